@@ -8,3 +8,66 @@ var RequestNotFound = errors.New("request not found")
 var InvalidToken = errors.New("invalid token")
 var RequestExpired = errors.New("request expired")
 var Unauthorized = errors.New("unauthorized")
+var Forbidden = errors.New("forbidden")
+
+// for authentication usage
+var InvalidCredentials = errors.New("invalid credentials")
+var AccountSuspended = errors.New("account suspended")
+var TooManyAttempts = errors.New("too many attempts")
+var InvalidScope = errors.New("invalid scope")
+
+// for password policy usage
+var PasswordPolicyViolated = errors.New("password policy violated")
+var PasswordReused = errors.New("password was used recently")
+
+// for registration usage
+var EmailTaken = errors.New("email taken")
+var UsernameTaken = errors.New("username taken")
+var InvalidEmail = errors.New("invalid email")
+var InvalidUsername = errors.New("invalid username")
+var InvalidName = errors.New("invalid name")
+
+// for session usage
+var SessionNotFound = errors.New("session not found")
+
+// for role usage
+var RoleNotFound = errors.New("role not found")
+
+// for organization usage
+var MemberExist = errors.New("member exist")
+var NotOrganizationMember = errors.New("not an organization member")
+var InvalidOrganizationRole = errors.New("invalid organization role")
+var OwnershipChanged = errors.New("organization owner changed")
+
+// for API key usage
+var InvalidAPIKeyPrefix = errors.New("api key prefix must not be empty")
+
+// for OAuth provider usage
+var MissingSigningKey = errors.New("oauth provider requires a signing key")
+
+// for local cache usage
+var InvalidCacheCapacity = errors.New("local cache capacity must be positive")
+var InvalidCacheLifeSpan = errors.New("local cache life span must be positive")
+
+// for device authorization usage
+var AuthorizationPending = errors.New("authorization pending")
+var SlowDown = errors.New("polling too frequently")
+var AccessDenied = errors.New("access denied")
+var UserCodeUnavailable = errors.New("no free user code")
+
+// for token revocation usage
+var UnsupportedTokenType = errors.New("unsupported token type")
+
+// for migration usage
+var SchemaOutdated = errors.New("database schema is outdated, run the pending migrations")
+
+// for account listing usage
+var InvalidFilter = errors.New("invalid filter")
+var InvalidCursor = errors.New("invalid cursor")
+
+// for account search usage
+var SearchUnsupported = errors.New("full-text search requires PostgreSQL")
+
+// for account deletion usage
+var AccountNotFound = errors.New("account not found")
+var RestoreWindowExpired = errors.New("restore window expired")
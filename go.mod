@@ -3,16 +3,18 @@ module github.com/lefalya/commonuser
 go 1.23.7
 
 require (
+	github.com/golang-jwt/jwt/v5 v5.3.0
 	github.com/lefalya/item v0.3.1
 	github.com/lefalya/pageflow v0.7.0
 	github.com/matthewhartstonge/argon2 v1.3.3
+	github.com/mattn/go-sqlite3 v1.14.32
 	github.com/redis/go-redis/v9 v9.7.0
+	golang.org/x/text v0.27.0
 )
 
 require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/golang-jwt/jwt/v5 v5.3.0 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	go.mongodb.org/mongo-driver v1.17.3 // indirect
 	golang.org/x/crypto v0.40.0 // indirect
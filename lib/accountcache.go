@@ -0,0 +1,302 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/lefalya/commonuser/definition"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+const accountCacheLifeSpan = 24 * time.Hour
+
+const (
+	accountIndexUUID     = "uuid"
+	accountIndexUsername = "username"
+	accountIndexEmail    = "email"
+	accountIndexRandId   = "randid"
+)
+
+// accountCache stores every account once, as <entity>:account:{<uuid>}, and
+// points <entity>:account:<index>:<value> keys for username, email and randId at
+// that uuid. An optional in-process tier sits in front of Redis and an optional
+// bus tells the other instances about invalidations.
+//
+// The index keys are looked up by value, so in cluster mode they land wherever
+// their value hashes and cannot share the account's slot; their writes are not
+// atomic with the record's. GetBy never trusts an index key its record does not
+// confirm, which makes any interleaving of those writes safe.
+type accountCache struct {
+	redis      redis.UniversalClient
+	entityName string
+	local      *localAccountCache
+	bus        *InvalidationBus
+}
+
+func (ac *accountCache) setLocal(capacity int, lifeSpan time.Duration) error {
+	if capacity <= 0 {
+		return definition.InvalidCacheCapacity
+	}
+	if lifeSpan <= 0 {
+		return definition.InvalidCacheLifeSpan
+	}
+	ac.local = newLocalAccountCache(capacity, lifeSpan)
+	return nil
+}
+
+// evict handles the events other instances publish. Dropping the uuid key is
+// enough for Redis, the index keys left behind are not trusted without it.
+func (ac *accountCache) evict(ctx context.Context, event AccountEvent) {
+	if ac.bus != nil && event.Origin == ac.bus.InstanceId() {
+		return
+	}
+	if ac.local != nil {
+		ac.local.Evict(event.AccountUUID)
+	}
+	ac.redis.Del(ctx, ac.key(accountIndexUUID, event.AccountUUID))
+}
+
+// accountRecord is the cached form of an account. Unlike the JSON of AccountSQL
+// it keeps every column but the password hash, which never leaves SQL; code
+// that checks a password reloads the account with a FindBy method first.
+type accountRecord struct {
+	UUID               string    `json:"uuid"`
+	RandId             string    `json:"randId"`
+	CreatedAt          time.Time `json:"createdAt"`
+	UpdatedAt          time.Time `json:"updatedAt"`
+	Name               string    `json:"name"`
+	Username           string    `json:"username"`
+	PasswordUpdatedAt  time.Time `json:"passwordUpdatedAt"`
+	MustChangePassword bool      `json:"mustChangePassword"`
+	Email              string    `json:"email"`
+	EmailVerified      bool      `json:"emailVerified"`
+	Avatar             string    `json:"avatar"`
+	Suspended          bool      `json:"suspended"`
+	ServiceAccount     bool      `json:"serviceAccount"`
+}
+
+func newAccountRecord(account *AccountSQL) accountRecord {
+	return accountRecord{
+		UUID:               account.GetUUID(),
+		RandId:             account.GetRandId(),
+		CreatedAt:          account.GetCreatedAt(),
+		UpdatedAt:          account.GetUpdatedAt(),
+		Name:               account.Name,
+		Username:           account.Username,
+		PasswordUpdatedAt:  account.PasswordUpdatedAt,
+		MustChangePassword: account.MustChangePassword,
+		Email:              account.Email,
+		EmailVerified:      account.EmailVerified,
+		Avatar:             account.Avatar,
+		Suspended:          account.Suspended,
+		ServiceAccount:     account.ServiceAccount,
+	}
+}
+
+func (ar accountRecord) account() *AccountSQL {
+	account := NewAccountSQL()
+	account.SQLItem.UUID = ar.UUID
+	account.SQLItem.RandId = ar.RandId
+	account.SQLItem.CreatedAt = ar.CreatedAt
+	account.SQLItem.UpdatedAt = ar.UpdatedAt
+	account.Base.Name = ar.Name
+	account.Base.Username = ar.Username
+	account.Base.PasswordUpdatedAt = ar.PasswordUpdatedAt
+	account.Base.MustChangePassword = ar.MustChangePassword
+	account.Base.Email = ar.Email
+	account.Base.EmailVerified = ar.EmailVerified
+	account.Base.Avatar = ar.Avatar
+	account.Base.Suspended = ar.Suspended
+	account.Base.ServiceAccount = ar.ServiceAccount
+	return account
+}
+
+// indexes maps every index of the record to its value; empty values are not
+// indexed.
+func (ar accountRecord) indexes() map[string]string {
+	indexes := map[string]string{}
+	if ar.Username != "" {
+		indexes[accountIndexUsername] = ar.Username
+	}
+	if ar.Email != "" {
+		indexes[accountIndexEmail] = ar.Email
+	}
+	if ar.RandId != "" {
+		indexes[accountIndexRandId] = ar.RandId
+	}
+	return indexes
+}
+
+func (ac *accountCache) key(index string, value string) string {
+	if index == accountIndexUUID {
+		return ac.entityName + ":account:{" + value + "}"
+	}
+	return ac.entityName + ":account:" + index + ":" + value
+}
+
+func (ac *accountCache) record(ctx context.Context, uuid string) (*accountRecord, error) {
+	payload, errGet := ac.redis.Get(ctx, ac.key(accountIndexUUID, uuid)).Bytes()
+	if errGet != nil {
+		if errors.Is(errGet, redis.Nil) {
+			return nil, nil
+		}
+		return nil, errGet
+	}
+
+	var record accountRecord
+	errUnmarshal := json.Unmarshal(payload, &record)
+	if errUnmarshal != nil {
+		// an unreadable entry is treated as a miss and overwritten on the next load
+		return nil, nil
+	}
+	return &record, nil
+}
+
+// Get returns the cached account, nil on a miss.
+func (ac *accountCache) Get(ctx context.Context, uuid string) (*AccountSQL, error) {
+	if ac.local != nil {
+		if account := ac.local.Get(uuid); account != nil {
+			return account, nil
+		}
+	}
+
+	record, errRecord := ac.record(ctx, uuid)
+	if errRecord != nil || record == nil {
+		return nil, errRecord
+	}
+	account := record.account()
+	if ac.local != nil {
+		ac.local.Set(account)
+	}
+	return account, nil
+}
+
+// GetBy resolves the account through one of its index keys, nil on a miss. An
+// index key left behind by an older version of the account is not trusted.
+func (ac *accountCache) GetBy(ctx context.Context, index string, value string) (*AccountSQL, error) {
+	if index == accountIndexUUID {
+		return ac.Get(ctx, value)
+	}
+	if ac.local != nil {
+		if account := ac.local.GetBy(index, value); account != nil {
+			return account, nil
+		}
+	}
+
+	uuid, errGet := ac.redis.Get(ctx, ac.key(index, value)).Result()
+	if errGet != nil {
+		if errors.Is(errGet, redis.Nil) {
+			return nil, nil
+		}
+		return nil, errGet
+	}
+
+	record, errRecord := ac.record(ctx, uuid)
+	if errRecord != nil || record == nil {
+		return nil, errRecord
+	}
+	if record.indexes()[index] != value {
+		return nil, nil
+	}
+	account := record.account()
+	if ac.local != nil {
+		ac.local.Set(account)
+	}
+	return account, nil
+}
+
+// Set stores the account under its uuid, points its index keys at it and drops
+// the index keys of values the account no longer has.
+func (ac *accountCache) Set(ctx context.Context, account *AccountSQL) error {
+	record := newAccountRecord(account)
+	payload, errMarshal := json.Marshal(record)
+	if errMarshal != nil {
+		return errMarshal
+	}
+
+	previous, errPrevious := ac.record(ctx, record.UUID)
+	if errPrevious != nil {
+		return errPrevious
+	}
+
+	indexes := record.indexes()
+	// the keys span slots, a MULTI would fail in cluster mode
+	pipeline := ac.redis.Pipeline()
+	if previous != nil {
+		for index, value := range previous.indexes() {
+			if indexes[index] != value {
+				pipeline.Del(ctx, ac.key(index, value))
+			}
+		}
+	}
+	pipeline.Set(ctx, ac.key(accountIndexUUID, record.UUID), payload, accountCacheLifeSpan)
+	for index, value := range indexes {
+		pipeline.Set(ctx, ac.key(index, value), record.UUID, accountCacheLifeSpan)
+	}
+	_, errExec := pipeline.Exec(ctx)
+	if errExec != nil {
+		return errExec
+	}
+
+	if ac.local != nil {
+		ac.local.Set(account)
+	}
+	return nil
+}
+
+// Invalidate drops the cached account together with every index key pointing
+// at it, including those of account values that are not cached anymore, then
+// publishes event for the other instances.
+func (ac *accountCache) Invalidate(ctx context.Context, account *AccountSQL, event string) error {
+	if ac.local != nil {
+		ac.local.Evict(account.GetUUID())
+	}
+
+	keys := []string{ac.key(accountIndexUUID, account.GetUUID())}
+	for index, value := range newAccountRecord(account).indexes() {
+		keys = append(keys, ac.key(index, value))
+	}
+
+	previous, errPrevious := ac.record(ctx, account.GetUUID())
+	if errPrevious != nil {
+		return errPrevious
+	}
+	if previous != nil {
+		for index, value := range previous.indexes() {
+			keys = append(keys, ac.key(index, value))
+		}
+	}
+	// one DEL per key, a multi-key DEL across slots fails in cluster mode
+	pipeline := ac.redis.Pipeline()
+	for _, key := range keys {
+		pipeline.Del(ctx, key)
+	}
+	_, errDel := pipeline.Exec(ctx)
+	if errDel != nil {
+		return errDel
+	}
+
+	if ac.bus != nil {
+		return ac.bus.Publish(ctx, event, account.GetUUID())
+	}
+	return nil
+}
+
+// invalidateAccount invalidates account in cache, when one is set, once tx
+// committed.
+func invalidateAccount(ctx context.Context, tx *Tx, cache *accountCache, account AccountSQL, event string) error {
+	if cache == nil {
+		return nil
+	}
+	return afterCommit(tx, func() error {
+		return cache.Invalidate(ctx, &account, event)
+	})
+}
+
+func newAccountCache(redis redis.UniversalClient, entityName string) *accountCache {
+	return &accountCache{
+		redis:      redis,
+		entityName: entityName,
+	}
+}
@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/lefalya/commonuser/definition"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccountRecordOmitsPassword(t *testing.T) {
+	account := newTestAccount()
+	account.Password = "$2a$10$hash"
+
+	record, errMarshal := json.Marshal(newAccountRecord(account))
+	if errMarshal != nil {
+		t.Fatal(errMarshal)
+	}
+	if strings.Contains(string(record), account.Password) {
+		t.Errorf("the password hash is cached in %s", record)
+	}
+}
+
+func TestSetLocalRejectsInvalidBounds(t *testing.T) {
+	cache := &accountCache{}
+	if err := cache.setLocal(0, time.Minute); !errors.Is(err, definition.InvalidCacheCapacity) {
+		t.Errorf("got %v for a zero capacity, want %v", err, definition.InvalidCacheCapacity)
+	}
+	if err := cache.setLocal(10, 0); !errors.Is(err, definition.InvalidCacheLifeSpan) {
+		t.Errorf("got %v for a zero life span, want %v", err, definition.InvalidCacheLifeSpan)
+	}
+	if cache.local != nil {
+		t.Error("an invalid local cache was installed")
+	}
+	if err := cache.setLocal(10, time.Minute); err != nil || cache.local == nil {
+		t.Errorf("a valid local cache was refused: %v", err)
+	}
+}
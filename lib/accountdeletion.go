@@ -0,0 +1,226 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"github.com/lefalya/commonuser/definition"
+	"time"
+)
+
+const defaultDeletionGrace = 30 * 24 * time.Hour
+
+const purgeBatchSize = 100
+
+// accountOwnedTables lists the tables whose rows belong to one account through
+// their accountuuid column and go away with it on Purge. Organizations the
+// account owns are handed over first, see handOverOrganizations.
+var accountOwnedTables = []string{
+	"ResetPassword",
+	"UpdateEmail",
+	"EmailVerification",
+	"PasswordHistory",
+	"AccountRole",
+	"OrganizationMember",
+	"APIKey",
+	"ClientCredential",
+	"OAuthConsent",
+}
+
+// Restore brings back an account deleted less than the deletion grace period
+// ago.
+func (asql *AccountManagerSQL) Restore(uuid string) (*AccountSQL, error) {
+	return asql.RestoreContext(context.Background(), uuid)
+}
+
+func (asql *AccountManagerSQL) RestoreContext(ctx context.Context, uuid string) (*AccountSQL, error) {
+	var restored *AccountSQL
+	errRestore := asql.inTx(ctx, func(accounts *AccountManagerSQL) error {
+		var deletedAt sql.NullTime
+		query := "SELECT deletedat FROM " + accounts.db.table(accounts.entityName) + " WHERE uuid = $1"
+		errScan := accounts.conn().QueryRowContext(ctx, query, uuid).Scan(&deletedAt)
+		if errScan != nil {
+			if errScan == sql.ErrNoRows {
+				return definition.AccountNotFound
+			}
+			return errScan
+		}
+		if !deletedAt.Valid {
+			return definition.AccountNotFound
+		}
+		if time.Since(deletedAt.Time) > accounts.deletionGrace {
+			return definition.RestoreWindowExpired
+		}
+
+		update := "UPDATE " + accounts.db.table(accounts.entityName) + " SET deletedat = NULL, updatedat = $1 WHERE uuid = $2 AND deletedat IS NOT NULL"
+		result, errUpdate := accounts.conn().ExecContext(ctx, update, time.Now().UTC(), uuid)
+		if errUpdate != nil {
+			return errUpdate
+		}
+		// a concurrent Purge or Restore got there first
+		errAffected := requireAffected(result, definition.AccountNotFound)
+		if errAffected != nil {
+			return errAffected
+		}
+
+		account, errFind := accounts.FindByUUIDContext(ctx, uuid)
+		if errFind != nil {
+			return errFind
+		}
+		restored = account
+		return accounts.cacheAccount(ctx, account)
+	})
+	if errRestore != nil {
+		return nil, errRestore
+	}
+	return restored, nil
+}
+
+// Purge hard-deletes the accounts deleted longer than the deletion grace period
+// ago together with every row they own, which frees their username and email.
+// Organizations they own pass to another member, or are deleted when they have
+// none. It returns how many accounts were purged and is meant to run
+// periodically.
+func (asql *AccountManagerSQL) Purge() (int, error) {
+	return asql.PurgeContext(context.Background())
+}
+
+func (asql *AccountManagerSQL) PurgeContext(ctx context.Context) (int, error) {
+	cutoff := time.Now().UTC().Add(-asql.deletionGrace)
+	query := "SELECT " + accountColumns + " FROM " + asql.db.table(asql.entityName) + " WHERE deletedat IS NOT NULL AND deletedat <= $1 ORDER BY deletedat LIMIT $2"
+
+	purged := 0
+	for {
+		expired, errExpired := asql.findExpired(ctx, query, cutoff)
+		if errExpired != nil {
+			return purged, errExpired
+		}
+
+		for _, account := range expired {
+			removed := false
+			errPurge := asql.inTx(ctx, func(accounts *AccountManagerSQL) error {
+				var errRemove error
+				removed, errRemove = accounts.purgeAccount(ctx, account, cutoff)
+				return errRemove
+			})
+			if errPurge != nil {
+				return purged, errPurge
+			}
+			if removed {
+				purged++
+			}
+		}
+
+		if len(expired) < purgeBatchSize {
+			return purged, nil
+		}
+	}
+}
+
+func (asql *AccountManagerSQL) findExpired(ctx context.Context, query string, cutoff time.Time) ([]AccountSQL, error) {
+	rows, errQuery := asql.conn().QueryContext(ctx, query, cutoff, purgeBatchSize)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	var accounts []AccountSQL
+	for rows.Next() {
+		account, errScan := scanAccount(rows)
+		if errScan != nil {
+			return nil, errScan
+		}
+		accounts = append(accounts, *account)
+	}
+	return accounts, rows.Err()
+}
+
+// purgeAccount reports false when the account was restored in the meantime.
+func (asql *AccountManagerSQL) purgeAccount(ctx context.Context, account AccountSQL, cutoff time.Time) (bool, error) {
+	conn := asql.conn()
+	// the account row goes first so that an account restored in the meantime
+	// keeps its rows
+	query := "DELETE FROM " + conn.table(asql.entityName) + " WHERE uuid = $1 AND deletedat IS NOT NULL AND deletedat <= $2"
+	result, errDelete := conn.ExecContext(ctx, query, account.GetUUID(), cutoff)
+	if errDelete != nil {
+		return false, errDelete
+	}
+	affected, errAffected := result.RowsAffected()
+	if errAffected != nil || affected == 0 {
+		return false, errAffected
+	}
+
+	errHandOver := asql.handOverOrganizations(ctx, conn, account.GetUUID())
+	if errHandOver != nil {
+		return false, errHandOver
+	}
+
+	for _, suffix := range accountOwnedTables {
+		_, errOwned := conn.ExecContext(ctx, "DELETE FROM "+conn.table(asql.entityName+suffix)+" WHERE accountuuid = $1", account.GetUUID())
+		if errOwned != nil {
+			return false, errOwned
+		}
+	}
+	return true, asql.invalidateCache(ctx, &account, AccountDeleted)
+}
+
+// handOverOrganizations passes every organization the account owns to its
+// longest-standing admin, or member when it has no admin, and deletes the ones
+// the account was the only member of.
+func (asql *AccountManagerSQL) handOverOrganizations(ctx context.Context, conn sqlConn, accountUUID string) error {
+	organizationTable := conn.table(asql.entityName + "Organization")
+	memberTable := conn.table(asql.entityName + "OrganizationMember")
+	invitationTable := conn.table(asql.entityName + "OrganizationInvitation")
+
+	rows, errQuery := conn.QueryContext(ctx, "SELECT uuid FROM "+organizationTable+" WHERE owneruuid = $1", accountUUID)
+	if errQuery != nil {
+		return errQuery
+	}
+	var organizationUUIDs []string
+	for rows.Next() {
+		var organizationUUID string
+		errScan := rows.Scan(&organizationUUID)
+		if errScan != nil {
+			rows.Close()
+			return errScan
+		}
+		organizationUUIDs = append(organizationUUIDs, organizationUUID)
+	}
+	rows.Close()
+	if errRows := rows.Err(); errRows != nil {
+		return errRows
+	}
+
+	timeNow := time.Now().UTC()
+	successorQuery := "SELECT accountuuid FROM " + memberTable + " WHERE organizationuuid = $1 AND accountuuid <> $2 ORDER BY CASE WHEN role = $3 THEN 0 ELSE 1 END, createdat LIMIT 1"
+	for _, organizationUUID := range organizationUUIDs {
+		var successorUUID string
+		errScan := conn.QueryRowContext(ctx, successorQuery, organizationUUID, accountUUID, OrganizationRoleAdmin).Scan(&successorUUID)
+		if errScan != nil && errScan != sql.ErrNoRows {
+			return errScan
+		}
+
+		statements := []struct {
+			query string
+			args  []any
+		}{
+			{"UPDATE " + organizationTable + " SET owneruuid = $1, updatedat = $2 WHERE uuid = $3", []any{successorUUID, timeNow, organizationUUID}},
+			{"UPDATE " + memberTable + " SET role = $1 WHERE organizationuuid = $2 AND accountuuid = $3", []any{OrganizationRoleOwner, organizationUUID, successorUUID}},
+		}
+		if errScan == sql.ErrNoRows {
+			statements = []struct {
+				query string
+				args  []any
+			}{
+				{"DELETE FROM " + invitationTable + " WHERE organizationuuid = $1", []any{organizationUUID}},
+				{"DELETE FROM " + organizationTable + " WHERE uuid = $1", []any{organizationUUID}},
+			}
+		}
+		for _, statement := range statements {
+			_, errExec := conn.ExecContext(ctx, statement.query, statement.args...)
+			if errExec != nil {
+				return errExec
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/lefalya/commonuser/definition"
+	"testing"
+	"time"
+)
+
+// newTestAccounts creates the accounts in a fresh database.
+func newTestAccounts(t *testing.T, emails ...string) (*sql.DB, *AccountManagerSQL, []*AccountSQL) {
+	t.Helper()
+	db := newTestDB(t)
+	accounts := NewAccountManagerSQL(db, newFakeRedis(), testEntityName)
+	accounts.SetDeletionGracePeriod(time.Hour)
+
+	var created []*AccountSQL
+	for _, email := range emails {
+		account := newTestMember(email)
+		if err := accounts.Create(*account); err != nil {
+			t.Fatal(err)
+		}
+		created = append(created, account)
+	}
+	return db, accounts, created
+}
+
+// deleteAt soft-deletes account and backdates the deletion to deletedAt.
+func deleteAt(t *testing.T, db *sql.DB, accounts *AccountManagerSQL, account *AccountSQL, deletedAt time.Time) {
+	t.Helper()
+	if err := accounts.Delete(*account); err != nil {
+		t.Fatal(err)
+	}
+	conn := newSQLDB(db)
+	_, errUpdate := conn.Exec("UPDATE "+conn.table(testEntityName)+" SET deletedat = $1 WHERE uuid = $2", deletedAt.UTC(), account.GetUUID())
+	if errUpdate != nil {
+		t.Fatal(errUpdate)
+	}
+}
+
+func TestRestoreWithinGracePeriod(t *testing.T) {
+	db, accounts, created := newTestAccounts(t, "ada@example.com", "charles@example.com")
+	recent, expired := created[0], created[1]
+
+	if _, err := accounts.Restore(recent.GetUUID()); !errors.Is(err, definition.AccountNotFound) {
+		t.Errorf("got %v restoring a live account, want %v", err, definition.AccountNotFound)
+	}
+
+	deleteAt(t, db, accounts, recent, time.Now().Add(-30*time.Minute))
+	restored, errRestore := accounts.Restore(recent.GetUUID())
+	if errRestore != nil {
+		t.Fatal(errRestore)
+	}
+	if restored == nil || restored.Email != recent.Email {
+		t.Fatalf("restored %+v", restored)
+	}
+
+	deleteAt(t, db, accounts, expired, time.Now().Add(-2*time.Hour))
+	if _, err := accounts.Restore(expired.GetUUID()); !errors.Is(err, definition.RestoreWindowExpired) {
+		t.Errorf("got %v past the grace period, want %v", err, definition.RestoreWindowExpired)
+	}
+}
+
+func TestPurgeHandsOverOrganizations(t *testing.T) {
+	db, accounts, created := newTestAccounts(t, "owner@example.com", "member@example.com", "admin@example.com", "recent@example.com")
+	owner, member, admin, recent := created[0], created[1], created[2], created[3]
+
+	organizations := NewOrganizationManagerSQL(db, testEntityName)
+	shared, errCreate := organizations.Create(owner, "Analytical Engines")
+	if errCreate != nil {
+		t.Fatal(errCreate)
+	}
+	// the member joined first, but an admin takes precedence
+	if err := organizations.AddMember(shared, member, OrganizationRoleMember); err != nil {
+		t.Fatal(err)
+	}
+	if err := organizations.AddMember(shared, admin, OrganizationRoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	solo, errCreate := organizations.Create(owner, "Difference Engines")
+	if errCreate != nil {
+		t.Fatal(errCreate)
+	}
+	if _, err := organizations.CreateInvitation(solo, owner, "guest@example.com", OrganizationRoleMember); err != nil {
+		t.Fatal(err)
+	}
+
+	deleteAt(t, db, accounts, owner, time.Now().Add(-2*time.Hour))
+	deleteAt(t, db, accounts, recent, time.Now().Add(-time.Minute))
+	purged, errPurge := accounts.Purge()
+	if errPurge != nil {
+		t.Fatal(errPurge)
+	}
+	if purged != 1 {
+		t.Fatalf("purged %d accounts, want 1", purged)
+	}
+
+	handedOver, errFind := organizations.Find(shared.GetUUID())
+	if errFind != nil {
+		t.Fatal(errFind)
+	}
+	if handedOver == nil || handedOver.OwnerUUID != admin.GetUUID() {
+		t.Fatalf("got %+v, want it owned by the admin", handedOver)
+	}
+	successor, errMember := organizations.FindMember(shared.GetUUID(), admin.GetUUID())
+	if errMember != nil {
+		t.Fatal(errMember)
+	}
+	if successor == nil || successor.Role != OrganizationRoleOwner {
+		t.Errorf("the successor is %+v, want the owner role", successor)
+	}
+	if former, _ := organizations.FindMember(shared.GetUUID(), owner.GetUUID()); former != nil {
+		t.Error("the purged owner is still a member")
+	}
+
+	if deleted, _ := organizations.Find(solo.GetUUID()); deleted != nil {
+		t.Error("the organization without other members survived")
+	}
+	if invitation, _ := organizations.FindInvitation(solo.GetUUID(), "guest@example.com"); invitation != nil {
+		t.Error("the deleted organization's invitation survived")
+	}
+
+	if account, _ := accounts.FindByUUID(owner.GetUUID()); account != nil {
+		t.Error("the purged account is still there")
+	}
+	if _, err := accounts.Restore(recent.GetUUID()); err != nil {
+		t.Errorf("the account inside the grace period was purged: %v", err)
+	}
+}
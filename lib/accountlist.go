@@ -0,0 +1,205 @@
+package lib
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/lefalya/commonuser/definition"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ListByCreatedAt = "createdat"
+	ListByUpdatedAt = "updatedat"
+)
+
+// How an account signs in, as told by its columns: a password, a service
+// account credential, or an external identity provider for accounts without
+// a password.
+const (
+	AccountProviderPassword = "password"
+	AccountProviderService  = "service"
+	AccountProviderExternal = "external"
+)
+
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+// AccountFilter selects and orders the accounts returned by ListAccounts. Zero
+// values do not filter.
+type AccountFilter struct {
+	// OrderBy is ListByCreatedAt, the default, or ListByUpdatedAt.
+	OrderBy   string
+	Ascending bool
+
+	Suspended     *bool
+	EmailVerified *bool
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Provider      string
+	// Deleted lists the soft-deleted accounts instead of the active ones.
+	Deleted bool
+
+	// Search matches name, username and email case-insensitively by prefix,
+	// or anywhere when SearchSubstring is set.
+	Search          string
+	SearchSubstring bool
+
+	// Cursor is the NextCursor of the previous page.
+	Cursor string
+	Limit  int
+}
+
+type AccountPage struct {
+	Accounts []AccountSQL
+	// NextCursor is empty on the last page.
+	NextCursor string
+}
+
+// ListAccounts pages through the accounts matching filter. Pages are cut on
+// the ordering timestamp and the uuid, so accounts written while paging never
+// shift the following pages.
+//
+// The listing queries SQL directly rather than through pageflow: pageflow pages
+// Redis sorted sets kept in step with writes, which cannot apply the filters
+// and searches here without one sorted set per combination of them.
+func (asql *AccountManagerSQL) ListAccounts(filter AccountFilter) (*AccountPage, error) {
+	return asql.ListAccountsContext(context.Background(), filter)
+}
+
+func (asql *AccountManagerSQL) ListAccountsContext(ctx context.Context, filter AccountFilter) (*AccountPage, error) {
+	orderBy := filter.OrderBy
+	if orderBy == "" {
+		orderBy = ListByCreatedAt
+	}
+	if orderBy != ListByCreatedAt && orderBy != ListByUpdatedAt {
+		return nil, definition.InvalidFilter
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	conditions := []string{"deletedat IS NULL"}
+	if filter.Deleted {
+		conditions[0] = "deletedat IS NOT NULL"
+	}
+	var args []any
+	arg := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if filter.Suspended != nil {
+		conditions = append(conditions, "suspended = "+arg(*filter.Suspended))
+	}
+	if filter.EmailVerified != nil {
+		conditions = append(conditions, "emailverified = "+arg(*filter.EmailVerified))
+	}
+	if !filter.CreatedAfter.IsZero() {
+		conditions = append(conditions, "createdat >= "+arg(filter.CreatedAfter))
+	}
+	if !filter.CreatedBefore.IsZero() {
+		conditions = append(conditions, "createdat < "+arg(filter.CreatedBefore))
+	}
+
+	switch filter.Provider {
+	case "":
+	case AccountProviderPassword:
+		conditions = append(conditions, "serviceaccount = "+arg(false)+" AND password IS NOT NULL AND password <> ''")
+	case AccountProviderService:
+		conditions = append(conditions, "serviceaccount = "+arg(true))
+	case AccountProviderExternal:
+		conditions = append(conditions, "serviceaccount = "+arg(false)+" AND (password IS NULL OR password = '')")
+	default:
+		return nil, definition.InvalidFilter
+	}
+
+	if search := strings.TrimSpace(filter.Search); search != "" {
+		pattern := escapeLike(strings.ToLower(search)) + "%"
+		if filter.SearchSubstring {
+			pattern = "%" + pattern
+		}
+		placeholder := arg(pattern)
+		conditions = append(conditions, "(LOWER(name) LIKE "+placeholder+" ESCAPE '!' OR LOWER(username) LIKE "+placeholder+" ESCAPE '!' OR LOWER(email) LIKE "+placeholder+" ESCAPE '!')")
+	}
+
+	comparison, direction := "<", "DESC"
+	if filter.Ascending {
+		comparison, direction = ">", "ASC"
+	}
+	if filter.Cursor != "" {
+		position, uuid, errCursor := decodeListCursor(filter.Cursor)
+		if errCursor != nil {
+			return nil, errCursor
+		}
+		positionArg, uuidArg := arg(position), arg(uuid)
+		conditions = append(conditions, "("+orderBy+" "+comparison+" "+positionArg+" OR ("+orderBy+" = "+positionArg+" AND uuid "+comparison+" "+uuidArg+"))")
+	}
+
+	query := "SELECT " + accountColumns + " FROM " + asql.db.table(asql.entityName) + " WHERE " + strings.Join(conditions, " AND ")
+	// one extra row tells whether another page follows
+	query += " ORDER BY " + orderBy + " " + direction + ", uuid " + direction + " LIMIT " + arg(limit+1)
+
+	rows, errQuery := asql.conn().QueryContext(ctx, query, args...)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	page := &AccountPage{}
+	for rows.Next() {
+		account, errScan := scanAccount(rows)
+		if errScan != nil {
+			return nil, errScan
+		}
+		page.Accounts = append(page.Accounts, *account)
+	}
+	errRows := rows.Err()
+	if errRows != nil {
+		return nil, errRows
+	}
+
+	if len(page.Accounts) > limit {
+		page.Accounts = page.Accounts[:limit]
+		last := page.Accounts[limit-1]
+		position := last.GetCreatedAt()
+		if orderBy == ListByUpdatedAt {
+			position = last.GetUpdatedAt()
+		}
+		page.NextCursor = encodeListCursor(position, last.GetUUID())
+	}
+	return page, nil
+}
+
+// escapeLike escapes the LIKE wildcards of value for ESCAPE '!'.
+func escapeLike(value string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(value)
+}
+
+func encodeListCursor(position time.Time, uuid string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(position.UTC().Format(time.RFC3339Nano) + "|" + uuid))
+}
+
+func decodeListCursor(cursor string) (time.Time, string, error) {
+	decoded, errDecode := base64.RawURLEncoding.DecodeString(cursor)
+	if errDecode != nil {
+		return time.Time{}, "", definition.InvalidCursor
+	}
+	position, uuid, found := strings.Cut(string(decoded), "|")
+	if !found || uuid == "" {
+		return time.Time{}, "", definition.InvalidCursor
+	}
+	parsed, errParse := time.Parse(time.RFC3339Nano, position)
+	if errParse != nil {
+		return time.Time{}, "", definition.InvalidCursor
+	}
+	return parsed, uuid, nil
+}
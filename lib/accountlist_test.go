@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/lefalya/commonuser/definition"
+	"testing"
+	"time"
+)
+
+func TestListCursorRoundTrip(t *testing.T) {
+	position := time.Date(1843, time.July, 10, 12, 30, 0, 123456789, time.FixedZone("GMT+1", 3600))
+	decoded, uuid, errDecode := decodeListCursor(encodeListCursor(position, "4c4a1d6e"))
+	if errDecode != nil {
+		t.Fatal(errDecode)
+	}
+	if !decoded.Equal(position) || uuid != "4c4a1d6e" {
+		t.Errorf("got %v %q, want %v %q", decoded, uuid, position, "4c4a1d6e")
+	}
+}
+
+func TestDecodeListCursorRejectsGarbage(t *testing.T) {
+	encode := func(value string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	tests := []string{
+		"",
+		"not base64!",
+		encode("2024-01-02T03:04:05Z"),
+		encode("2024-01-02T03:04:05Z|"),
+		encode("yesterday|4c4a1d6e"),
+		base64.StdEncoding.EncodeToString([]byte("2024-01-02T03:04:05Z|4c4a1d6e?")),
+	}
+	for _, cursor := range tests {
+		if _, _, err := decodeListCursor(cursor); !errors.Is(err, definition.InvalidCursor) {
+			t.Errorf("cursor %q: got %v, want %v", cursor, err, definition.InvalidCursor)
+		}
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "ada", want: "ada"},
+		{value: "100%", want: "100!%"},
+		{value: "ada_l", want: "ada!_l"},
+		{value: "wow!", want: "wow!!"},
+		{value: "!%_", want: "!!!%!_"},
+	}
+	for _, test := range tests {
+		if got := escapeLike(test.value); got != test.want {
+			t.Errorf("escapeLike(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
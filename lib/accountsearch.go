@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"context"
+	"embed"
+	"github.com/lefalya/commonuser/definition"
+	"strings"
+	"unicode"
+)
+
+//go:embed optional/account_search.*.sql
+var accountSearchFiles embed.FS
+
+// accountSearchMigration creates the full-text search column and indexes. It is
+// kept out of the versioned migrations because it is PostgreSQL only, needs the
+// pg_trgm extension and rewrites the account table to fill the column.
+func accountSearchMigration() (Migration, error) {
+	up, errUp := accountSearchFiles.ReadFile("optional/account_search.up.sql")
+	if errUp != nil {
+		return Migration{}, errUp
+	}
+	down, errDown := accountSearchFiles.ReadFile("optional/account_search.down.sql")
+	if errDown != nil {
+		return Migration{}, errDown
+	}
+	return Migration{Name: "account_search", up: string(up), down: string(down)}, nil
+}
+
+// EnableAccountSearch adds the generated tsvector column with its GIN index and
+// a trigram index on usernames, then AccountManagerSQL.SetAccountSearch can be
+// switched on. Running it again is harmless.
+func (mg *Migrator) EnableAccountSearch() error {
+	return mg.applyAccountSearch(true)
+}
+
+func (mg *Migrator) DisableAccountSearch() error {
+	return mg.applyAccountSearch(false)
+}
+
+func (mg *Migrator) applyAccountSearch(up bool) error {
+	dialect := mg.db.dialect()
+	if dialect.Name() != PostgreSQL.Name() {
+		return definition.SearchUnsupported
+	}
+
+	migration, errMigration := accountSearchMigration()
+	if errMigration != nil {
+		return errMigration
+	}
+	statements, errStatements := migration.Statements(dialect, mg.entityName, up)
+	if errStatements != nil {
+		return errStatements
+	}
+
+	label := "account_search (up)"
+	if !up {
+		label = "account_search (down)"
+	}
+	return mg.execute(label, statements)
+}
+
+type AccountSearchResult struct {
+	Account AccountSQL
+	Rank    float64
+}
+
+// SearchAccounts ranks the accounts whose name, username or email contain words
+// starting like the words of query. When no account matches, usernames similar
+// to query are returned instead, ranked by trigram similarity, so typos still
+// find their account. Without SetAccountSearch it falls back to a substring
+// search through ListAccounts, every result ranked 0.
+func (asql *AccountManagerSQL) SearchAccounts(query string, limit int) ([]AccountSearchResult, error) {
+	return asql.SearchAccountsContext(context.Background(), query, limit)
+}
+
+func (asql *AccountManagerSQL) SearchAccountsContext(ctx context.Context, query string, limit int) ([]AccountSearchResult, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, nil
+	}
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	if !asql.accountSearch {
+		page, errList := asql.ListAccountsContext(ctx, AccountFilter{
+			Search:          query,
+			SearchSubstring: true,
+			Limit:           limit,
+		})
+		if errList != nil {
+			return nil, errList
+		}
+		results := make([]AccountSearchResult, 0, len(page.Accounts))
+		for _, account := range page.Accounts {
+			results = append(results, AccountSearchResult{Account: account})
+		}
+		return results, nil
+	}
+
+	table := asql.db.table(asql.entityName)
+	if tsQuery := prefixTSQuery(query); tsQuery != "" {
+		results, errSearch := asql.rankAccounts(ctx, "SELECT "+accountColumns+", ts_rank(searchvector, to_tsquery('simple', $1)) AS rank FROM "+table+" WHERE searchvector @@ to_tsquery('simple', $1) AND deletedat IS NULL ORDER BY rank DESC, uuid LIMIT $2", tsQuery, limit)
+		if errSearch != nil || len(results) > 0 {
+			return results, errSearch
+		}
+	}
+	return asql.rankAccounts(ctx, "SELECT "+accountColumns+", similarity(username, $1) AS rank FROM "+table+" WHERE username % $1 AND deletedat IS NULL ORDER BY rank DESC, uuid LIMIT $2", strings.ToLower(query), limit)
+}
+
+func (asql *AccountManagerSQL) rankAccounts(ctx context.Context, query string, term string, limit int) ([]AccountSearchResult, error) {
+	rows, errQuery := asql.conn().QueryContext(ctx, query, term, limit)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	var results []AccountSearchResult
+	for rows.Next() {
+		var rank float64
+		account, errScan := scanAccount(rankedRow{rows: rows, rank: &rank})
+		if errScan != nil {
+			return nil, errScan
+		}
+		results = append(results, AccountSearchResult{Account: *account, Rank: rank})
+	}
+	return results, rows.Err()
+}
+
+// rankedRow lets scanAccount read a row selected with accountColumns followed
+// by a rank.
+type rankedRow struct {
+	rows interface{ Scan(dest ...any) error }
+	rank *float64
+}
+
+func (rr rankedRow) Scan(dest ...any) error {
+	return rr.rows.Scan(append(dest, rr.rank)...)
+}
+
+// prefixTSQuery turns the words of query into a tsquery matching lexemes that
+// start with every one of them. Only letters and digits are kept, so the
+// result is always a valid tsquery.
+func prefixTSQuery(query string) string {
+	words := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, word := range words {
+		words[i] = word + ":*"
+	}
+	return strings.Join(words, " & ")
+}
@@ -0,0 +1,40 @@
+package lib
+
+import (
+	"errors"
+	"github.com/lefalya/commonuser/definition"
+	"testing"
+)
+
+func TestPrefixTSQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: "", want: ""},
+		{query: "Ada", want: "ada:*"},
+		{query: "ada lovelace", want: "ada:* & lovelace:*"},
+		{query: "  ada\t1815 ", want: "ada:* & 1815:*"},
+		{query: "ada's | !engine & (notes)", want: "ada:* & s:* & engine:* & notes:*"},
+		{query: "Ada:* & <->", want: "ada:*"},
+		{query: "Zoë Müller", want: "zoë:* & müller:*"},
+	}
+	for _, test := range tests {
+		if got := prefixTSQuery(test.query); got != test.want {
+			t.Errorf("prefixTSQuery(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestSetAccountSearchRequiresPostgreSQL(t *testing.T) {
+	accounts := NewAccountManagerSQL(newTestDB(t), newFakeRedis(), testEntityName)
+	if err := accounts.SetAccountSearch(true); !errors.Is(err, definition.SearchUnsupported) {
+		t.Fatalf("got %v on SQLite, want %v", err, definition.SearchUnsupported)
+	}
+	if accounts.accountSearch {
+		t.Error("account search enabled on SQLite")
+	}
+	if err := accounts.SetAccountSearch(false); err != nil {
+		t.Errorf("disabling account search failed: %v", err)
+	}
+}
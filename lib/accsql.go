@@ -1,9 +1,11 @@
 package lib
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/lefalya/commonuser/definition"
 	"github.com/lefalya/pageflow"
 	"github.com/redis/go-redis/v9"
 	"time"
@@ -15,16 +17,30 @@ type AccountSQL struct {
 }
 
 func (asql *AccountSQL) GenerateAccessToken(jwtSecret string, jwtTokenIssuer string, jwtTokenLifeSpan int) (string, error) {
+	return asql.GenerateScopedAccessToken(jwtSecret, jwtTokenIssuer, "", time.Hour*time.Duration(jwtTokenLifeSpan))
+}
+
+// GenerateScopedAccessToken issues an access token restricted to scope. An empty
+// scope yields a regular, unrestricted access token.
+func (asql *AccountSQL) GenerateScopedAccessToken(jwtSecret string, jwtTokenIssuer string, scope string, lifeSpan time.Duration) (string, error) {
+	userClaims := asql.newUserClaims(jwtTokenIssuer, lifeSpan)
+	userClaims.Scope = scope
+	return signToken(jwtSecret, userClaims)
+}
+
+func (asql *AccountSQL) newUserClaims(jwtTokenIssuer string, lifeSpan time.Duration) UserClaims {
 	timeNow := time.Now().UTC()
-	expirestAt := timeNow.Add(time.Hour * time.Duration(jwtTokenLifeSpan))
+	expirestAt := timeNow.Add(lifeSpan)
 
-	userClaims := UserClaims{
+	return UserClaims{
 		UUID:              asql.GetUUID(),
 		Name:              asql.Name,
 		Username:          asql.Username,
 		Email:             asql.Email,
 		Avatar:            asql.Avatar,
 		PasswordUpdatedAt: asql.PasswordUpdatedAt,
+		Roles:             asql.Roles,
+		Organization:      asql.ActiveOrganization,
 		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer: jwtTokenIssuer,
 			IssuedAt: &jwt.NumericDate{
@@ -35,8 +51,10 @@ func (asql *AccountSQL) GenerateAccessToken(jwtSecret string, jwtTokenIssuer str
 			},
 		},
 	}
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, userClaims)
+func signToken(jwtSecret string, claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenString, err := token.SignedString([]byte(jwtSecret))
 	if err != nil {
 		return "", err
@@ -46,11 +64,17 @@ func (asql *AccountSQL) GenerateAccessToken(jwtSecret string, jwtTokenIssuer str
 }
 
 func (asql *AccountSQL) GenerateRefreshToken(jwtSecret string, jwtTokenIssuer string, jwtTokenLifeSpan int) (string, error) {
+	return asql.generateRefreshToken(jwtSecret, jwtTokenIssuer, "", time.Hour*time.Duration(jwtTokenLifeSpan))
+}
+
+func (asql *AccountSQL) generateRefreshToken(jwtSecret string, jwtTokenIssuer string, sessionId string, lifeSpan time.Duration) (string, error) {
 	timeNow := time.Now().UTC()
-	expirestAt := timeNow.Add(time.Hour * time.Duration(jwtTokenLifeSpan))
+	expirestAt := timeNow.Add(lifeSpan)
 
 	refreshTokenClaims := RefreshTokenClaims{
-		UUID: asql.GetUUID(),
+		UUID:      asql.GetUUID(),
+		SessionId: sessionId,
+		TokenUse:  tokenUseRefresh,
 		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer: jwtTokenIssuer,
 			IssuedAt: &jwt.NumericDate{
@@ -62,13 +86,7 @@ func (asql *AccountSQL) GenerateRefreshToken(jwtSecret string, jwtTokenIssuer st
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshTokenClaims)
-	tokenString, err := token.SignedString([]byte(jwtSecret))
-	if err != nil {
-		return "", err
-	}
-
-	return tokenString, nil
+	return signToken(jwtSecret, refreshTokenClaims)
 }
 
 func NewAccountSQL() *AccountSQL {
@@ -81,70 +99,463 @@ func NewAccountSQL() *AccountSQL {
 }
 
 type AccountManagerSQL struct {
-	db         *sql.DB
-	base       *pageflow.Base[AccountSQL]
-	entityName string
+	db                *sqlDB
+	cache             *accountCache
+	entityName        string
+	passwordPolicy    *PasswordPolicy
+	passwordHistory   *PasswordHistoryManagerSQL
+	maxPasswordAge    time.Duration
+	notifier          Notifier
+	sessionRevoker    SessionRevoker
+	sessionManager    *SessionManager
+	jwtHandler        *JWTHandler
+	emailVerification *EmailVerificationManagerSQL
+	loginThrottler    LoginThrottler
+	mfaProvider       MFAProvider
+	roleManager       *RoleManagerSQL
+	accountSearch     bool
+	deletionGrace     time.Duration
+	tx                *Tx
+}
+
+// WithTx returns a copy of the manager, together with its password history and
+// email verification, that works inside tx. Cache writes, session revocations
+// and notifications of the copy wait for the commit.
+func (asql *AccountManagerSQL) WithTx(tx *Tx) *AccountManagerSQL {
+	bound := *asql
+	bound.tx = tx
+	if bound.passwordHistory != nil {
+		bound.passwordHistory = bound.passwordHistory.WithTx(tx)
+	}
+	if bound.emailVerification != nil {
+		bound.emailVerification = bound.emailVerification.WithTx(tx)
+	}
+	return &bound
+}
+
+func (asql *AccountManagerSQL) conn() sqlConn {
+	if asql.tx != nil {
+		return asql.tx
+	}
+	return asql.db
+}
+
+// inTx runs fn with the manager bound to its transaction, starting one when it
+// is not bound yet.
+func (asql *AccountManagerSQL) inTx(ctx context.Context, fn func(accounts *AccountManagerSQL) error) error {
+	if asql.tx != nil {
+		return fn(asql)
+	}
+	return RunInTx(ctx, asql.db.DB, func(tx *Tx) error {
+		return fn(asql.WithTx(tx))
+	})
 }
 
 func (asql *AccountManagerSQL) SetEntityName(entityName string) {
 	asql.entityName = entityName
 }
 
+func (asql *AccountManagerSQL) SetPasswordPolicy(policy *PasswordPolicy) {
+	asql.passwordPolicy = policy
+}
+
+func (asql *AccountManagerSQL) SetPasswordHistory(history *PasswordHistoryManagerSQL) {
+	asql.passwordHistory = history
+}
+
+func (asql *AccountManagerSQL) SetNotifier(notifier Notifier) {
+	asql.notifier = notifier
+}
+
+func (asql *AccountManagerSQL) SetSessionRevoker(sessionRevoker SessionRevoker) {
+	asql.sessionRevoker = sessionRevoker
+}
+
+// SetSessionManager binds the tokens of every login to a new session.
+func (asql *AccountManagerSQL) SetSessionManager(sessionManager *SessionManager) {
+	asql.sessionManager = sessionManager
+}
+
+func (asql *AccountManagerSQL) SetJWTHandler(jwtHandler *JWTHandler) {
+	asql.jwtHandler = jwtHandler
+}
+
+func (asql *AccountManagerSQL) SetEmailVerification(emailVerification *EmailVerificationManagerSQL) {
+	asql.emailVerification = emailVerification
+}
+
+// SetLocalCache puts an in-process LRU of up to capacity accounts in front of
+// the Redis cache. Without an invalidation bus other instances' writes only
+// reach it once lifeSpan passed. Both capacity and lifeSpan must be positive.
+func (asql *AccountManagerSQL) SetLocalCache(capacity int, lifeSpan time.Duration) error {
+	return asql.cache.setLocal(capacity, lifeSpan)
+}
+
+// SetInvalidationBus broadcasts the manager's cache invalidations and evicts the
+// accounts other instances invalidate.
+func (asql *AccountManagerSQL) SetInvalidationBus(bus *InvalidationBus) {
+	asql.cache.bus = bus
+	bus.OnAccountEvent(asql.cache.evict)
+}
+
+// SetDeletionGracePeriod sets how long a deleted account can be restored before
+// Purge removes it, 30 days by default.
+func (asql *AccountManagerSQL) SetDeletionGracePeriod(grace time.Duration) {
+	asql.deletionGrace = grace
+}
+
+// SetAccountSearch makes SearchAccounts use the full-text search index created
+// by Migrator.EnableAccountSearch. Enabling it fails with
+// definition.SearchUnsupported outside PostgreSQL.
+func (asql *AccountManagerSQL) SetAccountSearch(enabled bool) error {
+	if enabled && asql.db.dialect().Name() != PostgreSQL.Name() {
+		return definition.SearchUnsupported
+	}
+	asql.accountSearch = enabled
+	return nil
+}
+
+func (asql *AccountManagerSQL) SetRoleManager(roleManager *RoleManagerSQL) {
+	asql.roleManager = roleManager
+}
+
+func (asql *AccountManagerSQL) AssignRole(account *AccountSQL, role string) error {
+	return asql.AssignRoleContext(context.Background(), account, role)
+}
+
+func (asql *AccountManagerSQL) AssignRoleContext(ctx context.Context, account *AccountSQL, role string) error {
+	if asql.roleManager == nil {
+		return errors.New("role manager is not configured")
+	}
+	errAssign := asql.roleManager.AssignRoleContext(ctx, account, role)
+	if errAssign != nil {
+		return errAssign
+	}
+	return asql.roleManager.LoadRolesContext(ctx, account)
+}
+
+func (asql *AccountManagerSQL) UnassignRole(account *AccountSQL, role string) error {
+	return asql.UnassignRoleContext(context.Background(), account, role)
+}
+
+func (asql *AccountManagerSQL) UnassignRoleContext(ctx context.Context, account *AccountSQL, role string) error {
+	if asql.roleManager == nil {
+		return errors.New("role manager is not configured")
+	}
+	errUnassign := asql.roleManager.UnassignRoleContext(ctx, account, role)
+	if errUnassign != nil {
+		return errUnassign
+	}
+	return asql.roleManager.LoadRolesContext(ctx, account)
+}
+
+func (asql *AccountManagerSQL) FindRoles(account *AccountSQL) ([]string, error) {
+	return asql.FindRolesContext(context.Background(), account)
+}
+
+func (asql *AccountManagerSQL) FindRolesContext(ctx context.Context, account *AccountSQL) ([]string, error) {
+	if asql.roleManager == nil {
+		return nil, errors.New("role manager is not configured")
+	}
+	return asql.roleManager.FindRolesContext(ctx, account.GetUUID())
+}
+
+// SetMaxPasswordAge enables password expiry; zero disables it.
+func (asql *AccountManagerSQL) SetMaxPasswordAge(maxPasswordAge time.Duration) {
+	asql.maxPasswordAge = maxPasswordAge
+}
+
+func (asql *AccountManagerSQL) PasswordChangeRequired(account *AccountSQL) bool {
+	return account.MustChangePassword || account.IsPasswordExpired(asql.maxPasswordAge)
+}
+
+func (asql *AccountManagerSQL) SetMustChangePassword(account *AccountSQL, mustChangePassword bool) error {
+	return asql.SetMustChangePasswordContext(context.Background(), account, mustChangePassword)
+}
+
+func (asql *AccountManagerSQL) SetMustChangePasswordContext(ctx context.Context, account *AccountSQL, mustChangePassword bool) error {
+	query := "UPDATE " + asql.db.table(asql.entityName) + " SET mustchangepassword = $1 WHERE uuid = $2 AND deletedat IS NULL"
+	result, errUpdate := asql.conn().ExecContext(ctx, query, mustChangePassword, account.GetUUID())
+	if errUpdate != nil {
+		return errUpdate
+	}
+	errAffected := requireAffected(result, definition.AccountNotFound)
+	if errAffected != nil {
+		return errAffected
+	}
+
+	account.MustChangePassword = mustChangePassword
+	return asql.invalidateCache(ctx, account, AccountChanged)
+}
+
+// FindPasswordsExpiringWithin lists accounts whose password is still valid but
+// expires before now + window.
+func (asql *AccountManagerSQL) FindPasswordsExpiringWithin(window time.Duration) ([]AccountSQL, error) {
+	return asql.FindPasswordsExpiringWithinContext(context.Background(), window)
+}
+
+func (asql *AccountManagerSQL) FindPasswordsExpiringWithinContext(ctx context.Context, window time.Duration) ([]AccountSQL, error) {
+	if asql.maxPasswordAge <= 0 {
+		return nil, errors.New("max password age is not configured")
+	}
+
+	timeNow := time.Now().UTC()
+	query := "SELECT " + accountColumns + " FROM " + asql.db.table(asql.entityName) + " WHERE passwordupdatedat > $1 AND passwordupdatedat <= $2 AND deletedat IS NULL ORDER BY passwordupdatedat ASC"
+	rows, errQuery := asql.conn().QueryContext(ctx, query, timeNow.Add(-asql.maxPasswordAge), timeNow.Add(window-asql.maxPasswordAge))
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	var accounts []AccountSQL
+	for rows.Next() {
+		account, errScan := scanAccount(rows)
+		if errScan != nil {
+			return nil, errScan
+		}
+		accounts = append(accounts, *account)
+	}
+	return accounts, rows.Err()
+}
+
 func (asql *AccountManagerSQL) Create(account AccountSQL) error {
-	query := "INSERT INTO $1 (name, username, password, email, avatar, suspended) VALUES ($2, $3, $4, $5, $6, $7)"
-	_, errInsert := asql.db.Exec(query, asql.entityName, account.Name, account.Username, account.Password, account.Email, account.Avatar, account.Suspended)
+	return asql.CreateContext(context.Background(), account)
+}
+
+func (asql *AccountManagerSQL) CreateContext(ctx context.Context, account AccountSQL) error {
+	errInsert := insertAccount(ctx, asql.conn(), asql.entityName, account)
 	if errInsert != nil {
 		return errInsert
 	}
-	if account.Username != "" {
-		asql.base.Set(account, account.Username)
-	} else {
-		asql.base.Set(account)
+	return asql.cacheAccount(ctx, &account)
+}
+
+// cacheAccount and invalidateCache wait for the commit inside a transaction.
+// Their errors are returned like any other write's, so a stale cache never
+// goes unnoticed.
+func (asql *AccountManagerSQL) cacheAccount(ctx context.Context, account *AccountSQL) error {
+	cached := *account
+	return afterCommit(asql.tx, func() error {
+		return asql.cache.Set(ctx, &cached)
+	})
+}
+
+func (asql *AccountManagerSQL) invalidateCache(ctx context.Context, account *AccountSQL, event string) error {
+	invalidated := *account
+	return afterCommit(asql.tx, func() error {
+		return asql.cache.Invalidate(ctx, &invalidated, event)
+	})
+}
+
+// SignUp hashes the password under the manager's password policy before creating the account.
+func (asql *AccountManagerSQL) SignUp(account AccountSQL, password string) error {
+	return asql.SignUpContext(context.Background(), account, password)
+}
+
+func (asql *AccountManagerSQL) SignUpContext(ctx context.Context, account AccountSQL, password string) error {
+	errSetPassword := account.SetPasswordWithPolicy(password, asql.passwordPolicy)
+	if errSetPassword != nil {
+		return errSetPassword
+	}
+
+	errCreate := asql.CreateContext(ctx, account)
+	if errCreate != nil {
+		return errCreate
+	}
+
+	if asql.passwordHistory != nil {
+		return asql.passwordHistory.RecordContext(ctx, &account)
 	}
 	return nil
 }
 
+func (asql *AccountManagerSQL) UpdatePassword(account *AccountSQL, password string) error {
+	return asql.UpdatePasswordContext(context.Background(), account, password)
+}
+
+func (asql *AccountManagerSQL) UpdatePasswordContext(ctx context.Context, account *AccountSQL, password string) error {
+	errApply := applyNewPassword(ctx, account, password, asql.passwordPolicy, asql.passwordHistory)
+	if errApply != nil {
+		return errApply
+	}
+	return asql.inTx(ctx, func(accounts *AccountManagerSQL) error {
+		errStore := storePassword(ctx, accounts.conn(), accounts.entityName, account, accounts.passwordHistory)
+		if errStore != nil {
+			return errStore
+		}
+		return accounts.invalidateCache(ctx, account, AccountChanged)
+	})
+}
+
+// ChangePassword verifies the current password before storing the new one, then
+// revokes every session of the account except currentSessionId, the session of
+// the device making the change. With an empty currentSessionId, or a session
+// revoker that cannot keep one session, every session is revoked.
+//
+// An account without a password, e.g. one signed up through an external
+// identity provider, has no current password to verify and gets
+// definition.Forbidden; it sets one through the reset password flow. Wrong
+// current passwords count against the login throttler like failed logins.
+func (asql *AccountManagerSQL) ChangePassword(account *AccountSQL, currentSessionId string, currentPassword string, newPassword string) error {
+	return asql.ChangePasswordContext(context.Background(), account, currentSessionId, currentPassword, newPassword)
+}
+
+func (asql *AccountManagerSQL) ChangePasswordContext(ctx context.Context, account *AccountSQL, currentSessionId string, currentPassword string, newPassword string) error {
+	if account.IsServiceAccount() {
+		return definition.Forbidden
+	}
+
+	// the account may come from the cache, which holds no password hash
+	stored, errFind := asql.FindByUUIDContext(ctx, account.GetUUID())
+	if errFind != nil {
+		return errFind
+	}
+	if stored == nil {
+		return definition.AccountNotFound
+	}
+	account.Password = stored.Password
+	if !account.IsPasswordExist() {
+		return definition.Forbidden
+	}
+
+	identifier := throttleIdentifier(stored)
+	if asql.loginThrottler != nil {
+		errThrottle := checkThrottle(ctx, asql.loginThrottler, identifier)
+		if errThrottle != nil {
+			return errThrottle
+		}
+	}
+	match, errVerify := account.VerifyPassword(currentPassword)
+	if errVerify != nil {
+		return errVerify
+	}
+	if !match {
+		if asql.loginThrottler != nil {
+			errRecord := recordLoginFailure(ctx, asql.loginThrottler, identifier)
+			if errRecord != nil {
+				return errRecord
+			}
+		}
+		return definition.InvalidCredentials
+	}
+
+	return asql.inTx(ctx, func(accounts *AccountManagerSQL) error {
+		errUpdate := accounts.UpdatePasswordContext(ctx, account, newPassword)
+		if errUpdate != nil {
+			return errUpdate
+		}
+
+		if accounts.sessionRevoker != nil {
+			errRevoke := afterCommit(accounts.tx, func() error {
+				return revokeOtherSessions(ctx, accounts.sessionRevoker, account, currentSessionId)
+			})
+			if errRevoke != nil {
+				return errRevoke
+			}
+		}
+
+		if accounts.notifier != nil {
+			afterCommit(accounts.tx, func() error {
+				// the password is already changed, a failed notification must not report otherwise
+				notify(ctx, accounts.notifier, Notification{Event: NotificationPasswordChanged, Account: account})
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
 func (asql *AccountManagerSQL) Update(account AccountSQL) error {
-	query := "UPDATE $1 SET updatedat = $2, name = $3, username = $4, suspended = $5 WHERE id = $6"
-	_, errUpdate := asql.db.Exec(query, asql.entityName, account.GetUpdatedAt(), account.Name, account.Username, account.Suspended)
+	return asql.UpdateContext(context.Background(), account)
+}
+
+func (asql *AccountManagerSQL) UpdateContext(ctx context.Context, account AccountSQL) error {
+	query := "UPDATE " + asql.db.table(asql.entityName) + " SET updatedat = $1, name = $2, username = $3, suspended = $4 WHERE uuid = $5 AND deletedat IS NULL"
+	result, errUpdate := asql.conn().ExecContext(ctx, query, account.GetUpdatedAt(), account.Name, nullString(account.Username), account.Suspended, account.GetUUID())
 	if errUpdate != nil {
 		return errUpdate
 	}
-	return nil
+	errAffected := requireAffected(result, definition.AccountNotFound)
+	if errAffected != nil {
+		return errAffected
+	}
+	return asql.invalidateCache(ctx, &account, AccountChanged)
 }
 
+// Delete soft-deletes the account: finders stop returning it and its sessions
+// are revoked, but its username and email stay reserved and it can be brought
+// back with Restore until the deletion grace period passed and Purge removes it.
 func (asql *AccountManagerSQL) Delete(account AccountSQL) error {
-	query := "DELETE FROM $1 WHERE uuid = $2"
-	_, errDelete := asql.db.Exec(query, asql.entityName, account.UUID)
+	return asql.DeleteContext(context.Background(), account)
+}
+
+func (asql *AccountManagerSQL) DeleteContext(ctx context.Context, account AccountSQL) error {
+	timeNow := time.Now().UTC()
+	query := "UPDATE " + asql.db.table(asql.entityName) + " SET deletedat = $1, updatedat = $1 WHERE uuid = $2 AND deletedat IS NULL"
+	result, errDelete := asql.conn().ExecContext(ctx, query, timeNow, account.GetUUID())
 	if errDelete != nil {
 		return errDelete
 	}
-	return nil
+	errAffected := requireAffected(result, definition.AccountNotFound)
+	if errAffected != nil {
+		return errAffected
+	}
+
+	if asql.sessionRevoker != nil {
+		errRevoke := afterCommit(asql.tx, func() error {
+			return revokeAllSessions(ctx, asql.sessionRevoker, &account)
+		})
+		if errRevoke != nil {
+			return errRevoke
+		}
+	}
+	return asql.invalidateCache(ctx, &account, AccountDeleted)
 }
 
 func (asql *AccountManagerSQL) FindByUsername(username string) (*AccountSQL, error) {
-	query := "SELECT uuid, createdat, updatedat, name, username, password, email, avatar, suspended FROM " + asql.entityName + " WHERE username = $1"
-	return findOneAccount(asql.db, query, username)
+	return asql.FindByUsernameContext(context.Background(), username)
+}
+
+func (asql *AccountManagerSQL) FindByUsernameContext(ctx context.Context, username string) (*AccountSQL, error) {
+	query := "SELECT " + accountColumns + " FROM " + asql.db.table(asql.entityName) + " WHERE username = $1 AND deletedat IS NULL"
+	return findOneAccount(ctx, asql.conn(), query, username)
 }
 
 func (asql *AccountManagerSQL) SeedByUsername(username string) error {
-	account, err := asql.FindByUsername(username)
+	return asql.SeedByUsernameContext(context.Background(), username)
+}
+
+func (asql *AccountManagerSQL) SeedByUsernameContext(ctx context.Context, username string) error {
+	account, err := asql.FindByUsernameContext(ctx, username)
 	if err != nil {
 		return err
 	}
 	if account == nil {
 		return errors.New("account not found")
 	}
+
+	errSetAcc := asql.cacheAccount(ctx, account)
+	if errSetAcc != nil {
+		return errSetAcc
+	}
 	return nil
 }
 
 func (asql *AccountManagerSQL) FindByRandId(randId string) (*AccountSQL, error) {
-	query := "SELECT uuid, createdat, updatedat, name, username, password, email, avatar, suspended FROM " + asql.entityName + " WHERE randId = $1"
-	return findOneAccount(asql.db, query, randId)
+	return asql.FindByRandIdContext(context.Background(), randId)
+}
+
+func (asql *AccountManagerSQL) FindByRandIdContext(ctx context.Context, randId string) (*AccountSQL, error) {
+	query := "SELECT " + accountColumns + " FROM " + asql.db.table(asql.entityName) + " WHERE randId = $1 AND deletedat IS NULL"
+	return findOneAccount(ctx, asql.conn(), query, randId)
 }
 
 func (asql *AccountManagerSQL) SeedByRandId(randId string) error {
-	account, err := asql.FindByRandId(randId)
+	return asql.SeedByRandIdContext(context.Background(), randId)
+}
+
+func (asql *AccountManagerSQL) SeedByRandIdContext(ctx context.Context, randId string) error {
+	account, err := asql.FindByRandIdContext(ctx, randId)
 	if err != nil {
 		return err
 	}
@@ -152,7 +563,7 @@ func (asql *AccountManagerSQL) SeedByRandId(randId string) error {
 		return errors.New("account not found")
 	}
 
-	errSetAcc := asql.base.Set(*account)
+	errSetAcc := asql.cacheAccount(ctx, account)
 	if errSetAcc != nil {
 		return errSetAcc
 	}
@@ -160,12 +571,20 @@ func (asql *AccountManagerSQL) SeedByRandId(randId string) error {
 }
 
 func (asql *AccountManagerSQL) FindByEmail(email string) (*AccountSQL, error) {
-	query := "SELECT uuid, createdat, updatedat, name, username, password, email, avatar, suspended FROM " + asql.entityName + " WHERE email = $1"
-	return findOneAccount(asql.db, query, email)
+	return asql.FindByEmailContext(context.Background(), email)
+}
+
+func (asql *AccountManagerSQL) FindByEmailContext(ctx context.Context, email string) (*AccountSQL, error) {
+	query := "SELECT " + accountColumns + " FROM " + asql.db.table(asql.entityName) + " WHERE email = $1 AND deletedat IS NULL"
+	return findOneAccount(ctx, asql.conn(), query, email)
 }
 
 func (asql *AccountManagerSQL) SeedByEmail(email string) error {
-	account, err := asql.FindByEmail(email)
+	return asql.SeedByEmailContext(context.Background(), email)
+}
+
+func (asql *AccountManagerSQL) SeedByEmailContext(ctx context.Context, email string) error {
+	account, err := asql.FindByEmailContext(ctx, email)
 	if err != nil {
 		return err
 	}
@@ -173,7 +592,7 @@ func (asql *AccountManagerSQL) SeedByEmail(email string) error {
 		return errors.New("account not found")
 	}
 
-	errSetAcc := asql.base.Set(*account)
+	errSetAcc := asql.cacheAccount(ctx, account)
 	if errSetAcc != nil {
 		return errSetAcc
 	}
@@ -181,12 +600,20 @@ func (asql *AccountManagerSQL) SeedByEmail(email string) error {
 }
 
 func (asql *AccountManagerSQL) FindByUUID(uuid string) (*AccountSQL, error) {
-	query := "SELECT uuid, createdat, updatedat, name, username, password, email, avatar, suspended FROM " + asql.entityName + " WHERE uuid = $1"
-	return findOneAccount(asql.db, query, uuid)
+	return asql.FindByUUIDContext(context.Background(), uuid)
+}
+
+func (asql *AccountManagerSQL) FindByUUIDContext(ctx context.Context, uuid string) (*AccountSQL, error) {
+	query := "SELECT " + accountColumns + " FROM " + asql.db.table(asql.entityName) + " WHERE uuid = $1 AND deletedat IS NULL"
+	return findOneAccount(ctx, asql.conn(), query, uuid)
 }
 
 func (asql *AccountManagerSQL) SeedByUUID(uuid string) error {
-	account, err := asql.FindByUUID(uuid)
+	return asql.SeedByUUIDContext(context.Background(), uuid)
+}
+
+func (asql *AccountManagerSQL) SeedByUUIDContext(ctx context.Context, uuid string) error {
+	account, err := asql.FindByUUIDContext(ctx, uuid)
 	if err != nil {
 		return err
 	}
@@ -194,98 +621,188 @@ func (asql *AccountManagerSQL) SeedByUUID(uuid string) error {
 		return errors.New("account not found")
 	}
 
-	errSetAcc := asql.base.Set(*account)
+	errSetAcc := asql.cacheAccount(ctx, account)
 	if errSetAcc != nil {
 		return errSetAcc
 	}
 	return nil
 }
 
-func NewAccountManagerSQL(db *sql.DB, redis *redis.Client, entityName string) *AccountManagerSQL {
-	base := pageflow.NewBase[AccountSQL](redis, entityName+":%s")
+func NewAccountManagerSQL(db *sql.DB, redis redis.UniversalClient, entityName string) *AccountManagerSQL {
 	return &AccountManagerSQL{
-		db:         db,
-		base:       base,
-		entityName: entityName,
+		db:            newSQLDB(db),
+		cache:         newAccountCache(redis, entityName),
+		entityName:    entityName,
+		deletionGrace: defaultDeletionGrace,
 	}
 }
 
-type AccountFetchers struct {
-	base *pageflow.Base[AccountSQL]
+// FetchByUUID serves the account from the cache, loading and caching it from
+// SQL on a miss.
+func (asql *AccountManagerSQL) FetchByUUID(uuid string) (*AccountSQL, error) {
+	return asql.FetchByUUIDContext(context.Background(), uuid)
 }
 
-func (af *AccountFetchers) FetchByUsername(username string) (*AccountSQL, error) {
-	account, err := af.base.Get(username)
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			return nil, nil
+func (asql *AccountManagerSQL) FetchByUUIDContext(ctx context.Context, uuid string) (*AccountSQL, error) {
+	return asql.fetch(ctx, accountIndexUUID, uuid, asql.FindByUUIDContext)
+}
+
+func (asql *AccountManagerSQL) FetchByUsername(username string) (*AccountSQL, error) {
+	return asql.FetchByUsernameContext(context.Background(), username)
+}
+
+func (asql *AccountManagerSQL) FetchByUsernameContext(ctx context.Context, username string) (*AccountSQL, error) {
+	return asql.fetch(ctx, accountIndexUsername, username, asql.FindByUsernameContext)
+}
+
+func (asql *AccountManagerSQL) FetchByEmail(email string) (*AccountSQL, error) {
+	return asql.FetchByEmailContext(context.Background(), email)
+}
+
+func (asql *AccountManagerSQL) FetchByEmailContext(ctx context.Context, email string) (*AccountSQL, error) {
+	return asql.fetch(ctx, accountIndexEmail, email, asql.FindByEmailContext)
+}
+
+func (asql *AccountManagerSQL) FetchByRandId(randId string) (*AccountSQL, error) {
+	return asql.FetchByRandIdContext(context.Background(), randId)
+}
+
+func (asql *AccountManagerSQL) FetchByRandIdContext(ctx context.Context, randId string) (*AccountSQL, error) {
+	return asql.fetch(ctx, accountIndexRandId, randId, asql.FindByRandIdContext)
+}
+
+func (asql *AccountManagerSQL) fetch(ctx context.Context, index string, value string, find func(ctx context.Context, value string) (*AccountSQL, error)) (*AccountSQL, error) {
+	// inside a transaction the cache may hold what the transaction already changed
+	if asql.tx == nil {
+		cached, errCached := asql.cache.GetBy(ctx, index, value)
+		if errCached != nil {
+			return nil, errCached
 		}
-		return nil, err
+		if cached != nil {
+			return cached, nil
+		}
+	}
+
+	account, errFind := find(ctx, value)
+	if errFind != nil || account == nil {
+		return nil, errFind
+	}
+	errCache := asql.cacheAccount(ctx, account)
+	if errCache != nil {
+		return nil, errCache
 	}
-	return &account, nil
+	return account, nil
+}
+
+// AccountFetchers reads the accounts cached by AccountManagerSQL without ever
+// falling back to SQL.
+type AccountFetchers struct {
+	cache *accountCache
+}
+
+func (af *AccountFetchers) FetchByUsername(username string) (*AccountSQL, error) {
+	return af.cache.GetBy(context.Background(), accountIndexUsername, username)
 }
 
 func (af *AccountFetchers) FetchByUUID(uuid string) (*AccountSQL, error) {
-	account, err := af.base.Get(uuid)
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			return nil, nil
-		}
-		return nil, err
-	}
-	return &account, nil
+	return af.cache.Get(context.Background(), uuid)
 }
 
 func (af *AccountFetchers) FetchByEmail(email string) (*AccountSQL, error) {
-	account, err := af.base.Get(email)
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			return nil, nil
-		}
-		return nil, err
-	}
-	return &account, nil
+	return af.cache.GetBy(context.Background(), accountIndexEmail, email)
 }
 
 func (af *AccountFetchers) FetchByRandId(randId string) (*AccountSQL, error) {
-	account, err := af.base.Get(randId)
+	return af.cache.GetBy(context.Background(), accountIndexRandId, randId)
+}
+
+// SetLocalCache puts an in-process LRU of up to capacity accounts in front of
+// the Redis cache. Both capacity and lifeSpan must be positive.
+func (af *AccountFetchers) SetLocalCache(capacity int, lifeSpan time.Duration) error {
+	return af.cache.setLocal(capacity, lifeSpan)
+}
+
+// SetInvalidationBus evicts the accounts invalidated by any instance from the
+// local cache.
+func (af *AccountFetchers) SetInvalidationBus(bus *InvalidationBus) {
+	bus.OnAccountEvent(af.cache.evict)
+}
+
+func NewAccountFetchers(redis redis.UniversalClient, entityName string) *AccountFetchers {
+	return &AccountFetchers{
+		cache: newAccountCache(redis, entityName),
+	}
+}
+
+func insertAccount(ctx context.Context, db sqlConn, entityName string, account AccountSQL) error {
+	query := "INSERT INTO " + db.table(entityName) + " (uuid, randId, createdat, updatedat, name, username, password, passwordupdatedat, mustchangepassword, email, emailverified, avatar, suspended, serviceaccount) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)"
+	_, errInsert := db.ExecContext(
+		ctx,
+		query,
+		account.GetUUID(),
+		account.GetRandId(),
+		account.GetCreatedAt(),
+		account.GetUpdatedAt(),
+		account.Name,
+		nullString(account.Username),
+		account.Password,
+		account.PasswordUpdatedAt,
+		account.MustChangePassword,
+		nullString(account.Email),
+		account.EmailVerified,
+		account.Avatar,
+		account.Suspended,
+		account.ServiceAccount)
+	return errInsert
+}
+
+const accountColumns = "uuid, randId, createdat, updatedat, name, username, password, passwordupdatedat, mustchangepassword, email, emailverified, avatar, suspended, serviceaccount"
+
+func findOneAccount(ctx context.Context, db sqlConn, query string, param string) (*AccountSQL, error) {
+	account, err := scanAccount(db.QueryRowContext(ctx, query, param))
 	if err != nil {
-		if errors.Is(err, redis.Nil) {
+		if err == sql.ErrNoRows {
 			return nil, nil
 		}
+		return nil, err
 	}
-	return &account, nil
-}
 
-func NewAccountFetchers(redis *redis.Client, entityName string) *AccountFetchers {
-	base := pageflow.NewBase[AccountSQL](redis, entityName+":%s")
-	return &AccountFetchers{
-		base: base,
-	}
+	return account, nil
 }
 
-func findOneAccount(db *sql.DB, query string, param string) (*AccountSQL, error) {
-	row := db.QueryRow(query, param)
+// scanAccount reads one row selected with accountColumns.
+func scanAccount(row interface{ Scan(dest ...any) error }) (*AccountSQL, error) {
 	account := NewAccountSQL()
+	var username, email sql.NullString
+	var passwordUpdatedAt sql.NullTime
 	err := row.Scan(
 		&account.SQLItem.UUID,
 		&account.SQLItem.RandId,
 		&account.SQLItem.CreatedAt,
 		&account.SQLItem.UpdatedAt,
 		&account.Base.Name,
-		&account.Base.Username,
+		&username,
 		&account.Base.Password,
-		&account.Base.Email,
+		&passwordUpdatedAt,
+		&account.Base.MustChangePassword,
+		&email,
+		&account.Base.EmailVerified,
 		&account.Base.Avatar,
 		&account.Base.Suspended,
+		&account.Base.ServiceAccount,
 	)
-
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
 		return nil, err
 	}
 
+	account.Base.Username = username.String
+	account.Base.Email = email.String
+	account.Base.PasswordUpdatedAt = passwordUpdatedAt.Time
 	return account, nil
 }
+
+// nullString stores an empty value as NULL, so that optional values do not
+// collide in UNIQUE columns.
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
@@ -0,0 +1,301 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lefalya/commonuser/definition"
+	"github.com/lefalya/pageflow"
+	"strings"
+	"time"
+)
+
+const apiKeyLastUsedResolution = time.Minute
+
+type APIKeySQL struct {
+	*pageflow.SQLItem `bson:",inline" json:",inline"`
+	AccountUUID       string    `json:"accountuuid" db:"accountuuid"`
+	Name              string    `json:"name" db:"name"`
+	Hint              string    `json:"hint" db:"hint"`
+	KeyHash           string    `json:"-" db:"keyhash"`
+	Scopes            []string  `json:"scopes,omitempty" db:"scopes"`
+	ExpiredAt         time.Time `json:"expiredat,omitempty" db:"expiredat"`
+	LastUsedAt        time.Time `json:"lastusedat,omitempty" db:"lastusedat"`
+	RevokedAt         time.Time `json:"revokedat,omitempty" db:"revokedat"`
+}
+
+func (ak *APIKeySQL) IsActive() bool {
+	if !ak.RevokedAt.IsZero() {
+		return false
+	}
+	return ak.ExpiredAt.IsZero() || time.Now().UTC().Before(ak.ExpiredAt)
+}
+
+func NewAPIKeySQL() *APIKeySQL {
+	apiKey := &APIKeySQL{}
+	pageflow.InitSQLItem(apiKey)
+	return apiKey
+}
+
+// AccessTokenVerifier is satisfied by JWTHandler, OAuthProvider and
+// APIKeyManagerSQL, so middleware can accept any kind of bearer credential.
+type AccessTokenVerifier interface {
+	ParseAccessToken(token string) (*UserClaims, error)
+}
+
+// AccessTokenVerifiers tries each verifier in order and returns the first success.
+type AccessTokenVerifiers []AccessTokenVerifier
+
+func (av AccessTokenVerifiers) ParseAccessToken(token string) (*UserClaims, error) {
+	errLast := definition.Unauthorized
+	for _, verifier := range av {
+		claims, err := verifier.ParseAccessToken(token)
+		if err == nil {
+			return claims, nil
+		}
+		errLast = err
+	}
+	return nil, errLast
+}
+
+// APIKeyManagerSQL issues long-lived, scoped keys such as "cu_live_..." for
+// automation. Only a SHA-256 of each key is stored; the plaintext is returned once
+// at creation.
+type APIKeyManagerSQL struct {
+	db         *sqlDB
+	entityName string
+	prefix     string
+}
+
+func (am *APIKeyManagerSQL) tableName() string {
+	return am.db.table(am.entityName + "APIKey")
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create returns the plaintext key, which cannot be recovered afterwards. A zero
+// expiredAt never expires. A key needs at least one scope, and
+// RoleManagerSQL.Require only grants it the permissions among its scopes.
+func (am *APIKeyManagerSQL) Create(account *AccountSQL, name string, scopes []string, expiredAt time.Time) (string, *APIKeySQL, error) {
+	if len(scopes) == 0 {
+		return "", nil, definition.InvalidScope
+	}
+	for _, scope := range scopes {
+		if isLimitedScope(scope) || strings.ContainsAny(scope, " \t\n") {
+			return "", nil, definition.InvalidScope
+		}
+	}
+
+	secret, errToken := randomToken(32)
+	if errToken != nil {
+		return "", nil, errToken
+	}
+	key := am.prefix + secret
+
+	apiKey := NewAPIKeySQL()
+	apiKey.AccountUUID = account.GetUUID()
+	apiKey.Name = name
+	apiKey.Hint = key[:len(am.prefix)+4]
+	apiKey.KeyHash = hashAPIKey(key)
+	apiKey.Scopes = scopes
+	apiKey.ExpiredAt = expiredAt
+
+	query := "INSERT INTO " + am.tableName() + " (uuid, randId, createdat, updatedat, accountuuid, name, hint, keyhash, scopes, expiredat) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)"
+	_, errInsert := am.db.Exec(
+		query,
+		apiKey.GetUUID(),
+		apiKey.GetRandId(),
+		apiKey.GetCreatedAt(),
+		apiKey.GetUpdatedAt(),
+		apiKey.AccountUUID,
+		apiKey.Name,
+		apiKey.Hint,
+		apiKey.KeyHash,
+		strings.Join(apiKey.Scopes, " "),
+		nullTime(apiKey.ExpiredAt))
+	if errInsert != nil {
+		return "", nil, errInsert
+	}
+	return key, apiKey, nil
+}
+
+const apiKeyColumns = "uuid, randId, createdat, updatedat, accountuuid, name, hint, keyhash, scopes, expiredat, lastusedat, revokedat"
+
+func scanAPIKey(row interface{ Scan(dest ...any) error }) (*APIKeySQL, error) {
+	apiKey := NewAPIKeySQL()
+	var scopes string
+	var expiredAt, lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(
+		&apiKey.SQLItem.UUID,
+		&apiKey.SQLItem.RandId,
+		&apiKey.SQLItem.CreatedAt,
+		&apiKey.SQLItem.UpdatedAt,
+		&apiKey.AccountUUID,
+		&apiKey.Name,
+		&apiKey.Hint,
+		&apiKey.KeyHash,
+		&scopes,
+		&expiredAt,
+		&lastUsedAt,
+		&revokedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey.Scopes = strings.Fields(scopes)
+	apiKey.ExpiredAt = expiredAt.Time
+	apiKey.LastUsedAt = lastUsedAt.Time
+	apiKey.RevokedAt = revokedAt.Time
+	return apiKey, nil
+}
+
+func (am *APIKeyManagerSQL) FindByAccount(account *AccountSQL) ([]APIKeySQL, error) {
+	query := "SELECT " + apiKeyColumns + " FROM " + am.tableName() + " WHERE accountuuid = $1 ORDER BY createdat DESC"
+	rows, errQuery := am.db.Query(query, account.GetUUID())
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	var apiKeys []APIKeySQL
+	for rows.Next() {
+		apiKey, errScan := scanAPIKey(rows)
+		if errScan != nil {
+			return nil, errScan
+		}
+		apiKeys = append(apiKeys, *apiKey)
+	}
+	return apiKeys, rows.Err()
+}
+
+func (am *APIKeyManagerSQL) FindByKey(key string) (*APIKeySQL, error) {
+	return am.FindByKeyContext(context.Background(), key)
+}
+
+func (am *APIKeyManagerSQL) FindByKeyContext(ctx context.Context, key string) (*APIKeySQL, error) {
+	query := "SELECT " + apiKeyColumns + " FROM " + am.tableName() + " WHERE keyhash = $1"
+	apiKey, err := scanAPIKey(am.db.QueryRowContext(ctx, query, hashAPIKey(key)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return apiKey, nil
+}
+
+func (am *APIKeyManagerSQL) Revoke(account *AccountSQL, apiKeyUUID string) error {
+	timeNow := time.Now().UTC()
+	query := "UPDATE " + am.tableName() + " SET revokedat = $1, updatedat = $2 WHERE uuid = $3 AND accountuuid = $4 AND revokedat IS NULL"
+	result, errUpdate := am.db.Exec(query, timeNow, timeNow, apiKeyUUID, account.GetUUID())
+	if errUpdate != nil {
+		return errUpdate
+	}
+	return requireAffected(result, definition.RequestNotFound)
+}
+
+// RevokeByKey revokes the key presented in plaintext, e.g. by a revocation
+// endpoint that does not know its owner.
+func (am *APIKeyManagerSQL) RevokeByKey(key string) error {
+	timeNow := time.Now().UTC()
+	query := "UPDATE " + am.tableName() + " SET revokedat = $1, updatedat = $2 WHERE keyhash = $3 AND revokedat IS NULL"
+	result, errUpdate := am.db.Exec(query, timeNow, timeNow, hashAPIKey(key))
+	if errUpdate != nil {
+		return errUpdate
+	}
+	return requireAffected(result, definition.RequestNotFound)
+}
+
+func (am *APIKeyManagerSQL) RevokeAll(account *AccountSQL) error {
+	timeNow := time.Now().UTC()
+	query := "UPDATE " + am.tableName() + " SET revokedat = $1, updatedat = $2 WHERE accountuuid = $3 AND revokedat IS NULL"
+	_, errUpdate := am.db.Exec(query, timeNow, timeNow, account.GetUUID())
+	if errUpdate != nil {
+		return errUpdate
+	}
+	return nil
+}
+
+// ParseAccessToken verifies an API key and describes it with the same claims an
+// access token carries; the key's scopes end up in Scope and its uuid in ID.
+func (am *APIKeyManagerSQL) ParseAccessToken(key string) (*UserClaims, error) {
+	return am.ParseAccessTokenContext(context.Background(), key)
+}
+
+func (am *APIKeyManagerSQL) ParseAccessTokenContext(ctx context.Context, key string) (*UserClaims, error) {
+	if !am.IsAPIKey(key) {
+		return nil, definition.Unauthorized
+	}
+
+	apiKey, errFind := am.FindByKeyContext(ctx, key)
+	if errFind != nil {
+		return nil, errFind
+	}
+	if apiKey == nil || !apiKey.IsActive() {
+		return nil, definition.Unauthorized
+	}
+
+	account, errAccount := findOneAccount(ctx, am.db, "SELECT "+accountColumns+" FROM "+am.db.table(am.entityName)+" WHERE uuid = $1 AND deletedat IS NULL", apiKey.AccountUUID)
+	if errAccount != nil {
+		return nil, errAccount
+	}
+	if account == nil || account.IsSuspended() {
+		return nil, definition.Unauthorized
+	}
+
+	timeNow := time.Now().UTC()
+	if timeNow.Sub(apiKey.LastUsedAt) > apiKeyLastUsedResolution {
+		_, errUpdate := am.db.ExecContext(ctx, "UPDATE "+am.tableName()+" SET lastusedat = $1 WHERE uuid = $2", timeNow, apiKey.GetUUID())
+		if errUpdate != nil {
+			return nil, errUpdate
+		}
+	}
+
+	claims := &UserClaims{
+		UUID:              account.GetUUID(),
+		Name:              account.Name,
+		Username:          account.Username,
+		Email:             account.Email,
+		Avatar:            account.Avatar,
+		PasswordUpdatedAt: account.PasswordUpdatedAt,
+		Scope:             strings.Join(apiKey.Scopes, " "),
+		TokenUse:          tokenUseAPIKey,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       apiKey.GetUUID(),
+			IssuedAt: jwt.NewNumericDate(apiKey.GetCreatedAt()),
+		},
+	}
+	if !apiKey.ExpiredAt.IsZero() {
+		claims.ExpiresAt = jwt.NewNumericDate(apiKey.ExpiredAt)
+	}
+	return claims, nil
+}
+
+// IsAPIKey reports whether token carries this manager's prefix; it does not
+// verify the key.
+func (am *APIKeyManagerSQL) IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, am.prefix)
+}
+
+// NewAPIKeyManagerSQL requires a prefix, which tells API keys apart from the
+// other bearer credentials.
+func NewAPIKeyManagerSQL(db *sql.DB, entityName string, prefix string) (*APIKeyManagerSQL, error) {
+	if strings.TrimSpace(prefix) == "" {
+		return nil, definition.InvalidAPIKeyPrefix
+	}
+	return &APIKeyManagerSQL{
+		db:         newSQLDB(db),
+		entityName: entityName,
+		prefix:     prefix,
+	}, nil
+}
+
+func nullTime(value time.Time) sql.NullTime {
+	return sql.NullTime{Time: value, Valid: !value.IsZero()}
+}
@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"errors"
+	"github.com/lefalya/commonuser/definition"
+	"testing"
+	"time"
+)
+
+func TestNewAPIKeyManagerSQLRequiresPrefix(t *testing.T) {
+	for _, prefix := range []string{"", " "} {
+		_, errManager := NewAPIKeyManagerSQL(nil, "test", prefix)
+		if !errors.Is(errManager, definition.InvalidAPIKeyPrefix) {
+			t.Errorf("prefix %q: got %v, want %v", prefix, errManager, definition.InvalidAPIKeyPrefix)
+		}
+	}
+
+	apiKeys, errManager := NewAPIKeyManagerSQL(nil, "test", "cu_live_")
+	if errManager != nil {
+		t.Fatal(errManager)
+	}
+	if apiKeys.IsAPIKey("eyJhbGciOiJIUzI1NiJ9.e30.signature") {
+		t.Error("a JWT was taken for an API key")
+	}
+	if !apiKeys.IsAPIKey("cu_live_secret") {
+		t.Error("a prefixed key was not recognised")
+	}
+}
+
+func TestCreateAPIKeyRequiresScope(t *testing.T) {
+	apiKeys, errManager := NewAPIKeyManagerSQL(nil, "test", "cu_live_")
+	if errManager != nil {
+		t.Fatal(errManager)
+	}
+	_, _, errCreate := apiKeys.Create(newTestAccount(), "ci", nil, time.Time{})
+	if !errors.Is(errCreate, definition.InvalidScope) {
+		t.Fatalf("got %v, want %v", errCreate, definition.InvalidScope)
+	}
+}
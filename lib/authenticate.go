@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"context"
+	"github.com/lefalya/commonuser/definition"
+	"github.com/matthewhartstonge/argon2"
+	"strings"
+	"sync"
+)
+
+const dummyPassword = "commonuser-dummy-password"
+
+var (
+	dummyPasswordHash     []byte
+	dummyPasswordHashOnce sync.Once
+)
+
+// verifyDummyPassword spends the same argon2 work as a real verification, so
+// unknown identifiers cannot be told apart by response time.
+func verifyDummyPassword(password string) {
+	dummyPasswordHashOnce.Do(func() {
+		argon := argon2.DefaultConfig()
+		dummyPasswordHash, _ = argon.HashEncoded([]byte(dummyPassword))
+	})
+	argon2.VerifyEncoded([]byte(password), dummyPasswordHash)
+}
+
+func (asql *AccountManagerSQL) SetLoginThrottler(loginThrottler LoginThrottler) {
+	asql.loginThrottler = loginThrottler
+}
+
+func (asql *AccountManagerSQL) SetMFAProvider(mfaProvider MFAProvider) {
+	asql.mfaProvider = mfaProvider
+}
+
+// normalizeIdentifier normalizes identifier the way it is looked up, so that
+// every spelling of one account shares its throttle.
+func normalizeIdentifier(identifier string) string {
+	if strings.Contains(identifier, "@") {
+		return NormalizeEmail(identifier)
+	}
+	return NormalizeUsername(identifier)
+}
+
+// throttleIdentifier is the identifier a login with account's email, or its
+// username when it has none, is throttled under.
+func throttleIdentifier(account *AccountSQL) string {
+	if account.Email != "" {
+		return account.Email
+	}
+	return account.Username
+}
+
+func (asql *AccountManagerSQL) findByIdentifier(ctx context.Context, identifier string) (*AccountSQL, error) {
+	if strings.Contains(identifier, "@") {
+		return asql.FindByEmailContext(ctx, identifier)
+	}
+	return asql.FindByUsernameContext(ctx, identifier)
+}
+
+// Authenticate logs in with a username or email and a password. Unknown
+// identifiers, accounts without a password, service accounts and wrong
+// passwords all return definition.InvalidCredentials after the same amount of
+// hashing work.
+func (asql *AccountManagerSQL) Authenticate(identifier string, password string) (*LoginResult, error) {
+	return asql.AuthenticateContext(context.Background(), identifier, password)
+}
+
+func (asql *AccountManagerSQL) AuthenticateContext(ctx context.Context, identifier string, password string) (*LoginResult, error) {
+	identifier = normalizeIdentifier(identifier)
+	if asql.loginThrottler != nil {
+		errThrottle := checkThrottle(ctx, asql.loginThrottler, identifier)
+		if errThrottle != nil {
+			return nil, errThrottle
+		}
+	}
+
+	account, errFind := asql.findByIdentifier(ctx, identifier)
+	if errFind != nil {
+		return nil, errFind
+	}
+
+	match := false
+	if account == nil || !account.IsPasswordExist() || account.IsServiceAccount() {
+		verifyDummyPassword(password)
+	} else {
+		var errVerify error
+		match, errVerify = account.VerifyPassword(password)
+		if errVerify != nil {
+			return nil, errVerify
+		}
+	}
+
+	if !match {
+		if asql.loginThrottler != nil {
+			errRecord := recordLoginFailure(ctx, asql.loginThrottler, identifier)
+			if errRecord != nil {
+				return nil, errRecord
+			}
+		}
+		return nil, definition.InvalidCredentials
+	}
+
+	if account.IsSuspended() {
+		return nil, definition.AccountSuspended
+	}
+
+	if asql.loginThrottler != nil {
+		errRecord := recordLoginSuccess(ctx, asql.loginThrottler, identifier)
+		if errRecord != nil {
+			return nil, errRecord
+		}
+	}
+
+	return asql.issueLoginResult(ctx, account)
+}
+
+// issueLoginResult decides between MFA, password change and a full token pair.
+// Without a JWTHandler only the status and account are returned.
+func (asql *AccountManagerSQL) issueLoginResult(ctx context.Context, account *AccountSQL) (*LoginResult, error) {
+	if asql.mfaProvider != nil {
+		enrolled, errEnrolled := isMFAEnrolled(ctx, asql.mfaProvider, account)
+		if errEnrolled != nil {
+			return nil, errEnrolled
+		}
+		if enrolled {
+			if asql.jwtHandler == nil {
+				return &LoginResult{Status: LoginMFARequired, Account: account}, nil
+			}
+			return asql.jwtHandler.IssueMFAChallenge(account)
+		}
+	}
+	return asql.CompleteLoginContext(ctx, account)
+}
+
+// CompleteLogin finishes a login once its second factor is verified, or right
+// away for accounts without MFA. With SetSessionManager the token pair is bound
+// to a new session.
+func (asql *AccountManagerSQL) CompleteLogin(account *AccountSQL) (*LoginResult, error) {
+	return asql.CompleteLoginContext(context.Background(), account)
+}
+
+func (asql *AccountManagerSQL) CompleteLoginContext(ctx context.Context, account *AccountSQL) (*LoginResult, error) {
+	if asql.roleManager != nil {
+		errRoles := asql.roleManager.LoadRolesContext(ctx, account)
+		if errRoles != nil {
+			return nil, errRoles
+		}
+	}
+
+	passwordChangeRequired := asql.PasswordChangeRequired(account)
+	if asql.jwtHandler == nil {
+		status := LoginSuccess
+		if passwordChangeRequired {
+			status = LoginPasswordChangeRequired
+		}
+		return &LoginResult{Status: status, Account: account}, nil
+	}
+	if passwordChangeRequired || asql.sessionManager == nil {
+		return asql.jwtHandler.IssueLoginResult(account, passwordChangeRequired)
+	}
+
+	session, errSession := asql.sessionManager.CreateContext(ctx, account, "", "")
+	if errSession != nil {
+		return nil, errSession
+	}
+	return asql.jwtHandler.IssueSessionTokens(account, session)
+}
@@ -14,11 +14,34 @@ type UserClaims struct {
 	Email             string    `json:"email,omitempty"`
 	Avatar            string    `json:"avatar,omitempty"`
 	PasswordUpdatedAt time.Time `json:"passwordupdatedat,omitempty"`
+	Scope             string    `json:"scope,omitempty"`
+	SessionId         string    `json:"sid,omitempty"`
+	Roles             []string  `json:"roles,omitempty"`
+	Organization      string    `json:"org,omitempty"` // active organization uuid
+	ClientId          string    `json:"client_id,omitempty"`
+	TokenUse          string    `json:"token_use,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// tokenUseRefresh marks refresh tokens, which are signed with the same secret
+// as access tokens, so that one can never pass for the other.
+const tokenUseRefresh = "refresh"
+
+// tokenUseOAuthAccess marks access tokens issued to OAuth clients, which only
+// the OAuth verifiers accept.
+const tokenUseOAuthAccess = "oauth_access"
+
+// tokenUseAPIKey marks the claims APIKeyManagerSQL builds for an API key; they
+// are never signed and only tell such a bearer apart from a login.
+const tokenUseAPIKey = "api_key"
+
 type RefreshTokenClaims struct {
-	UUID string `json:"uuid"` // user uuid
+	UUID      string `json:"uuid"` // user uuid
+	SessionId string `json:"sid,omitempty"`
+	TokenUse  string `json:"token_use,omitempty"`
+	// Scope and ClientId are only read to reject access tokens
+	Scope    string `json:"scope,omitempty"`
+	ClientId string `json:"client_id,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -31,14 +54,19 @@ type AssociatedAccount struct {
 }
 
 type Base struct {
-	Name              string              `json:"name,omitempty" db:"name"`
-	Username          string              `json:"username,omitempty" db:"username"`
-	Password          string              `json:"-" db:"password"`
-	PasswordUpdatedAt time.Time           `json:"-" db:"passwordupdatedat"`
-	Email             string              `json:"email,omitempty" db:"email"`
-	Avatar            string              `json:"avatar,omitempty" db:"avatar"`
-	AssociatedAccount []AssociatedAccount `json:"associatedAccount,omitempty" db:"-"`
-	Suspended         bool                `json:"suspended,omitempty" db:"suspended"`
+	Name               string              `json:"name,omitempty" db:"name"`
+	Username           string              `json:"username,omitempty" db:"username"`
+	Password           string              `json:"-" db:"password"`
+	PasswordUpdatedAt  time.Time           `json:"-" db:"passwordupdatedat"`
+	MustChangePassword bool                `json:"mustChangePassword,omitempty" db:"mustchangepassword"`
+	Email              string              `json:"email,omitempty" db:"email"`
+	EmailVerified      bool                `json:"emailVerified,omitempty" db:"emailverified"`
+	Avatar             string              `json:"avatar,omitempty" db:"avatar"`
+	AssociatedAccount  []AssociatedAccount `json:"associatedAccount,omitempty" db:"-"`
+	Roles              []string            `json:"roles,omitempty" db:"-"`
+	ActiveOrganization string              `json:"activeOrganization,omitempty" db:"-"`
+	Suspended          bool                `json:"suspended,omitempty" db:"suspended"`
+	ServiceAccount     bool                `json:"serviceAccount,omitempty" db:"serviceaccount"`
 }
 
 func (b *Base) SetName(name string) {
@@ -58,9 +86,20 @@ func (b *Base) SetPassword(password string) error {
 
 	b.Password = string(encoded)
 	b.PasswordUpdatedAt = time.Now().UTC()
+	b.MustChangePassword = false
 	return nil
 }
 
+func (b *Base) SetPasswordWithPolicy(password string, policy *PasswordPolicy) error {
+	if policy != nil {
+		errValidate := policy.Validate(password, b)
+		if errValidate != nil {
+			return errValidate
+		}
+	}
+	return b.SetPassword(password)
+}
+
 func (b *Base) VerifyPassword(password string) (bool, error) {
 	match, err := argon2.VerifyEncoded([]byte(password), []byte(b.Password))
 	if err != nil {
@@ -76,6 +115,14 @@ func (b *Base) SetEmail(email string) {
 	b.Email = email
 }
 
+func (b *Base) VerifyEmail() {
+	b.EmailVerified = true
+}
+
+func (b *Base) IsEmailVerified() bool {
+	return b.EmailVerified
+}
+
 func (b *Base) SetAvatar(avatar string) {
 	b.Avatar = avatar
 }
@@ -96,10 +143,27 @@ func (b *Base) IsSuspended() bool {
 	return b.Suspended
 }
 
+func (b *Base) IsServiceAccount() bool {
+	return b.ServiceAccount
+}
+
 func (b *Base) IsPasswordExist() bool {
 	return b.Password != ""
 }
 
+func (b *Base) RequirePasswordChange() {
+	b.MustChangePassword = true
+}
+
+// IsPasswordExpired reports whether the password is older than maxAge. A zero
+// maxAge or an unknown PasswordUpdatedAt never expires.
+func (b *Base) IsPasswordExpired(maxAge time.Duration) bool {
+	if maxAge <= 0 || b.PasswordUpdatedAt.IsZero() {
+		return false
+	}
+	return time.Now().UTC().After(b.PasswordUpdatedAt.Add(maxAge))
+}
+
 type Account struct {
 	*item.Foundation
 	Base
@@ -0,0 +1,132 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+const breachedPrefixLength = 5
+
+// BreachedPasswordList looks passwords up in an offline, ascending-sorted file of
+// uppercase SHA-1 hashes, one per line and optionally suffixed with ":count"
+// (the format of the Have I Been Pwned downloads). Lookups binary-search the file
+// for a 5 character hash prefix and only ever read that range, mirroring the
+// k-anonymity range API.
+type BreachedPasswordList struct {
+	file *os.File
+	size int64
+}
+
+func (bl *BreachedPasswordList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	suffixes, err := bl.Range(hash[:breachedPrefixLength])
+	if err != nil {
+		return false, err
+	}
+	for _, suffix := range suffixes {
+		if suffix == hash[breachedPrefixLength:] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Range returns the hash suffixes stored under the given 5 character prefix.
+func (bl *BreachedPasswordList) Range(prefix string) ([]string, error) {
+	if len(prefix) != breachedPrefixLength {
+		return nil, errors.New("breached password prefix must be 5 characters")
+	}
+	prefix = strings.ToUpper(prefix)
+
+	low, high := int64(0), bl.size
+	for low < high {
+		mid := low + (high-low)/2
+		line, _, err := bl.lineAt(mid)
+		if err != nil {
+			return nil, err
+		}
+		if line != "" && line[:min(len(line), breachedPrefixLength)] < prefix {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+
+	_, start, err := bl.lineAt(low)
+	if err != nil {
+		return nil, err
+	}
+
+	var suffixes []string
+	scanner := bufio.NewScanner(io.NewSectionReader(bl.file, start, bl.size-start))
+	for scanner.Scan() {
+		hash := breachedHash(scanner.Text())
+		if !strings.HasPrefix(hash, prefix) {
+			break
+		}
+		suffixes = append(suffixes, hash[breachedPrefixLength:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return suffixes, nil
+}
+
+// lineAt returns the hash of the first line starting at or after offset together
+// with that line's starting offset. An empty hash means the end of the file.
+func (bl *BreachedPasswordList) lineAt(offset int64) (string, int64, error) {
+	start := offset
+	if offset > 0 {
+		reader := bufio.NewReader(io.NewSectionReader(bl.file, offset-1, bl.size-offset+1))
+		skipped, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return "", bl.size, nil
+			}
+			return "", 0, err
+		}
+		start = offset - 1 + int64(len(skipped))
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(bl.file, start, bl.size-start))
+	line, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", 0, err
+	}
+	return breachedHash(line), start, nil
+}
+
+func (bl *BreachedPasswordList) Close() error {
+	return bl.file.Close()
+}
+
+func breachedHash(line string) string {
+	line = strings.TrimSpace(line)
+	if colon := strings.IndexByte(line, ':'); colon >= 0 {
+		line = line[:colon]
+	}
+	return strings.ToUpper(line)
+}
+
+func NewBreachedPasswordList(path string) (*BreachedPasswordList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &BreachedPasswordList{
+		file: file,
+		size: info.Size(),
+	}, nil
+}
@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func writeBreachedList(t *testing.T, passwords []string, filler int) string {
+	t.Helper()
+	var lines []string
+	for _, password := range passwords {
+		sum := sha1.Sum([]byte(password))
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(sum[:]))+":42")
+	}
+	// unrelated hashes around the real ones make the search cross many lines
+	for i := 0; i < filler; i++ {
+		sum := sha1.Sum([]byte("filler-" + strings.Repeat("x", i)))
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(sum[:]))+":1")
+	}
+	sort.Strings(lines)
+
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	errWrite := os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0o600)
+	if errWrite != nil {
+		t.Fatal(errWrite)
+	}
+	return path
+}
+
+func TestBreachedPasswordListContains(t *testing.T) {
+	breached := []string{"password", "123456", "letmein", "correct horse battery staple"}
+	list, errOpen := NewBreachedPasswordList(writeBreachedList(t, breached, 500))
+	if errOpen != nil {
+		t.Fatal(errOpen)
+	}
+	defer list.Close()
+
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{password: "password", want: true},
+		{password: "123456", want: true},
+		{password: "letmein", want: true},
+		{password: "correct horse battery staple", want: true},
+		{password: "Password", want: false},
+		{password: "not in the list", want: false},
+		{password: "", want: false},
+	}
+	for _, test := range tests {
+		got, errContains := list.Contains(test.password)
+		if errContains != nil {
+			t.Fatalf("%q: %v", test.password, errContains)
+		}
+		if got != test.want {
+			t.Errorf("%q: got %v, want %v", test.password, got, test.want)
+		}
+	}
+}
+
+func TestBreachedPasswordListRange(t *testing.T) {
+	list, errOpen := NewBreachedPasswordList(writeBreachedList(t, []string{"password"}, 0))
+	if errOpen != nil {
+		t.Fatal(errOpen)
+	}
+	defer list.Close()
+
+	// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+	suffixes, errRange := list.Range("5baa6")
+	if errRange != nil {
+		t.Fatal(errRange)
+	}
+	if len(suffixes) != 1 || suffixes[0] != "1E4C9B93F3F0682250B6CF8331B7EE68FD8" {
+		t.Errorf("got %v", suffixes)
+	}
+
+	for _, prefix := range []string{"00000", "FFFFF"} {
+		suffixes, errRange = list.Range(prefix)
+		if errRange != nil || len(suffixes) != 0 {
+			t.Errorf("%s: got %v, %v", prefix, suffixes, errRange)
+		}
+	}
+	if _, errRange = list.Range("5BAA"); errRange == nil {
+		t.Error("a 4 character prefix was accepted")
+	}
+}
@@ -0,0 +1,293 @@
+package lib
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lefalya/commonuser/definition"
+	"net/http"
+	"time"
+)
+
+type CSRFMode int
+
+const (
+	// CSRFDoubleSubmit compares the CSRF header against a JavaScript readable cookie.
+	CSRFDoubleSubmit CSRFMode = iota
+	// CSRFSynchronizer compares the CSRF header against the token stored in the session record.
+	CSRFSynchronizer
+)
+
+type CookieConfig struct {
+	AccessCookieName  string
+	RefreshCookieName string
+	CSRFCookieName    string
+	CSRFHeaderName    string
+	Domain            string
+	Path              string
+	Secure            bool
+	SameSite          http.SameSite
+	// RefreshWindow refreshes the access token transparently when it expires within this window.
+	RefreshWindow time.Duration
+	CSRFMode      CSRFMode
+}
+
+func DefaultCookieConfig() CookieConfig {
+	return CookieConfig{
+		AccessCookieName:  "access_token",
+		RefreshCookieName: "refresh_token",
+		CSRFCookieName:    "csrf_token",
+		CSRFHeaderName:    "X-CSRF-Token",
+		Path:              "/",
+		Secure:            true,
+		SameSite:          http.SameSiteLaxMode,
+		RefreshWindow:     5 * time.Minute,
+		CSRFMode:          CSRFDoubleSubmit,
+	}
+}
+
+type cookieContextKey int
+
+const (
+	claimsContextKey cookieContextKey = iota
+	csrfTokenContextKey
+)
+
+func ClaimsFromContext(ctx context.Context) (*UserClaims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(*UserClaims)
+	return claims, ok
+}
+
+// CSRFTokenFromContext exposes the request's CSRF token so server-rendered pages can embed it.
+func CSRFTokenFromContext(ctx context.Context) string {
+	csrfToken, _ := ctx.Value(csrfTokenContextKey).(string)
+	return csrfToken
+}
+
+// CookieSessionHandler keeps access and refresh tokens in HttpOnly cookies for
+// browser apps instead of handing bearer strings to JavaScript.
+type CookieSessionHandler struct {
+	config         CookieConfig
+	jwtHandler     *JWTHandler
+	accountManager *AccountManagerSQL
+	sessionManager *SessionManager
+}
+
+func (ch *CookieSessionHandler) SetSessionManager(sessionManager *SessionManager) {
+	ch.sessionManager = sessionManager
+}
+
+// SetTokens writes the login result's tokens as cookies together with a fresh
+// CSRF token, which is also returned.
+func (ch *CookieSessionHandler) SetTokens(w http.ResponseWriter, result *LoginResult) (string, error) {
+	if result.Status != LoginSuccess {
+		return "", definition.Unauthorized
+	}
+
+	lifeSpan := time.Hour * time.Duration(ch.jwtHandler.jwtTokenLifeSpan)
+	http.SetCookie(w, ch.cookie(ch.config.AccessCookieName, result.AccessToken, lifeSpan, true))
+	http.SetCookie(w, ch.cookie(ch.config.RefreshCookieName, result.RefreshToken, lifeSpan, true))
+
+	csrfToken, errToken := randomToken(32)
+	if errToken != nil {
+		return "", errToken
+	}
+
+	if ch.config.CSRFMode == CSRFSynchronizer {
+		claims, errParse := ch.jwtHandler.ParseAccessToken(result.AccessToken)
+		if errParse != nil {
+			return "", errParse
+		}
+		errStore := ch.storeSynchronizerToken(claims.UUID, claims.SessionId, csrfToken)
+		if errStore != nil {
+			return "", errStore
+		}
+	} else {
+		http.SetCookie(w, ch.cookie(ch.config.CSRFCookieName, csrfToken, lifeSpan, false))
+	}
+	return csrfToken, nil
+}
+
+func (ch *CookieSessionHandler) storeSynchronizerToken(accountUUID string, sessionId string, csrfToken string) error {
+	if ch.sessionManager == nil {
+		return errors.New("synchronizer csrf mode requires a session manager")
+	}
+	return ch.sessionManager.SetCSRFToken(accountUUID, sessionId, csrfToken)
+}
+
+func (ch *CookieSessionHandler) Clear(w http.ResponseWriter) {
+	for _, name := range []string{ch.config.AccessCookieName, ch.config.RefreshCookieName, ch.config.CSRFCookieName} {
+		cookie := ch.cookie(name, "", 0, true)
+		cookie.MaxAge = -1
+		http.SetCookie(w, cookie)
+	}
+}
+
+func (ch *CookieSessionHandler) cookie(name string, value string, lifeSpan time.Duration, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Domain:   ch.config.Domain,
+		Path:     ch.config.Path,
+		MaxAge:   int(lifeSpan.Seconds()),
+		Secure:   ch.config.Secure,
+		HttpOnly: httpOnly,
+		SameSite: ch.config.SameSite,
+	}
+}
+
+// Middleware authenticates the request from its cookies, refreshing tokens that
+// are missing, expired or about to expire, and enforces CSRF protection on
+// unsafe methods. The claims are available through ClaimsFromContext.
+func (ch *CookieSessionHandler) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, errAuthenticate := ch.authenticate(w, r)
+		if errAuthenticate != nil {
+			http.Error(w, definition.Unauthorized.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		csrfToken, errCSRF := ch.expectedCSRFToken(r, claims)
+		if errCSRF != nil {
+			http.Error(w, errCSRF.Error(), http.StatusForbidden)
+			return
+		}
+		if !isSafeMethod(r.Method) {
+			header := r.Header.Get(ch.config.CSRFHeaderName)
+			if csrfToken == "" || subtle.ConstantTimeCompare([]byte(header), []byte(csrfToken)) != 1 {
+				http.Error(w, definition.InvalidToken.Error(), http.StatusForbidden)
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		ctx = context.WithValue(ctx, csrfTokenContextKey, csrfToken)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Authenticate reads the claims from the request cookies like Middleware does,
+// without enforcing CSRF or rejecting the request, so callers can redirect
+// anonymous visitors to a login page instead.
+func (ch *CookieSessionHandler) Authenticate(w http.ResponseWriter, r *http.Request) (*UserClaims, error) {
+	return ch.authenticate(w, r)
+}
+
+func (ch *CookieSessionHandler) authenticate(w http.ResponseWriter, r *http.Request) (*UserClaims, error) {
+	accessCookie, errCookie := r.Cookie(ch.config.AccessCookieName)
+	if errCookie == nil {
+		claims, errParse := ch.jwtHandler.ParseAccessToken(accessCookie.Value)
+		if errParse == nil {
+			// once sessions are tracked every access token is bound to one
+			if ch.sessionManager != nil {
+				_, errSession := ch.sessionManager.ValidateAccessTokenContext(r.Context(), claims)
+				if errSession != nil {
+					return nil, errSession
+				}
+			}
+			if claims.ExpiresAt == nil || time.Until(claims.ExpiresAt.Time) > ch.config.RefreshWindow {
+				return claims, nil
+			}
+			// the access token is still valid, a failed early refresh must not
+			// sign the user out
+			refreshed, errRefresh := ch.refresh(w, r)
+			if errRefresh != nil {
+				return claims, nil
+			}
+			return refreshed, nil
+		} else if !errors.Is(errParse, jwt.ErrTokenExpired) {
+			return nil, errParse
+		}
+	}
+
+	return ch.refresh(w, r)
+}
+
+func (ch *CookieSessionHandler) refresh(w http.ResponseWriter, r *http.Request) (*UserClaims, error) {
+	refreshCookie, errCookie := r.Cookie(ch.config.RefreshCookieName)
+	if errCookie != nil {
+		return nil, definition.Unauthorized
+	}
+	refreshClaims, errParse := ch.jwtHandler.ParseRefreshToken(refreshCookie.Value)
+	if errParse != nil {
+		return nil, errParse
+	}
+	// once sessions are tracked every refresh token is bound to one
+	if ch.sessionManager != nil && refreshClaims.SessionId == "" {
+		return nil, definition.Unauthorized
+	}
+
+	account, errFind := ch.accountManager.FindByUUID(refreshClaims.UUID)
+	if errFind != nil {
+		return nil, errFind
+	}
+	if account == nil || account.IsSuspended() || ch.accountManager.PasswordChangeRequired(account) {
+		return nil, definition.Unauthorized
+	}
+	if ch.accountManager.roleManager != nil {
+		errRoles := ch.accountManager.roleManager.LoadRoles(account)
+		if errRoles != nil {
+			return nil, errRoles
+		}
+	}
+
+	var result *LoginResult
+	var errIssue error
+	if ch.sessionManager != nil {
+		session, errSession := ch.sessionManager.ValidateRefreshTokenContext(r.Context(), refreshClaims)
+		if errSession != nil {
+			return nil, errSession
+		}
+		account.ActiveOrganization = session.Organization
+		result, errIssue = ch.jwtHandler.IssueSessionTokens(account, session)
+	} else {
+		result, errIssue = ch.jwtHandler.IssueLoginResult(account, false)
+	}
+	if errIssue != nil {
+		return nil, errIssue
+	}
+
+	lifeSpan := time.Hour * time.Duration(ch.jwtHandler.jwtTokenLifeSpan)
+	http.SetCookie(w, ch.cookie(ch.config.AccessCookieName, result.AccessToken, lifeSpan, true))
+	http.SetCookie(w, ch.cookie(ch.config.RefreshCookieName, result.RefreshToken, lifeSpan, true))
+	return ch.jwtHandler.ParseAccessToken(result.AccessToken)
+}
+
+func (ch *CookieSessionHandler) expectedCSRFToken(r *http.Request, claims *UserClaims) (string, error) {
+	if ch.config.CSRFMode == CSRFSynchronizer {
+		if ch.sessionManager == nil || claims.SessionId == "" {
+			return "", definition.SessionNotFound
+		}
+		session, errFind := ch.sessionManager.FindContext(r.Context(), claims.UUID, claims.SessionId)
+		if errFind != nil {
+			return "", errFind
+		}
+		if session == nil {
+			return "", definition.SessionNotFound
+		}
+		return session.CSRFToken, nil
+	}
+
+	csrfCookie, errCookie := r.Cookie(ch.config.CSRFCookieName)
+	if errCookie != nil {
+		return "", nil
+	}
+	return csrfCookie.Value, nil
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+func NewCookieSessionHandler(jwtHandler *JWTHandler, accountManager *AccountManagerSQL, config CookieConfig) *CookieSessionHandler {
+	return &CookieSessionHandler{
+		config:         config,
+		jwtHandler:     jwtHandler,
+		accountManager: accountManager,
+	}
+}
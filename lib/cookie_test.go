@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func signTestAccessToken(t *testing.T, jwtHandler *JWTHandler, lifeSpan time.Duration, sessionId string) string {
+	t.Helper()
+	claims := newTestAccount().newUserClaims(jwtHandler.jwtTokenIssuer, lifeSpan)
+	claims.SessionId = sessionId
+	accessToken, errSign := signToken(jwtHandler.jwtSecret, claims)
+	if errSign != nil {
+		t.Fatal(errSign)
+	}
+	return accessToken
+}
+
+func TestCookieAuthenticateKeepsValidTokenWhenRefreshFails(t *testing.T) {
+	jwtHandler := NewJWTHandler("secret", "issuer", 1)
+	handler := NewCookieSessionHandler(jwtHandler, nil, DefaultCookieConfig())
+
+	// inside the refresh window, without a refresh cookie
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.AddCookie(&http.Cookie{Name: "access_token", Value: signTestAccessToken(t, jwtHandler, 2*time.Minute, "")})
+	claims, errAuthenticate := handler.Authenticate(httptest.NewRecorder(), request)
+	if errAuthenticate != nil {
+		t.Fatalf("a valid access token was refused: %v", errAuthenticate)
+	}
+	if claims.UUID != newTestAccount().GetUUID() {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	// expired, without a refresh cookie
+	request = httptest.NewRequest(http.MethodGet, "/", nil)
+	request.AddCookie(&http.Cookie{Name: "access_token", Value: signTestAccessToken(t, jwtHandler, -time.Minute, "")})
+	if _, errAuthenticate = handler.Authenticate(httptest.NewRecorder(), request); errAuthenticate == nil {
+		t.Error("an expired access token was accepted without a refresh")
+	}
+}
+
+func TestCookieAuthenticateRefusesSessionlessAccessToken(t *testing.T) {
+	jwtHandler := NewJWTHandler("secret", "issuer", 1)
+	handler := NewCookieSessionHandler(jwtHandler, nil, DefaultCookieConfig())
+	handler.SetSessionManager(NewSessionManager(newFakeRedis(), "test", time.Hour, 24*time.Hour))
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.AddCookie(&http.Cookie{Name: "access_token", Value: signTestAccessToken(t, jwtHandler, time.Hour, "")})
+	if _, errAuthenticate := handler.Authenticate(httptest.NewRecorder(), request); errAuthenticate == nil {
+		t.Error("an access token without a session was accepted")
+	}
+}
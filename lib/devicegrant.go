@@ -0,0 +1,471 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"github.com/lefalya/commonuser/definition"
+	"github.com/redis/go-redis/v9"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const GrantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+const (
+	defaultDeviceCodeLifeSpan = 10 * time.Minute
+	defaultDevicePollInterval = 5 * time.Second
+	// RFC 8628 section 6.1 recommends consonants only, so user codes neither
+	// spell words nor mix up 0/O and 1/I.
+	userCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength  = 8
+	// collisions are rare with 20^8 codes; repeated ones mean the space is
+	// flooded, and the request fails instead of spinning
+	userCodeAttempts = 5
+)
+
+type DeviceAuthorizationStatus string
+
+const (
+	DeviceAuthorizationPending  DeviceAuthorizationStatus = "pending"
+	DeviceAuthorizationApproved DeviceAuthorizationStatus = "approved"
+	DeviceAuthorizationDenied   DeviceAuthorizationStatus = "denied"
+)
+
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// DeviceAuthorization is the pending request a user code refers to.
+type DeviceAuthorization struct {
+	ClientId    string                    `json:"clientid"`
+	ClientName  string                    `json:"clientname"`
+	Scope       string                    `json:"scope"`
+	UserCode    string                    `json:"usercode"`
+	Status      DeviceAuthorizationStatus `json:"status"`
+	AccountUUID string                    `json:"accountuuid,omitempty"`
+	AuthTime    time.Time                 `json:"authtime,omitempty"`
+}
+
+// devicePoll tracks the device's polling apart from the authorization, so a
+// poll never writes over the user's decision.
+type devicePoll struct {
+	Interval     time.Duration `json:"interval"`
+	LastPolledAt time.Time     `json:"lastpolledat"`
+}
+
+// the device code itself is only known to the device; Redis holds its hash
+func (op *OAuthProvider) deviceCodeKey(deviceCodeHash string) string {
+	return op.entityName + ":oauth:device:" + deviceCodeHash
+}
+
+// the poll record is left to expire with the device code's life span
+func (op *OAuthProvider) devicePollKey(deviceCodeHash string) string {
+	return op.entityName + ":oauth:devicepoll:" + deviceCodeHash
+}
+
+func (op *OAuthProvider) userCodeKey(userCode string) string {
+	return op.entityName + ":oauth:usercode:" + userCode
+}
+
+func (op *OAuthProvider) verificationURL() string {
+	if op.config.VerificationURL != "" {
+		return op.config.VerificationURL
+	}
+	return op.config.Issuer + "/device"
+}
+
+// AuthorizeDevice starts the device authorization grant (RFC 8628) for the
+// client. The user then enters the returned user code at the verification URL
+// while the device polls the token endpoint with the device code.
+func (op *OAuthProvider) AuthorizeDevice(clientId string, clientSecret string, requestedScope string) (*DeviceAuthorizationResponse, error) {
+	client, errClient := op.clients.Authenticate(clientId, clientSecret)
+	if errClient != nil {
+		return nil, errClient
+	}
+	scopes, granted := grantScopes(requestedScope, client.Scopes)
+	if !granted {
+		return nil, definition.InvalidScope
+	}
+
+	deviceCode, errToken := randomToken(32)
+	if errToken != nil {
+		return nil, errToken
+	}
+	deviceCodeHash := hashAPIKey(deviceCode)
+
+	ctx := context.Background()
+	lifeSpan := op.config.DeviceCodeLifeSpan
+	userCode := ""
+	for attempt := 0; attempt < userCodeAttempts && userCode == ""; attempt++ {
+		candidate, errUserCode := generateUserCode()
+		if errUserCode != nil {
+			return nil, errUserCode
+		}
+		// another pending request may hold this user code
+		created, errSetNX := op.redis.SetNX(ctx, op.userCodeKey(candidate), deviceCodeHash, lifeSpan).Result()
+		if errSetNX != nil {
+			return nil, errSetNX
+		}
+		if created {
+			userCode = candidate
+		}
+	}
+	if userCode == "" {
+		return nil, definition.UserCodeUnavailable
+	}
+
+	payload, errMarshal := json.Marshal(DeviceAuthorization{
+		ClientId:   client.ClientId,
+		ClientName: client.Name,
+		Scope:      strings.Join(scopes, " "),
+		UserCode:   userCode,
+		Status:     DeviceAuthorizationPending,
+	})
+	if errMarshal != nil {
+		return nil, errMarshal
+	}
+	errSet := op.redis.Set(ctx, op.deviceCodeKey(deviceCodeHash), payload, lifeSpan).Err()
+	if errSet != nil {
+		return nil, errSet
+	}
+
+	formatted := userCode[:userCodeLength/2] + "-" + userCode[userCodeLength/2:]
+	return &DeviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                formatted,
+		VerificationURI:         op.verificationURL(),
+		VerificationURIComplete: appendQuery(op.verificationURL(), url.Values{"user_code": {formatted}}),
+		ExpiresIn:               int64(lifeSpan.Seconds()),
+		Interval:                int64(op.config.DevicePollInterval.Seconds()),
+	}, nil
+}
+
+// FindDeviceAuthorization returns the pending request behind a user code, nil
+// when it does not exist or expired. The user code is matched case-insensitively
+// and ignoring separators.
+func (op *OAuthProvider) FindDeviceAuthorization(userCode string) (*DeviceAuthorization, error) {
+	_, authorization, err := op.findDeviceAuthorization(userCode)
+	return authorization, err
+}
+
+func (op *OAuthProvider) findDeviceAuthorization(userCode string) (string, *DeviceAuthorization, error) {
+	ctx := context.Background()
+	deviceCodeHash, errGet := op.redis.Get(ctx, op.userCodeKey(normalizeUserCode(userCode))).Result()
+	if errGet != nil {
+		if errors.Is(errGet, redis.Nil) {
+			return "", nil, nil
+		}
+		return "", nil, errGet
+	}
+
+	authorization, errLoad := op.loadDeviceAuthorization(ctx, deviceCodeHash)
+	if errLoad != nil {
+		return "", nil, errLoad
+	}
+	return deviceCodeHash, authorization, nil
+}
+
+func (op *OAuthProvider) loadDeviceAuthorization(ctx context.Context, deviceCodeHash string) (*DeviceAuthorization, error) {
+	payload, errGet := op.redis.Get(ctx, op.deviceCodeKey(deviceCodeHash)).Bytes()
+	if errGet != nil {
+		if errors.Is(errGet, redis.Nil) {
+			return nil, nil
+		}
+		return nil, errGet
+	}
+
+	authorization := &DeviceAuthorization{}
+	errUnmarshal := json.Unmarshal(payload, authorization)
+	if errUnmarshal != nil {
+		return nil, errUnmarshal
+	}
+	return authorization, nil
+}
+
+func (op *OAuthProvider) saveDeviceAuthorization(ctx context.Context, deviceCodeHash string, authorization *DeviceAuthorization) error {
+	payload, errMarshal := json.Marshal(authorization)
+	if errMarshal != nil {
+		return errMarshal
+	}
+	// XX keeps an expired request from coming back without a TTL
+	saved, errSet := op.redis.SetArgs(ctx, op.deviceCodeKey(deviceCodeHash), payload, redis.SetArgs{Mode: "XX", KeepTTL: true}).Result()
+	if errSet != nil && !errors.Is(errSet, redis.Nil) {
+		return errSet
+	}
+	if saved != "OK" {
+		return definition.RequestNotFound
+	}
+	return nil
+}
+
+// ApproveDevice lets the signed in account grant the device request, which
+// counts as consent to the requested scopes. The user code stops working once
+// the request is decided.
+func (op *OAuthProvider) ApproveDevice(account *AccountSQL, userCode string) error {
+	return op.decideDevice(account, userCode, DeviceAuthorizationApproved)
+}
+
+func (op *OAuthProvider) DenyDevice(account *AccountSQL, userCode string) error {
+	return op.decideDevice(account, userCode, DeviceAuthorizationDenied)
+}
+
+func (op *OAuthProvider) decideDevice(account *AccountSQL, userCode string, status DeviceAuthorizationStatus) error {
+	deviceCodeHash, authorization, errFind := op.findDeviceAuthorization(userCode)
+	if errFind != nil {
+		return errFind
+	}
+	if authorization == nil || authorization.Status != DeviceAuthorizationPending {
+		return definition.RequestNotFound
+	}
+
+	if status == DeviceAuthorizationApproved {
+		errConsent := op.consentToDevice(account, authorization)
+		if errConsent != nil {
+			return errConsent
+		}
+	}
+
+	authorization.Status = status
+	authorization.AccountUUID = account.GetUUID()
+	authorization.AuthTime = time.Now().UTC()
+
+	ctx := context.Background()
+	errSave := op.saveDeviceAuthorization(ctx, deviceCodeHash, authorization)
+	if errSave != nil {
+		return errSave
+	}
+	return op.redis.Del(ctx, op.userCodeKey(authorization.UserCode)).Err()
+}
+
+// consentToDevice adds the device request's scopes to the account's consent,
+// which its refresh tokens are checked against.
+func (op *OAuthProvider) consentToDevice(account *AccountSQL, authorization *DeviceAuthorization) error {
+	client, errClient := op.clients.Find(authorization.ClientId)
+	if errClient != nil {
+		return errClient
+	}
+	if client == nil {
+		return definition.RequestNotFound
+	}
+	if client.FirstParty {
+		return nil
+	}
+
+	consented, errConsent := op.clients.FindConsent(account.GetUUID(), client.ClientId)
+	if errConsent != nil {
+		return errConsent
+	}
+	scopes := strings.Fields(authorization.Scope)
+	if containsScopes(consented, scopes) {
+		return nil
+	}
+	for _, scope := range consented {
+		if !containsScopes(scopes, []string{scope}) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return op.clients.GrantConsent(account, client.ClientId, scopes)
+}
+
+// ExchangeDeviceCode is polled by the device. It returns
+// definition.AuthorizationPending until the user decides, definition.SlowDown
+// when polled faster than the interval (which then grows by five seconds),
+// definition.AccessDenied on denial and definition.RequestExpired once the
+// device code is gone.
+func (op *OAuthProvider) ExchangeDeviceCode(clientId string, clientSecret string, deviceCode string) (*OAuthTokenResponse, error) {
+	client, errClient := op.clients.Authenticate(clientId, clientSecret)
+	if errClient != nil {
+		return nil, errClient
+	}
+
+	ctx := context.Background()
+	deviceCodeHash := hashAPIKey(deviceCode)
+	authorization, errLoad := op.loadDeviceAuthorization(ctx, deviceCodeHash)
+	if errLoad != nil {
+		return nil, errLoad
+	}
+	if authorization == nil {
+		return nil, definition.RequestExpired
+	}
+	if authorization.ClientId != client.ClientId {
+		return nil, definition.InvalidToken
+	}
+
+	switch authorization.Status {
+	case DeviceAuthorizationPending:
+		tooFast, errPoll := op.recordDevicePoll(ctx, deviceCodeHash)
+		if errPoll != nil {
+			return nil, errPoll
+		}
+		if tooFast {
+			return nil, definition.SlowDown
+		}
+		return nil, definition.AuthorizationPending
+	case DeviceAuthorizationDenied:
+		errDel := op.redis.Del(ctx, op.deviceCodeKey(deviceCodeHash)).Err()
+		if errDel != nil {
+			return nil, errDel
+		}
+		return nil, definition.AccessDenied
+	}
+
+	// only the poll that removes the record may redeem it
+	deleted, errDel := op.redis.Del(ctx, op.deviceCodeKey(deviceCodeHash)).Result()
+	if errDel != nil {
+		return nil, errDel
+	}
+	if deleted == 0 {
+		return nil, definition.RequestExpired
+	}
+	return op.issueTokens(client, authorization.AccountUUID, strings.Fields(authorization.Scope), "", authorization.AuthTime)
+}
+
+// recordDevicePoll reports whether the device polled faster than its interval,
+// growing the interval by five seconds when it did.
+func (op *OAuthProvider) recordDevicePoll(ctx context.Context, deviceCodeHash string) (bool, error) {
+	poll := devicePoll{Interval: op.config.DevicePollInterval}
+	payload, errGet := op.redis.Get(ctx, op.devicePollKey(deviceCodeHash)).Bytes()
+	if errGet != nil && !errors.Is(errGet, redis.Nil) {
+		return false, errGet
+	}
+	if errGet == nil {
+		errUnmarshal := json.Unmarshal(payload, &poll)
+		if errUnmarshal != nil {
+			return false, errUnmarshal
+		}
+	}
+
+	timeNow := time.Now().UTC()
+	tooFast := timeNow.Sub(poll.LastPolledAt) < poll.Interval
+	if tooFast {
+		poll.Interval += defaultDevicePollInterval
+	}
+	poll.LastPolledAt = timeNow
+
+	payload, errMarshal := json.Marshal(poll)
+	if errMarshal != nil {
+		return false, errMarshal
+	}
+	errSet := op.redis.Set(ctx, op.devicePollKey(deviceCodeHash), payload, op.config.DeviceCodeLifeSpan).Err()
+	if errSet != nil {
+		return false, errSet
+	}
+	return tooFast, nil
+}
+
+// DeviceAuthorizationHandler serves the device authorization endpoint.
+func (op *OAuthProvider) DeviceAuthorizationHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeOAuthError(w, http.StatusMethodNotAllowed, OAuthInvalidRequest, "device authorization endpoint only accepts POST")
+			return
+		}
+
+		clientId, clientSecret := clientCredentialsFromRequest(r)
+		response, errAuthorize := op.AuthorizeDevice(clientId, clientSecret, r.PostFormValue("scope"))
+		if errAuthorize != nil {
+			writeTokenError(w, errAuthorize)
+			return
+		}
+		writeJSON(w, http.StatusOK, response)
+	})
+}
+
+// VerificationHandler backs the page where the signed in user enters a user
+// code. GET describes the pending request; POST with approve=true or
+// approve=false decides it. Cookie based deployments should mount it behind
+// CookieSessionHandler.Middleware so the POST is CSRF protected.
+func (op *OAuthProvider) VerificationHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := op.authenticate(w, r)
+		if claims == nil {
+			if r.Method == http.MethodGet && op.config.LoginURL != "" {
+				http.Redirect(w, r, appendQuery(op.config.LoginURL, url.Values{"return_to": {r.URL.String()}}), http.StatusFound)
+				return
+			}
+			http.Error(w, definition.Unauthorized.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			authorization, errFind := op.FindDeviceAuthorization(r.URL.Query().Get("user_code"))
+			if errFind != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if authorization == nil || authorization.Status != DeviceAuthorizationPending {
+				http.Error(w, definition.RequestNotFound.Error(), http.StatusNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{
+				"client_id":   authorization.ClientId,
+				"client_name": authorization.ClientName,
+				"scope":       authorization.Scope,
+			})
+		case http.MethodPost:
+			account, errAccount := op.accountManager.FindByUUID(claims.UUID)
+			if errAccount != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if account == nil {
+				http.Error(w, definition.Unauthorized.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			var errDecide error
+			if r.PostFormValue("approve") == "true" {
+				errDecide = op.ApproveDevice(account, r.PostFormValue("user_code"))
+			} else {
+				errDecide = op.DenyDevice(account, r.PostFormValue("user_code"))
+			}
+			if errDecide != nil {
+				if errDecide == definition.RequestNotFound {
+					http.Error(w, errDecide.Error(), http.StatusNotFound)
+					return
+				}
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func generateUserCode() (string, error) {
+	charsetSize := big.NewInt(int64(len(userCodeCharset)))
+	userCode := make([]byte, userCodeLength)
+	for i := range userCode {
+		index, err := rand.Int(rand.Reader, charsetSize)
+		if err != nil {
+			return "", err
+		}
+		userCode[i] = userCodeCharset[index.Int64()]
+	}
+	return string(userCode), nil
+}
+
+func normalizeUserCode(userCode string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r
+		}
+		return -1
+	}, userCode)
+}
@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"errors"
+	"github.com/lefalya/commonuser/definition"
+	"testing"
+)
+
+func TestExchangeDeviceCodeKeepsDecision(t *testing.T) {
+	provider, client, clientSecret, account := newTestOAuthFlow(t, []string{ScopeOpenId, ScopeOfflineAccess})
+	device, errAuthorize := provider.AuthorizeDevice(client.ClientId, clientSecret, "")
+	if errAuthorize != nil {
+		t.Fatal(errAuthorize)
+	}
+
+	if _, err := provider.ExchangeDeviceCode(client.ClientId, clientSecret, device.DeviceCode); !errors.Is(err, definition.AuthorizationPending) {
+		t.Fatalf("got %v before the decision, want %v", err, definition.AuthorizationPending)
+	}
+	if _, err := provider.ExchangeDeviceCode(client.ClientId, clientSecret, device.DeviceCode); !errors.Is(err, definition.SlowDown) {
+		t.Fatalf("got %v for an early poll, want %v", err, definition.SlowDown)
+	}
+	if err := provider.ApproveDevice(account, device.UserCode); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.DenyDevice(account, device.UserCode); !errors.Is(err, definition.RequestNotFound) {
+		t.Fatalf("got %v for a decided user code, want %v", err, definition.RequestNotFound)
+	}
+
+	tokens, errExchange := provider.ExchangeDeviceCode(client.ClientId, clientSecret, device.DeviceCode)
+	if errExchange != nil {
+		t.Fatal(errExchange)
+	}
+	if tokens.RefreshToken == "" {
+		t.Errorf("missing refresh token in %+v", tokens)
+	}
+	if _, err := provider.ExchangeDeviceCode(client.ClientId, clientSecret, device.DeviceCode); !errors.Is(err, definition.RequestExpired) {
+		t.Fatalf("got %v for a redeemed device code, want %v", err, definition.RequestExpired)
+	}
+}
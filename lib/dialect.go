@@ -0,0 +1,331 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Dialect hides the differences between the SQL databases commonuser runs on.
+// Queries are written once with Postgres style $N placeholders and rebound for
+// the dialect right before they reach the driver.
+type Dialect interface {
+	Name() string
+	// Rebind rewrites the $N placeholders of query, reordering args when the
+	// dialect only knows positional placeholders.
+	Rebind(query string, args []any) (string, []any)
+	QuoteIdentifier(name string) string
+	// Upsert builds an INSERT of columns that updates updateColumns instead when
+	// a row with the same conflictColumns already exists.
+	Upsert(table string, columns []string, conflictColumns []string, updateColumns []string) string
+	TimestampType() string
+	CurrentTimestamp() string
+	// SupportsIfExists tells whether ALTER TABLE accepts IF [NOT] EXISTS on
+	// columns.
+	SupportsIfExists() bool
+	IsUniqueViolation(err error) bool
+}
+
+var (
+	PostgreSQL Dialect = postgresDialect{}
+	// MySQL needs parseTime=true in the DSN to scan timestamps, and
+	// clientFoundRows=true so that an update leaving a row unchanged still
+	// counts it as affected.
+	MySQL  Dialect = mysqlDialect{}
+	SQLite Dialect = sqliteDialect{}
+)
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+func (postgresDialect) Rebind(query string, args []any) (string, []any) {
+	return query, args
+}
+
+// Postgres folds unquoted identifiers to lower case, so quoted names are
+// lowered too and keep matching tables created without quotes.
+func (postgresDialect) QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(strings.ToLower(name), `"`, `""`) + `"`
+}
+
+func (postgresDialect) Upsert(table string, columns []string, conflictColumns []string, updateColumns []string) string {
+	return onConflictUpsert(table, columns, conflictColumns, updateColumns)
+}
+
+func (postgresDialect) TimestampType() string {
+	return "TIMESTAMP"
+}
+
+func (postgresDialect) CurrentTimestamp() string {
+	return "CURRENT_TIMESTAMP"
+}
+
+func (postgresDialect) SupportsIfExists() bool {
+	return true
+}
+
+func (postgresDialect) IsUniqueViolation(err error) bool {
+	if stateErr, ok := err.(interface{ SQLState() string }); ok {
+		return stateErr.SQLState() == "23505"
+	}
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "23505") || strings.Contains(message, "duplicate key")
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string {
+	return "mysql"
+}
+
+// MySQL only has anonymous ? placeholders, so an argument referenced twice is
+// passed twice.
+func (mysqlDialect) Rebind(query string, args []any) (string, []any) {
+	var rebound []any
+	query = replacePlaceholders(query, func(index int) string {
+		if index <= len(args) {
+			rebound = append(rebound, args[index-1])
+		}
+		return "?"
+	})
+	return query, rebound
+}
+
+func (mysqlDialect) QuoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func (mysqlDialect) Upsert(table string, columns []string, conflictColumns []string, updateColumns []string) string {
+	assignments := make([]string, len(updateColumns))
+	for i, column := range updateColumns {
+		assignments[i] = column + " = VALUES(" + column + ")"
+	}
+	return insertStatement(table, columns) + " ON DUPLICATE KEY UPDATE " + strings.Join(assignments, ", ")
+}
+
+func (mysqlDialect) TimestampType() string {
+	return "DATETIME(6)"
+}
+
+func (mysqlDialect) CurrentTimestamp() string {
+	return "CURRENT_TIMESTAMP(6)"
+}
+
+func (mysqlDialect) SupportsIfExists() bool {
+	return false
+}
+
+func (mysqlDialect) IsUniqueViolation(err error) bool {
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "error 1062") || strings.Contains(message, "duplicate entry")
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+// SQLite understands numbered ?N placeholders, which keep the argument order.
+func (sqliteDialect) Rebind(query string, args []any) (string, []any) {
+	return replacePlaceholders(query, func(index int) string {
+		return "?" + strconv.Itoa(index)
+	}), args
+}
+
+func (sqliteDialect) QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (sqliteDialect) Upsert(table string, columns []string, conflictColumns []string, updateColumns []string) string {
+	return onConflictUpsert(table, columns, conflictColumns, updateColumns)
+}
+
+func (sqliteDialect) TimestampType() string {
+	return "TIMESTAMP"
+}
+
+func (sqliteDialect) CurrentTimestamp() string {
+	return "CURRENT_TIMESTAMP"
+}
+
+func (sqliteDialect) SupportsIfExists() bool {
+	return false
+}
+
+func (sqliteDialect) IsUniqueViolation(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "unique constraint failed")
+}
+
+func insertStatement(table string, columns []string) string {
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+	}
+	return "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES (" + strings.Join(placeholders, ", ") + ")"
+}
+
+func onConflictUpsert(table string, columns []string, conflictColumns []string, updateColumns []string) string {
+	assignments := make([]string, len(updateColumns))
+	for i, column := range updateColumns {
+		assignments[i] = column + " = EXCLUDED." + column
+	}
+	return insertStatement(table, columns) + " ON CONFLICT (" + strings.Join(conflictColumns, ", ") + ") DO UPDATE SET " + strings.Join(assignments, ", ")
+}
+
+// replacePlaceholders calls replace for every $N outside of string literals.
+func replacePlaceholders(query string, replace func(index int) string) string {
+	var rebound strings.Builder
+	inLiteral := false
+	for i := 0; i < len(query); i++ {
+		char := query[i]
+		if char == '\'' {
+			inLiteral = !inLiteral
+		}
+		if char != '$' || inLiteral {
+			rebound.WriteByte(char)
+			continue
+		}
+
+		end := i + 1
+		for end < len(query) && query[end] >= '0' && query[end] <= '9' {
+			end++
+		}
+		if end == i+1 {
+			rebound.WriteByte(char)
+			continue
+		}
+		index, _ := strconv.Atoi(query[i+1 : end])
+		rebound.WriteString(replace(index))
+		i = end - 1
+	}
+	return rebound.String()
+}
+
+var dialects sync.Map
+
+// SetDialect overrides the dialect detected for db from its driver.
+func SetDialect(db *sql.DB, dialect Dialect) {
+	dialects.Store(db, dialect)
+}
+
+// DialectOf returns the dialect set for db, otherwise the one matching its
+// driver, falling back to PostgreSQL.
+func DialectOf(db *sql.DB) Dialect {
+	if dialect, found := dialects.Load(db); found {
+		return dialect.(Dialect)
+	}
+
+	var dialect Dialect = PostgreSQL
+	driverType := strings.ToLower(fmt.Sprintf("%T", db.Driver()))
+	switch {
+	case strings.Contains(driverType, "mysql"):
+		dialect = MySQL
+	case strings.Contains(driverType, "sqlite"):
+		dialect = SQLite
+	}
+	dialects.Store(db, dialect)
+	return dialect
+}
+
+// sqlDB rebinds every query for the dialect of the wrapped database.
+type sqlDB struct {
+	*sql.DB
+}
+
+func newSQLDB(db *sql.DB) *sqlDB {
+	return &sqlDB{DB: db}
+}
+
+func (d *sqlDB) dialect() Dialect {
+	return DialectOf(d.DB)
+}
+
+func (d *sqlDB) table(name string) string {
+	return d.dialect().QuoteIdentifier(name)
+}
+
+func (d *sqlDB) Exec(query string, args ...any) (sql.Result, error) {
+	return d.ExecContext(context.Background(), query, args...)
+}
+
+func (d *sqlDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	query, args = d.dialect().Rebind(query, args)
+	return d.DB.ExecContext(ctx, query, args...)
+}
+
+func (d *sqlDB) Query(query string, args ...any) (*sql.Rows, error) {
+	return d.QueryContext(context.Background(), query, args...)
+}
+
+func (d *sqlDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	query, args = d.dialect().Rebind(query, args)
+	return d.DB.QueryContext(ctx, query, args...)
+}
+
+func (d *sqlDB) QueryRow(query string, args ...any) *sql.Row {
+	return d.QueryRowContext(context.Background(), query, args...)
+}
+
+func (d *sqlDB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	query, args = d.dialect().Rebind(query, args)
+	return d.DB.QueryRowContext(ctx, query, args...)
+}
+
+func (d *sqlDB) Begin() (*sqlTx, error) {
+	return d.BeginTx(context.Background(), nil)
+}
+
+func (d *sqlDB) BeginTx(ctx context.Context, options *sql.TxOptions) (*sqlTx, error) {
+	tx, err := d.DB.BeginTx(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{Tx: tx, dialectOf: d.dialect()}, nil
+}
+
+type sqlTx struct {
+	*sql.Tx
+	dialectOf Dialect
+}
+
+func (t *sqlTx) dialect() Dialect {
+	return t.dialectOf
+}
+
+func (t *sqlTx) table(name string) string {
+	return t.dialectOf.QuoteIdentifier(name)
+}
+
+func (t *sqlTx) Exec(query string, args ...any) (sql.Result, error) {
+	return t.ExecContext(context.Background(), query, args...)
+}
+
+func (t *sqlTx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	query, args = t.dialectOf.Rebind(query, args)
+	return t.Tx.ExecContext(ctx, query, args...)
+}
+
+func (t *sqlTx) Query(query string, args ...any) (*sql.Rows, error) {
+	return t.QueryContext(context.Background(), query, args...)
+}
+
+func (t *sqlTx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	query, args = t.dialectOf.Rebind(query, args)
+	return t.Tx.QueryContext(ctx, query, args...)
+}
+
+func (t *sqlTx) QueryRow(query string, args ...any) *sql.Row {
+	return t.QueryRowContext(context.Background(), query, args...)
+}
+
+func (t *sqlTx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	query, args = t.dialectOf.Rebind(query, args)
+	return t.Tx.QueryRowContext(ctx, query, args...)
+}
@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRebind(t *testing.T) {
+	const query = "SELECT * FROM t WHERE a = $1 AND b = '$2' AND c IN ($2, $1) AND d = '$' || $10"
+	args := []any{"first", "second", 3, 4, 5, 6, 7, 8, 9, "tenth"}
+
+	tests := []struct {
+		dialect Dialect
+		query   string
+		args    []any
+	}{
+		{
+			dialect: PostgreSQL,
+			query:   query,
+			args:    args,
+		},
+		{
+			dialect: MySQL,
+			query:   "SELECT * FROM t WHERE a = ? AND b = '$2' AND c IN (?, ?) AND d = '$' || ?",
+			args:    []any{"first", "second", "first", "tenth"},
+		},
+		{
+			dialect: SQLite,
+			query:   "SELECT * FROM t WHERE a = ?1 AND b = '$2' AND c IN (?2, ?1) AND d = '$' || ?10",
+			args:    args,
+		},
+	}
+	for _, test := range tests {
+		rebound, reboundArgs := test.dialect.Rebind(query, args)
+		if rebound != test.query {
+			t.Errorf("%s: got %q, want %q", test.dialect.Name(), rebound, test.query)
+		}
+		if !reflect.DeepEqual(reboundArgs, test.args) {
+			t.Errorf("%s: got args %v, want %v", test.dialect.Name(), reboundArgs, test.args)
+		}
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	columns := []string{"accountuuid", "clientid", "scopes"}
+	tests := []struct {
+		dialect Dialect
+		query   string
+	}{
+		{
+			dialect: PostgreSQL,
+			query:   "INSERT INTO consent (accountuuid, clientid, scopes) VALUES ($1, $2, $3) ON CONFLICT (accountuuid, clientid) DO UPDATE SET scopes = EXCLUDED.scopes",
+		},
+		{
+			dialect: MySQL,
+			query:   "INSERT INTO consent (accountuuid, clientid, scopes) VALUES ($1, $2, $3) ON DUPLICATE KEY UPDATE scopes = VALUES(scopes)",
+		},
+		{
+			dialect: SQLite,
+			query:   "INSERT INTO consent (accountuuid, clientid, scopes) VALUES ($1, $2, $3) ON CONFLICT (accountuuid, clientid) DO UPDATE SET scopes = EXCLUDED.scopes",
+		},
+	}
+	for _, test := range tests {
+		query := test.dialect.Upsert("consent", columns, columns[:2], columns[2:])
+		if query != test.query {
+			t.Errorf("%s: got %q, want %q", test.dialect.Name(), query, test.query)
+		}
+	}
+}
+
+func TestUpsertOnSQLite(t *testing.T) {
+	db := newSQLDB(newTestDB(t))
+	if db.dialect() != SQLite {
+		t.Fatalf("detected %s for the sqlite3 driver", db.dialect().Name())
+	}
+	if _, err := db.Exec("CREATE TABLE consent (accountuuid TEXT, clientid TEXT, scopes TEXT, PRIMARY KEY (accountuuid, clientid))"); err != nil {
+		t.Fatal(err)
+	}
+
+	columns := []string{"accountuuid", "clientid", "scopes"}
+	query := db.dialect().Upsert(db.table("consent"), columns, columns[:2], columns[2:])
+	for _, scopes := range []string{"openid", "openid email"} {
+		if _, err := db.Exec(query, "account", "client", scopes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int
+	var scopes string
+	if err := db.QueryRow("SELECT COUNT(*), MAX(scopes) FROM consent WHERE accountuuid = $1", "account").Scan(&count, &scopes); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || scopes != "openid email" {
+		t.Errorf("got %d rows with scopes %q, want one row with %q", count, scopes, "openid email")
+	}
+}
@@ -1,9 +1,11 @@
 package lib
 
 import (
+	"context"
 	"database/sql"
 	"github.com/lefalya/commonuser/definition"
 	"github.com/lefalya/pageflow"
+	"github.com/redis/go-redis/v9"
 	"time"
 )
 
@@ -56,21 +58,59 @@ func NewUpdateEmailRequestSQL() *UpdateEmailRequestSQL {
 }
 
 type UpdateEmailManagerSQL struct {
-	db         *sql.DB
+	db         *sqlDB
 	entityName string
+	cache      *accountCache
+	tx         *Tx
+}
+
+// SetInvalidationBus broadcasts the manager's cache invalidations.
+func (em *UpdateEmailManagerSQL) SetInvalidationBus(bus *InvalidationBus) {
+	em.cache.bus = bus
+}
+
+// WithTx returns a copy of the manager that works inside tx.
+func (em *UpdateEmailManagerSQL) WithTx(tx *Tx) *UpdateEmailManagerSQL {
+	bound := *em
+	bound.tx = tx
+	return &bound
+}
+
+func (em *UpdateEmailManagerSQL) conn() sqlConn {
+	if em.tx != nil {
+		return em.tx
+	}
+	return em.db
+}
+
+func (em *UpdateEmailManagerSQL) inTx(ctx context.Context, fn func(updates *UpdateEmailManagerSQL) error) error {
+	if em.tx != nil {
+		return fn(em)
+	}
+	return RunInTx(ctx, em.db.DB, func(tx *Tx) error {
+		return fn(em.WithTx(tx))
+	})
+}
+
+func (em *UpdateEmailManagerSQL) tableName() string {
+	return em.db.table(em.entityName + "UpdateEmail")
 }
 
 func (em *UpdateEmailManagerSQL) CreateRequest(account AccountSQL, newEmailAddress string) (*UpdateEmailRequestSQL, error) {
+	return em.CreateRequestContext(context.Background(), account, newEmailAddress)
+}
+
+func (em *UpdateEmailManagerSQL) CreateRequestContext(ctx context.Context, account AccountSQL, newEmailAddress string) (*UpdateEmailRequestSQL, error) {
 	updateEmailRequest := NewUpdateEmailRequestSQL()
+	updateEmailRequest.SetAccountUUID(&account)
 	updateEmailRequest.SetPreviousEmailAddress(account.Base.Email)
 	updateEmailRequest.SetNewEmailAddress(newEmailAddress)
 	updateEmailRequest.SetResetToken()
 	updateEmailRequest.SetExpiration()
 
-	tableName := em.entityName + "UpdateEmailManagerSQL"
-
-	query := `INSERT INTO ` + tableName + ` (uuid, randId, createdat, updatedat, accountuuid, previousemailaddress, newemailaddress, updatetoken, expiredat) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
-	_, errInsert := em.db.Exec(
+	query := `INSERT INTO ` + em.tableName() + ` (uuid, randId, createdat, updatedat, accountuuid, previousemailaddress, newemailaddress, updatetoken, expiredat) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, errInsert := em.conn().ExecContext(
+		ctx,
 		query,
 		updateEmailRequest.GetUUID(),
 		updateEmailRequest.GetRandId(),
@@ -89,8 +129,34 @@ func (em *UpdateEmailManagerSQL) CreateRequest(account AccountSQL, newEmailAddre
 }
 
 func (em *UpdateEmailManagerSQL) FindRequest(account AccountSQL) (*UpdateEmailRequestSQL, error) {
-	query := `SELECT * FROM ` + em.entityName + `UpdateEmailManagerSQL WHERE accountuuid = $1`
-	row := em.db.QueryRow(query, account.GetUUID())
+	return em.FindRequestContext(context.Background(), account)
+}
+
+func (em *UpdateEmailManagerSQL) FindRequestContext(ctx context.Context, account AccountSQL) (*UpdateEmailRequestSQL, error) {
+	updateEmailRequest, err := em.findByAccount(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	if updateEmailRequest == nil {
+		return nil, nil
+	}
+
+	if updateEmailRequest.ExpiredAt.Before(time.Now().UTC()) {
+		em.DeleteRequestContext(ctx, updateEmailRequest)
+		newUpdateEmailRequest, err := em.CreateRequestContext(ctx, account, updateEmailRequest.NewEmailAddress)
+		if err != nil {
+			return nil, err
+		}
+		return newUpdateEmailRequest, nil
+	} else {
+		return nil, definition.RequestExist
+	}
+	return updateEmailRequest, nil
+}
+
+func (em *UpdateEmailManagerSQL) findByAccount(ctx context.Context, account AccountSQL) (*UpdateEmailRequestSQL, error) {
+	query := `SELECT uuid, randId, createdat, updatedat, accountuuid, previousemailaddress, newemailaddress, updatetoken, expiredat FROM ` + em.tableName() + ` WHERE accountuuid = $1`
+	row := em.conn().QueryRowContext(ctx, query, account.GetUUID())
 	updateEmailRequest := NewUpdateEmailRequestSQL()
 	err := row.Scan(
 		&updateEmailRequest.SQLItem.UUID,
@@ -101,6 +167,7 @@ func (em *UpdateEmailManagerSQL) FindRequest(account AccountSQL) (*UpdateEmailRe
 		&updateEmailRequest.PreviousEmailAddress,
 		&updateEmailRequest.NewEmailAddress,
 		&updateEmailRequest.UpdateToken,
+		&updateEmailRequest.ExpiredAt,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -108,23 +175,16 @@ func (em *UpdateEmailManagerSQL) FindRequest(account AccountSQL) (*UpdateEmailRe
 		}
 		return nil, err
 	}
-
-	if updateEmailRequest.ExpiredAt.Before(time.Now().UTC()) {
-		em.DeleteRequest(updateEmailRequest)
-		newUpdateEmailRequest, err := em.CreateRequest(account, updateEmailRequest.NewEmailAddress)
-		if err != nil {
-			return nil, err
-		}
-		return newUpdateEmailRequest, nil
-	} else {
-		return nil, definition.RequestExist
-	}
 	return updateEmailRequest, nil
 }
 
 func (em *UpdateEmailManagerSQL) DeleteRequest(request *UpdateEmailRequestSQL) error {
-	query := `DELETE FROM ` + em.entityName + `UpdateEmailManagerSQL WHERE uuid = $1`
-	_, errDelete := em.db.Exec(query, request.GetUUID())
+	return em.DeleteRequestContext(context.Background(), request)
+}
+
+func (em *UpdateEmailManagerSQL) DeleteRequestContext(ctx context.Context, request *UpdateEmailRequestSQL) error {
+	query := `DELETE FROM ` + em.tableName() + ` WHERE uuid = $1`
+	_, errDelete := em.conn().ExecContext(ctx, query, request.GetUUID())
 	if errDelete != nil {
 		return errDelete
 	}
@@ -132,27 +192,78 @@ func (em *UpdateEmailManagerSQL) DeleteRequest(request *UpdateEmailRequestSQL) e
 }
 
 func (em *UpdateEmailManagerSQL) ValidateRequest(account AccountSQL, updateToken string) error {
-	request, errFind := em.FindRequest(account)
+	return em.ValidateRequestContext(context.Background(), account, updateToken)
+}
+
+func (em *UpdateEmailManagerSQL) ValidateRequestContext(ctx context.Context, account AccountSQL, updateToken string) error {
+	_, errValidate := em.validRequest(ctx, account, updateToken)
+	return errValidate
+}
+
+func (em *UpdateEmailManagerSQL) validRequest(ctx context.Context, account AccountSQL, updateToken string) (*UpdateEmailRequestSQL, error) {
+	request, errFind := em.findByAccount(ctx, account)
 	if errFind != nil {
-		return errFind
+		return nil, errFind
 	}
 	if request == nil {
-		return definition.RequestNotFound
+		return nil, definition.RequestNotFound
 	}
 	errValidate := request.Validate(updateToken)
 	if errValidate != nil {
 		if errValidate == definition.RequestExpired {
-			em.DeleteRequest(request)
-			return definition.RequestExpired
+			em.DeleteRequestContext(ctx, request)
+			return nil, definition.RequestExpired
 		}
+		return nil, errValidate
+	}
+	return request, nil
+}
+
+// ApplyRequest moves the account to the requested email address and consumes
+// the request in one transaction. The update token is meant to be delivered to
+// the new address, so the new address counts as verified.
+func (em *UpdateEmailManagerSQL) ApplyRequest(account *AccountSQL, updateToken string) error {
+	return em.ApplyRequestContext(context.Background(), account, updateToken)
+}
+
+func (em *UpdateEmailManagerSQL) ApplyRequestContext(ctx context.Context, account *AccountSQL, updateToken string) error {
+	request, errValidate := em.validRequest(ctx, *account, updateToken)
+	if errValidate != nil {
 		return errValidate
 	}
+
+	errApply := em.inTx(ctx, func(updates *UpdateEmailManagerSQL) error {
+		query := "UPDATE " + updates.db.table(updates.entityName) + " SET email = $1, emailverified = $2, updatedat = $3 WHERE uuid = $4 AND email = $5 AND deletedat IS NULL"
+		result, errUpdate := updates.conn().ExecContext(ctx, query, request.NewEmailAddress, true, time.Now().UTC(), account.GetUUID(), request.PreviousEmailAddress)
+		if errUpdate != nil {
+			if updates.db.dialect().IsUniqueViolation(errUpdate) {
+				return definition.EmailTaken
+			}
+			return errUpdate
+		}
+		errAffected := requireAffected(result, definition.RequestNotFound)
+		if errAffected != nil {
+			return errAffected
+		}
+		errDelete := updates.DeleteRequestContext(ctx, request)
+		if errDelete != nil {
+			return errDelete
+		}
+		return invalidateAccount(ctx, updates.tx, updates.cache, *account, AccountChanged)
+	})
+	if errApply != nil {
+		return errApply
+	}
+
+	account.SetEmail(request.NewEmailAddress)
+	account.VerifyEmail()
 	return nil
 }
 
-func NewUpdateEmailManagerSQL(db *sql.DB, entityName string) *UpdateEmailManagerSQL {
+func NewUpdateEmailManagerSQL(db *sql.DB, redis redis.UniversalClient, entityName string) *UpdateEmailManagerSQL {
 	return &UpdateEmailManagerSQL{
-		db:         db,
+		cache:      newAccountCache(redis, entityName),
+		db:         newSQLDB(db),
 		entityName: entityName,
 	}
 }
@@ -0,0 +1,237 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"github.com/lefalya/commonuser/definition"
+	"github.com/lefalya/pageflow"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+type EmailVerificationRequestSQL struct {
+	*pageflow.SQLItem `bson:",inline" json:",inline"`
+	AccountUUID       string    `db:"accountuuid"`
+	Email             string    `db:"email"`
+	Token             string    `db:"token"`
+	ExpiredAt         time.Time `db:"expiredat"`
+}
+
+func (ev *EmailVerificationRequestSQL) SetAccountUUID(account *AccountSQL) {
+	ev.AccountUUID = account.GetUUID()
+}
+
+func (ev *EmailVerificationRequestSQL) SetEmail(email string) {
+	ev.Email = email
+}
+
+func (ev *EmailVerificationRequestSQL) SetToken() {
+	ev.Token = pageflow.RandId()
+}
+
+func (ev *EmailVerificationRequestSQL) SetExpiredAt() {
+	ev.ExpiredAt = time.Now().UTC().Add(time.Hour * 48)
+}
+
+func (ev *EmailVerificationRequestSQL) Validate(token string) error {
+	time := time.Now().UTC()
+	if time.After(ev.ExpiredAt) {
+		return definition.RequestExpired
+	}
+	if ev.Token != token {
+		return definition.InvalidToken
+	}
+	return nil
+}
+
+func NewEmailVerificationRequestSQL() *EmailVerificationRequestSQL {
+	request := &EmailVerificationRequestSQL{}
+	pageflow.InitSQLItem(request)
+	return request
+}
+
+type EmailVerificationManagerSQL struct {
+	db         *sqlDB
+	entityName string
+	notifier   Notifier
+	cache      *accountCache
+	tx         *Tx
+}
+
+func (ev *EmailVerificationManagerSQL) SetNotifier(notifier Notifier) {
+	ev.notifier = notifier
+}
+
+// SetInvalidationBus broadcasts the manager's cache invalidations.
+func (ev *EmailVerificationManagerSQL) SetInvalidationBus(bus *InvalidationBus) {
+	ev.cache.bus = bus
+}
+
+// WithTx returns a copy of the manager that works inside tx. Its notifications
+// wait for the commit.
+func (ev *EmailVerificationManagerSQL) WithTx(tx *Tx) *EmailVerificationManagerSQL {
+	bound := *ev
+	bound.tx = tx
+	return &bound
+}
+
+func (ev *EmailVerificationManagerSQL) conn() sqlConn {
+	if ev.tx != nil {
+		return ev.tx
+	}
+	return ev.db
+}
+
+func (ev *EmailVerificationManagerSQL) tableName() string {
+	return ev.db.table(ev.entityName + "EmailVerification")
+}
+
+// CreateRequest replaces any pending verification of the account and hands the
+// new token to the notifier as Data["token"].
+func (ev *EmailVerificationManagerSQL) CreateRequest(account *AccountSQL) (*EmailVerificationRequestSQL, error) {
+	return ev.CreateRequestContext(context.Background(), account)
+}
+
+func (ev *EmailVerificationManagerSQL) CreateRequestContext(ctx context.Context, account *AccountSQL) (*EmailVerificationRequestSQL, error) {
+	request := NewEmailVerificationRequestSQL()
+	request.SetAccountUUID(account)
+	request.SetEmail(account.Email)
+	request.SetToken()
+	request.SetExpiredAt()
+
+	_, errDelete := ev.conn().ExecContext(ctx, "DELETE FROM "+ev.tableName()+" WHERE accountuuid = $1", request.AccountUUID)
+	if errDelete != nil {
+		return nil, errDelete
+	}
+
+	query := "INSERT INTO " + ev.tableName() + " (uuid, randId, createdat, updatedat, accountuuid, email, token, expiredat) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+	_, errInsert := ev.conn().ExecContext(
+		ctx,
+		query,
+		request.GetUUID(),
+		request.GetRandId(),
+		request.GetCreatedAt(),
+		request.GetUpdatedAt(),
+		request.AccountUUID,
+		request.Email,
+		request.Token,
+		request.ExpiredAt)
+	if errInsert != nil {
+		return nil, errInsert
+	}
+
+	if ev.notifier != nil {
+		errNotify := afterCommit(ev.tx, func() error {
+			return notify(ctx, ev.notifier, Notification{
+				Event:   NotificationVerifyEmail,
+				Account: account,
+				Data:    map[string]string{"token": request.Token},
+			})
+		})
+		if errNotify != nil {
+			return nil, errNotify
+		}
+	}
+
+	return request, nil
+}
+
+func (ev *EmailVerificationManagerSQL) FindRequest(account *AccountSQL) (*EmailVerificationRequestSQL, error) {
+	return ev.FindRequestContext(context.Background(), account)
+}
+
+func (ev *EmailVerificationManagerSQL) FindRequestContext(ctx context.Context, account *AccountSQL) (*EmailVerificationRequestSQL, error) {
+	query := "SELECT uuid, randId, createdat, updatedat, accountuuid, email, token, expiredat FROM " + ev.tableName() + " WHERE accountuuid = $1"
+	row := ev.conn().QueryRowContext(ctx, query, account.GetUUID())
+	request := NewEmailVerificationRequestSQL()
+	err := row.Scan(
+		&request.SQLItem.UUID,
+		&request.SQLItem.RandId,
+		&request.SQLItem.CreatedAt,
+		&request.SQLItem.UpdatedAt,
+		&request.AccountUUID,
+		&request.Email,
+		&request.Token,
+		&request.ExpiredAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return request, nil
+}
+
+// Verify marks the account's email as verified, provided the token matches and
+// the email has not changed since the request was created.
+func (ev *EmailVerificationManagerSQL) Verify(account *AccountSQL, token string) error {
+	return ev.VerifyContext(context.Background(), account, token)
+}
+
+func (ev *EmailVerificationManagerSQL) VerifyContext(ctx context.Context, account *AccountSQL, token string) error {
+	request, errFind := ev.FindRequestContext(ctx, account)
+	if errFind != nil {
+		return errFind
+	}
+	if request == nil || request.Email != account.Email {
+		return definition.RequestNotFound
+	}
+
+	errValidate := request.Validate(token)
+	if errValidate != nil {
+		if errValidate == definition.RequestExpired {
+			ev.DeleteRequestContext(ctx, request)
+		}
+		return errValidate
+	}
+
+	errVerify := ev.inTx(ctx, func(verifications *EmailVerificationManagerSQL) error {
+		query := "UPDATE " + verifications.db.table(verifications.entityName) + " SET emailverified = $1, updatedat = $2 WHERE uuid = $3 AND email = $4"
+		_, errUpdate := verifications.conn().ExecContext(ctx, query, true, time.Now().UTC(), account.GetUUID(), request.Email)
+		if errUpdate != nil {
+			return errUpdate
+		}
+		errDelete := verifications.DeleteRequestContext(ctx, request)
+		if errDelete != nil {
+			return errDelete
+		}
+		return invalidateAccount(ctx, verifications.tx, verifications.cache, *account, AccountChanged)
+	})
+	if errVerify != nil {
+		return errVerify
+	}
+
+	account.VerifyEmail()
+	return nil
+}
+
+func (ev *EmailVerificationManagerSQL) inTx(ctx context.Context, fn func(verifications *EmailVerificationManagerSQL) error) error {
+	if ev.tx != nil {
+		return fn(ev)
+	}
+	return RunInTx(ctx, ev.db.DB, func(tx *Tx) error {
+		return fn(ev.WithTx(tx))
+	})
+}
+
+func (ev *EmailVerificationManagerSQL) DeleteRequest(request *EmailVerificationRequestSQL) error {
+	return ev.DeleteRequestContext(context.Background(), request)
+}
+
+func (ev *EmailVerificationManagerSQL) DeleteRequestContext(ctx context.Context, request *EmailVerificationRequestSQL) error {
+	query := "DELETE FROM " + ev.tableName() + " WHERE uuid = $1"
+	_, errDelete := ev.conn().ExecContext(ctx, query, request.GetUUID())
+	if errDelete != nil {
+		return errDelete
+	}
+	return nil
+}
+
+func NewEmailVerificationManagerSQL(db *sql.DB, redis redis.UniversalClient, entityName string) *EmailVerificationManagerSQL {
+	return &EmailVerificationManagerSQL{
+		cache:      newAccountCache(redis, entityName),
+		db:         newSQLDB(db),
+		entityName: entityName,
+	}
+}
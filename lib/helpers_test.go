@@ -0,0 +1,242 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql"
+	"github.com/lefalya/pageflow"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testEntityName = "test"
+
+// newTestDB opens a migrated SQLite database that lives as long as the test.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, errOpen := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_busy_timeout=5000")
+	if errOpen != nil {
+		t.Fatal(errOpen)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, errMigrate := NewMigrator(db, testEntityName).Up()
+	if errMigrate != nil {
+		t.Fatal(errMigrate)
+	}
+	return db
+}
+
+// fakeRedis answers the handful of commands the provider and the session
+// manager send, so that their tests run in-process without a Redis server.
+type fakeRedis struct {
+	mutex  sync.Mutex
+	values map[string]string
+	sets   map[string]map[string]float64
+}
+
+func newFakeRedis() redis.UniversalClient {
+	fake := &fakeRedis{values: map[string]string{}, sets: map[string]map[string]float64{}}
+	return redis.NewClient(&redis.Options{
+		Addr:             "fake",
+		Protocol:         2,
+		DisableIndentity: true,
+		Dialer: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go fake.serve(server)
+			return client, nil
+		},
+	})
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	// commands between MULTI and EXEC are queued and run under one lock
+	var queued [][]string
+	inMulti := false
+	for {
+		args, errRead := readCommand(reader)
+		if errRead != nil {
+			return
+		}
+
+		var reply string
+		switch {
+		case strings.EqualFold(args[0], "multi"):
+			inMulti = true
+			reply = "+OK\r\n"
+		case strings.EqualFold(args[0], "exec"):
+			fr.mutex.Lock()
+			reply = "*" + strconv.Itoa(len(queued)) + "\r\n"
+			for _, command := range queued {
+				reply += fr.execute(command)
+			}
+			fr.mutex.Unlock()
+			queued, inMulti = nil, false
+		case inMulti:
+			queued = append(queued, args)
+			reply = "+QUEUED\r\n"
+		default:
+			fr.mutex.Lock()
+			reply = fr.execute(args)
+			fr.mutex.Unlock()
+		}
+		_, errWrite := conn.Write([]byte(reply))
+		if errWrite != nil {
+			return
+		}
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	header, errHeader := reader.ReadString('\n')
+	if errHeader != nil {
+		return nil, errHeader
+	}
+	count, errCount := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(header, "*")))
+	if errCount != nil {
+		return nil, errCount
+	}
+
+	args := make([]string, count)
+	for i := range args {
+		length, errLength := reader.ReadString('\n')
+		if errLength != nil {
+			return nil, errLength
+		}
+		size, errSize := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(length, "$")))
+		if errSize != nil {
+			return nil, errSize
+		}
+		value := make([]byte, size+2)
+		_, errValue := io.ReadFull(reader, value)
+		if errValue != nil {
+			return nil, errValue
+		}
+		args[i] = string(value[:size])
+	}
+	return args, nil
+}
+
+// execute runs one command; the caller holds the mutex.
+func (fr *fakeRedis) execute(args []string) string {
+	switch strings.ToLower(args[0]) {
+	case "set":
+		_, found := fr.values[args[1]]
+		for _, option := range args[3:] {
+			if (strings.EqualFold(option, "nx") && found) || (strings.EqualFold(option, "xx") && !found) {
+				return "$-1\r\n"
+			}
+		}
+		fr.values[args[1]] = args[2]
+		return "+OK\r\n"
+	case "get", "getdel":
+		value, found := fr.values[args[1]]
+		if !found {
+			return "$-1\r\n"
+		}
+		if strings.ToLower(args[0]) == "getdel" {
+			delete(fr.values, args[1])
+		}
+		return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+	case "exists", "del":
+		count := 0
+		for _, key := range args[1:] {
+			_, found := fr.values[key]
+			_, foundSet := fr.sets[key]
+			if found || foundSet {
+				count++
+				if strings.ToLower(args[0]) == "del" {
+					delete(fr.values, key)
+					delete(fr.sets, key)
+				}
+			}
+		}
+		return ":" + strconv.Itoa(count) + "\r\n"
+	case "zadd":
+		if fr.sets[args[1]] == nil {
+			fr.sets[args[1]] = map[string]float64{}
+		}
+		score, _ := strconv.ParseFloat(args[2], 64)
+		_, found := fr.sets[args[1]][args[3]]
+		fr.sets[args[1]][args[3]] = score
+		if found {
+			return ":0\r\n"
+		}
+		return ":1\r\n"
+	case "zrem":
+		count := 0
+		for _, member := range args[2:] {
+			if _, found := fr.sets[args[1]][member]; found {
+				delete(fr.sets[args[1]], member)
+				count++
+			}
+		}
+		return ":" + strconv.Itoa(count) + "\r\n"
+	case "zrange":
+		members := make([]string, 0, len(fr.sets[args[1]]))
+		for member := range fr.sets[args[1]] {
+			members = append(members, member)
+		}
+		sort.Slice(members, func(i, j int) bool {
+			return fr.sets[args[1]][members[i]] < fr.sets[args[1]][members[j]]
+		})
+		reply := "*" + strconv.Itoa(len(members)) + "\r\n"
+		for _, member := range members {
+			reply += "$" + strconv.Itoa(len(member)) + "\r\n" + member + "\r\n"
+		}
+		return reply
+	case "expire":
+		return ":1\r\n"
+	case "incr":
+		value, _ := strconv.Atoi(fr.values[args[1]])
+		fr.values[args[1]] = strconv.Itoa(value + 1)
+		return ":" + fr.values[args[1]] + "\r\n"
+	case "ttl":
+		return ":60\r\n"
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func newTestOAuthProvider(t *testing.T) *OAuthProvider {
+	t.Helper()
+	return newTestOAuthProviderWith(t, newFakeRedis(), nil, nil, OAuthProviderConfig{})
+}
+
+// newTestOAuthProviderWith fills in the issuer and a fresh signing key.
+func newTestOAuthProviderWith(t *testing.T, redis redis.UniversalClient, clients *OAuthClientManagerSQL, accountManager *AccountManagerSQL, config OAuthProviderConfig) *OAuthProvider {
+	t.Helper()
+	signingKey, errKey := rsa.GenerateKey(rand.Reader, 2048)
+	if errKey != nil {
+		t.Fatal(errKey)
+	}
+	config.Issuer = "https://auth.example.com/"
+	config.SigningKey = signingKey
+	provider, errProvider := NewOAuthProvider(redis, testEntityName, clients, accountManager, NewJWTHandler("secret", "issuer", 1), config)
+	if errProvider != nil {
+		t.Fatal(errProvider)
+	}
+	return provider
+}
+
+func newTestAccount() *AccountSQL {
+	return &AccountSQL{
+		SQLItem: &pageflow.SQLItem{UUID: "4c4a1d6e-5e1a-4f4b-9d61-1b0c3a3f2f10"},
+		Base: &Base{
+			Name:     "Ada Lovelace",
+			Username: "ada",
+			Email:    "ada@example.com",
+		},
+	}
+}
@@ -0,0 +1,125 @@
+package lib
+
+import "context"
+
+const (
+	NotificationPasswordChanged = "password_changed"
+	NotificationVerifyEmail     = "verify_email"
+
+	NotificationOrganizationInvitation = "organization_invitation"
+)
+
+type Notification struct {
+	Event   string
+	Account *AccountSQL
+	Data    map[string]string
+}
+
+// Notifier delivers account events (emails, push, audit log...) on behalf of the managers.
+type Notifier interface {
+	Notify(notification Notification) error
+}
+
+// SessionRevoker invalidates every session an account holds, e.g. after its password changed.
+type SessionRevoker interface {
+	RevokeAllSessions(account *AccountSQL) error
+}
+
+// LoginThrottler is consulted by Authenticate before and after every password check.
+type LoginThrottler interface {
+	Check(identifier string) error
+	RecordFailure(identifier string) error
+	RecordSuccess(identifier string) error
+}
+
+// MFAProvider tells Authenticate whether an account must pass a second factor.
+type MFAProvider interface {
+	IsEnrolled(account *AccountSQL) (bool, error)
+}
+
+// The Context interfaces below are optional. A hook implementing one receives the
+// caller's context instead of having the plain method called.
+
+type ContextNotifier interface {
+	NotifyContext(ctx context.Context, notification Notification) error
+}
+
+type ContextSessionRevoker interface {
+	RevokeAllSessionsContext(ctx context.Context, account *AccountSQL) error
+}
+
+// OtherSessionsRevoker lets a SessionRevoker keep the session that made a change,
+// e.g. the device that changed the password, while revoking the rest.
+type OtherSessionsRevoker interface {
+	RevokeOthers(account *AccountSQL, currentSessionId string) error
+}
+
+type ContextOtherSessionsRevoker interface {
+	RevokeOthersContext(ctx context.Context, account *AccountSQL, currentSessionId string) error
+}
+
+type ContextLoginThrottler interface {
+	CheckContext(ctx context.Context, identifier string) error
+	RecordFailureContext(ctx context.Context, identifier string) error
+	RecordSuccessContext(ctx context.Context, identifier string) error
+}
+
+type ContextMFAProvider interface {
+	IsEnrolledContext(ctx context.Context, account *AccountSQL) (bool, error)
+}
+
+func notify(ctx context.Context, notifier Notifier, notification Notification) error {
+	if contextNotifier, ok := notifier.(ContextNotifier); ok {
+		return contextNotifier.NotifyContext(ctx, notification)
+	}
+	return notifier.Notify(notification)
+}
+
+func revokeAllSessions(ctx context.Context, revoker SessionRevoker, account *AccountSQL) error {
+	if contextRevoker, ok := revoker.(ContextSessionRevoker); ok {
+		return contextRevoker.RevokeAllSessionsContext(ctx, account)
+	}
+	return revoker.RevokeAllSessions(account)
+}
+
+// revokeOtherSessions keeps currentSessionId when the revoker can tell sessions
+// apart and revokes every session otherwise.
+func revokeOtherSessions(ctx context.Context, revoker SessionRevoker, account *AccountSQL, currentSessionId string) error {
+	if currentSessionId != "" {
+		if contextRevoker, ok := revoker.(ContextOtherSessionsRevoker); ok {
+			return contextRevoker.RevokeOthersContext(ctx, account, currentSessionId)
+		}
+		if othersRevoker, ok := revoker.(OtherSessionsRevoker); ok {
+			return othersRevoker.RevokeOthers(account, currentSessionId)
+		}
+	}
+	return revokeAllSessions(ctx, revoker, account)
+}
+
+func checkThrottle(ctx context.Context, throttler LoginThrottler, identifier string) error {
+	if contextThrottler, ok := throttler.(ContextLoginThrottler); ok {
+		return contextThrottler.CheckContext(ctx, identifier)
+	}
+	return throttler.Check(identifier)
+}
+
+func recordLoginFailure(ctx context.Context, throttler LoginThrottler, identifier string) error {
+	if contextThrottler, ok := throttler.(ContextLoginThrottler); ok {
+		return contextThrottler.RecordFailureContext(ctx, identifier)
+	}
+	return throttler.RecordFailure(identifier)
+}
+
+func recordLoginSuccess(ctx context.Context, throttler LoginThrottler, identifier string) error {
+	if contextThrottler, ok := throttler.(ContextLoginThrottler); ok {
+		return contextThrottler.RecordSuccessContext(ctx, identifier)
+	}
+	return throttler.RecordSuccess(identifier)
+}
+
+func isMFAEnrolled(ctx context.Context, provider MFAProvider, account *AccountSQL) (bool, error) {
+	if contextProvider, ok := provider.(ContextMFAProvider); ok {
+		return contextProvider.IsEnrolledContext(ctx, account)
+	}
+	return provider.IsEnrolled(account)
+}
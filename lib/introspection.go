@@ -0,0 +1,403 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/lefalya/commonuser/definition"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"time"
+)
+
+const (
+	TokenTypeAccessToken  = "access_token"
+	TokenTypeRefreshToken = "refresh_token"
+)
+
+// IntrospectionResponse follows RFC 7662 section 2.2. Inactive tokens only carry
+// Active, whatever the reason.
+type IntrospectionResponse struct {
+	Active    bool     `json:"active"`
+	TokenType string   `json:"token_type,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	ClientId  string   `json:"client_id,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	Audience  []string `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	Id        string   `json:"jti,omitempty"`
+}
+
+// SetSessionManager makes introspection reject tokens of revoked sessions and
+// lets revocation end the session behind a login refresh token.
+func (op *OAuthProvider) SetSessionManager(sessionManager *SessionManager) {
+	op.sessionManager = sessionManager
+}
+
+// SetAPIKeyManager lets introspection and revocation understand API keys.
+func (op *OAuthProvider) SetAPIKeyManager(apiKeyManager *APIKeyManagerSQL) {
+	op.apiKeyManager = apiKeyManager
+}
+
+// access tokens are stateless JWTs, so revoking one means remembering its hash
+// until it would have expired anyway
+func (op *OAuthProvider) revokedAccessTokenKey(accessToken string) string {
+	return op.entityName + ":oauth:revoked:" + hashAPIKey(accessToken)
+}
+
+// parseIssuedAccessToken accepts both login and OAuth access tokens, which
+// introspection and revocation deal with alike.
+func (op *OAuthProvider) parseIssuedAccessToken(accessToken string) (*UserClaims, error) {
+	claims, errParse := op.jwtHandler.ParseAccessToken(accessToken)
+	if errParse != nil {
+		return op.jwtHandler.ParseOAuthAccessToken(accessToken)
+	}
+	return claims, nil
+}
+
+func (op *OAuthProvider) isAccessTokenRevoked(ctx context.Context, accessToken string) (bool, error) {
+	revoked, errExists := op.redis.Exists(ctx, op.revokedAccessTokenKey(accessToken)).Result()
+	if errExists != nil {
+		return false, errExists
+	}
+	return revoked > 0, nil
+}
+
+// ParseAccessToken is JWTHandler.ParseOAuthAccessToken that also refuses the
+// access tokens revoked through Revoke, so resource servers should verify
+// bearer tokens with the provider rather than with the bare JWTHandler.
+func (op *OAuthProvider) ParseAccessToken(accessToken string) (*UserClaims, error) {
+	claims, errParse := op.jwtHandler.ParseOAuthAccessToken(accessToken)
+	if errParse != nil {
+		return nil, errParse
+	}
+	revoked, errRevoked := op.isAccessTokenRevoked(context.Background(), accessToken)
+	if errRevoked != nil {
+		return nil, errRevoked
+	}
+	if revoked {
+		return nil, definition.Unauthorized
+	}
+	return claims, nil
+}
+
+// Introspect reports whether token is an active access token, refresh token or
+// API key. Every kind is recognised on its own, so the RFC 7662 token_type_hint
+// is not needed.
+func (op *OAuthProvider) Introspect(token string) (*IntrospectionResponse, error) {
+	introspectors := []func(string) (*IntrospectionResponse, error){
+		op.introspectOAuthRefreshToken,
+		op.introspectAccessToken,
+		op.introspectRefreshToken,
+	}
+	for _, introspect := range introspectors {
+		response, err := introspect(token)
+		if err != nil {
+			return nil, err
+		}
+		if response != nil {
+			return response, nil
+		}
+	}
+	return &IntrospectionResponse{Active: false}, nil
+}
+
+// introspectAccessToken returns nil when token is not an access token at all.
+func (op *OAuthProvider) introspectAccessToken(token string) (*IntrospectionResponse, error) {
+	if op.apiKeyManager != nil && op.apiKeyManager.IsAPIKey(token) {
+		claims, errParse := op.apiKeyManager.ParseAccessToken(token)
+		if errParse != nil {
+			if errors.Is(errParse, definition.Unauthorized) {
+				return &IntrospectionResponse{Active: false}, nil
+			}
+			return nil, errParse
+		}
+		return introspectionFromClaims(claims, TokenTypeAccessToken), nil
+	}
+
+	claims, errParse := op.parseIssuedAccessToken(token)
+	if errParse != nil {
+		return nil, nil
+	}
+
+	revoked, errRevoked := op.isAccessTokenRevoked(context.Background(), token)
+	if errRevoked != nil {
+		return nil, errRevoked
+	}
+	if revoked {
+		return &IntrospectionResponse{Active: false}, nil
+	}
+
+	active, errActive := op.isAccountActive(claims.UUID, claims.SessionId)
+	if errActive != nil {
+		return nil, errActive
+	}
+	if !active {
+		return &IntrospectionResponse{Active: false}, nil
+	}
+	return introspectionFromClaims(claims, TokenTypeAccessToken), nil
+}
+
+// introspectOAuthRefreshToken returns nil unless token is a refresh token
+// issued by the token endpoint.
+func (op *OAuthProvider) introspectOAuthRefreshToken(token string) (*IntrospectionResponse, error) {
+	grant, ttl, errFind := op.findRefreshToken(context.Background(), token)
+	if errFind != nil {
+		return nil, errFind
+	}
+	if grant == nil {
+		return nil, nil
+	}
+
+	active, errActive := op.isAccountActive(grant.AccountUUID, "")
+	if errActive != nil {
+		return nil, errActive
+	}
+	if !active {
+		return &IntrospectionResponse{Active: false}, nil
+	}
+	return &IntrospectionResponse{
+		Active:    true,
+		TokenType: TokenTypeRefreshToken,
+		Scope:     grant.Scope,
+		ClientId:  grant.ClientId,
+		Subject:   grant.AccountUUID,
+		Issuer:    op.config.Issuer,
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+	}, nil
+}
+
+// introspectRefreshToken returns nil unless token is a login refresh token.
+func (op *OAuthProvider) introspectRefreshToken(token string) (*IntrospectionResponse, error) {
+	claims, errParse := op.jwtHandler.ParseRefreshToken(token)
+	if errParse != nil {
+		return nil, nil
+	}
+	active, errActive := op.isAccountActive(claims.UUID, claims.SessionId)
+	if errActive != nil {
+		return nil, errActive
+	}
+	if !active {
+		return &IntrospectionResponse{Active: false}, nil
+	}
+
+	response := &IntrospectionResponse{
+		Active:    true,
+		TokenType: TokenTypeRefreshToken,
+		Subject:   claims.UUID,
+		Issuer:    claims.Issuer,
+		Id:        claims.ID,
+	}
+	if claims.ExpiresAt != nil {
+		response.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		response.IssuedAt = claims.IssuedAt.Unix()
+	}
+	return response, nil
+}
+
+func (op *OAuthProvider) findRefreshToken(ctx context.Context, refreshToken string) (*oauthRefreshToken, time.Duration, error) {
+	key := op.refreshTokenKey(refreshToken)
+	payload, errGet := op.redis.Get(ctx, key).Bytes()
+	if errGet != nil {
+		if errors.Is(errGet, redis.Nil) {
+			return nil, 0, nil
+		}
+		return nil, 0, errGet
+	}
+	ttl, errTTL := op.redis.TTL(ctx, key).Result()
+	if errTTL != nil {
+		return nil, 0, errTTL
+	}
+
+	grant := &oauthRefreshToken{}
+	errUnmarshal := json.Unmarshal(payload, grant)
+	if errUnmarshal != nil {
+		return nil, 0, errUnmarshal
+	}
+	return grant, ttl, nil
+}
+
+// isAccountActive checks that the account still exists unsuspended and, when the
+// token belongs to a session, that the session is alive.
+func (op *OAuthProvider) isAccountActive(accountUUID string, sessionId string) (bool, error) {
+	account, errAccount := op.accountManager.FindByUUID(accountUUID)
+	if errAccount != nil {
+		return false, errAccount
+	}
+	if account == nil || account.IsSuspended() {
+		return false, nil
+	}
+
+	if op.sessionManager != nil && sessionId != "" {
+		_, errSession := op.sessionManager.validate(context.Background(), accountUUID, sessionId)
+		if errSession != nil {
+			if errors.Is(errSession, definition.SessionNotFound) {
+				return false, nil
+			}
+			return false, errSession
+		}
+	}
+	return true, nil
+}
+
+func introspectionFromClaims(claims *UserClaims, tokenType string) *IntrospectionResponse {
+	response := &IntrospectionResponse{
+		Active:    true,
+		TokenType: tokenType,
+		Scope:     claims.Scope,
+		ClientId:  claims.ClientId,
+		Username:  claims.Username,
+		Subject:   claims.UUID,
+		Issuer:    claims.Issuer,
+		Audience:  claims.Audience,
+		Id:        claims.ID,
+	}
+	if claims.ExpiresAt != nil {
+		response.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		response.IssuedAt = claims.IssuedAt.Unix()
+	}
+	return response
+}
+
+// ownsToken tells whether client may revoke a token issued to tokenClientId.
+// Tokens not issued through OAuth, such as login tokens and API keys, may only
+// be revoked by first-party clients.
+func ownsToken(client *OAuthClientSQL, tokenClientId string) bool {
+	if tokenClientId == "" {
+		return client.FirstParty
+	}
+	return tokenClientId == client.ClientId
+}
+
+// Revoke invalidates any kind of token on behalf of client following RFC 7009,
+// recognising the kind without a token_type_hint. Unknown or
+// already invalid tokens are not an error. definition.Forbidden means the token
+// belongs to another client; definition.UnsupportedTokenType means the token
+// cannot be revoked, e.g. a login refresh token without a session. Access
+// tokens stay stateless JWTs: only OAuthProvider.ParseAccessToken, introspection
+// and the userinfo endpoint know they were revoked, a bare JWTHandler accepts
+// them until they expire.
+func (op *OAuthProvider) Revoke(client *OAuthClientSQL, token string) error {
+	ctx := context.Background()
+
+	grant, _, errFind := op.findRefreshToken(ctx, token)
+	if errFind != nil {
+		return errFind
+	}
+	if grant != nil {
+		if !ownsToken(client, grant.ClientId) {
+			return definition.Forbidden
+		}
+		return op.redis.Del(ctx, op.refreshTokenKey(token)).Err()
+	}
+
+	if op.apiKeyManager != nil && op.apiKeyManager.IsAPIKey(token) {
+		if !client.FirstParty {
+			return definition.Forbidden
+		}
+		errRevoke := op.apiKeyManager.RevokeByKey(token)
+		if errRevoke != nil && !errors.Is(errRevoke, definition.RequestNotFound) {
+			return errRevoke
+		}
+		return nil
+	}
+
+	claims, errParseAccess := op.parseIssuedAccessToken(token)
+	if errParseAccess == nil {
+		if !ownsToken(client, claims.ClientId) {
+			return definition.Forbidden
+		}
+		if claims.ExpiresAt == nil {
+			return definition.UnsupportedTokenType
+		}
+		// a token that expired meanwhile needs no entry, and a zero TTL would
+		// keep one forever
+		lifeSpan := time.Until(claims.ExpiresAt.Time)
+		if lifeSpan <= 0 {
+			return nil
+		}
+		return op.redis.Set(ctx, op.revokedAccessTokenKey(token), 1, lifeSpan).Err()
+	}
+
+	refreshClaims, errParse := op.jwtHandler.ParseRefreshToken(token)
+	if errParse != nil {
+		return nil
+	}
+	if !ownsToken(client, "") {
+		return definition.Forbidden
+	}
+	if op.sessionManager == nil || refreshClaims.SessionId == "" {
+		return definition.UnsupportedTokenType
+	}
+	account, errAccount := op.accountManager.FindByUUID(refreshClaims.UUID)
+	if errAccount != nil {
+		return errAccount
+	}
+	if account == nil {
+		return nil
+	}
+	errRevoke := op.sessionManager.Revoke(account, refreshClaims.SessionId)
+	if errRevoke != nil && !errors.Is(errRevoke, definition.SessionNotFound) {
+		return errRevoke
+	}
+	return nil
+}
+
+// IntrospectionHandler serves the RFC 7662 endpoint. Only confidential clients,
+// typically resource servers, may introspect.
+func (op *OAuthProvider) IntrospectionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeOAuthError(w, http.StatusMethodNotAllowed, OAuthInvalidRequest, "introspection endpoint only accepts POST")
+			return
+		}
+
+		clientId, clientSecret := clientCredentialsFromRequest(r)
+		client, errClient := op.clients.Authenticate(clientId, clientSecret)
+		if errClient == nil && client.Public {
+			errClient = definition.InvalidCredentials
+		}
+		if errClient != nil {
+			writeTokenError(w, errClient)
+			return
+		}
+
+		response, errIntrospect := op.Introspect(r.PostFormValue("token"))
+		if errIntrospect != nil {
+			writeTokenError(w, errIntrospect)
+			return
+		}
+		writeJSON(w, http.StatusOK, response)
+	})
+}
+
+// RevocationHandler serves the RFC 7009 endpoint.
+func (op *OAuthProvider) RevocationHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeOAuthError(w, http.StatusMethodNotAllowed, OAuthInvalidRequest, "revocation endpoint only accepts POST")
+			return
+		}
+
+		clientId, clientSecret := clientCredentialsFromRequest(r)
+		client, errClient := op.clients.Authenticate(clientId, clientSecret)
+		if errClient != nil {
+			writeTokenError(w, errClient)
+			return
+		}
+
+		errRevoke := op.Revoke(client, r.PostFormValue("token"))
+		if errRevoke != nil {
+			writeTokenError(w, errRevoke)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
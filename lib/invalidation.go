@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/redis/go-redis/v9"
+	"sync"
+)
+
+const (
+	AccountChanged = "account_changed"
+	AccountDeleted = "account_deleted"
+)
+
+type AccountEvent struct {
+	Event       string `json:"event"`
+	AccountUUID string `json:"accountUUID"`
+	// Origin is the instance that published the event.
+	Origin string `json:"origin"`
+}
+
+// InvalidationBus broadcasts account writes over Redis pub/sub so that every
+// instance can evict the copies it holds. Each instance runs Listen for as
+// long as it serves requests.
+type InvalidationBus struct {
+	redis      redis.UniversalClient
+	channel    string
+	instanceId string
+	mutex      sync.RWMutex
+	handlers   []func(ctx context.Context, event AccountEvent)
+}
+
+func (ib *InvalidationBus) InstanceId() string {
+	return ib.instanceId
+}
+
+// OnAccountEvent registers handler for every event received by Listen,
+// including the ones this instance published.
+func (ib *InvalidationBus) OnAccountEvent(handler func(ctx context.Context, event AccountEvent)) {
+	ib.mutex.Lock()
+	defer ib.mutex.Unlock()
+	ib.handlers = append(ib.handlers, handler)
+}
+
+func (ib *InvalidationBus) Publish(ctx context.Context, event string, accountUUID string) error {
+	payload, errMarshal := json.Marshal(AccountEvent{
+		Event:       event,
+		AccountUUID: accountUUID,
+		Origin:      ib.instanceId,
+	})
+	if errMarshal != nil {
+		return errMarshal
+	}
+	return ib.redis.Publish(ctx, ib.channel, payload).Err()
+}
+
+// Listen dispatches the published events to the handlers until ctx is done.
+// Events published while an instance is not listening are lost, which the
+// lifespan of the cached entries bounds.
+func (ib *InvalidationBus) Listen(ctx context.Context) error {
+	subscription := ib.redis.Subscribe(ctx, ib.channel)
+	defer subscription.Close()
+
+	// wait for the subscription to be confirmed before consuming messages
+	_, errReceive := subscription.Receive(ctx)
+	if errReceive != nil {
+		return errReceive
+	}
+
+	messages := subscription.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case message, open := <-messages:
+			if !open {
+				return nil
+			}
+			var event AccountEvent
+			errUnmarshal := json.Unmarshal([]byte(message.Payload), &event)
+			if errUnmarshal != nil {
+				continue
+			}
+			ib.dispatch(ctx, event)
+		}
+	}
+}
+
+func (ib *InvalidationBus) dispatch(ctx context.Context, event AccountEvent) {
+	ib.mutex.RLock()
+	handlers := ib.handlers
+	ib.mutex.RUnlock()
+	for _, handler := range handlers {
+		handler(ctx, event)
+	}
+}
+
+func NewInvalidationBus(redis redis.UniversalClient, entityName string) (*InvalidationBus, error) {
+	instanceId, errInstanceId := randomToken(8)
+	if errInstanceId != nil {
+		return nil, errInstanceId
+	}
+	return &InvalidationBus{
+		redis:      redis,
+		channel:    entityName + ":account:events",
+		instanceId: instanceId,
+	}, nil
+}
@@ -1,9 +1,12 @@
 package lib
 
 import (
+	"context"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/lefalya/commonuser/definition"
+	"net/http"
+	"strings"
 )
 
 type JWTHandler struct {
@@ -20,7 +23,6 @@ func (jh *JWTHandler) ParseJWT(jwtToken string, expectedStruct interface{ jwt.Cl
 		return []byte(jh.jwtSecret), nil
 	})
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 
@@ -31,22 +33,109 @@ func (jh *JWTHandler) ParseJWT(jwtToken string, expectedStruct interface{ jwt.Cl
 	}
 }
 
+// ParseAccessToken only accepts first-party login access tokens. Tokens issued
+// to OAuth clients go through ParseOAuthAccessToken.
 func (jh *JWTHandler) ParseAccessToken(jwtToken string) (*UserClaims, error) {
+	claims, err := jh.parseUserClaims(jwtToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.TokenUse != "" || claims.ClientId != "" {
+		return nil, definition.Unauthorized
+	}
+	return claims, nil
+}
+
+// ParseOAuthAccessToken only accepts access tokens issued to an OAuth client,
+// whose Scope tells what the client may do.
+func (jh *JWTHandler) ParseOAuthAccessToken(jwtToken string) (*UserClaims, error) {
+	claims, err := jh.parseUserClaims(jwtToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.TokenUse != tokenUseOAuthAccess || claims.ClientId == "" {
+		return nil, definition.Unauthorized
+	}
+	return claims, nil
+}
+
+func (jh *JWTHandler) parseUserClaims(jwtToken string) (*UserClaims, error) {
+	userClaims, err := jh.ParseJWT(jwtToken, &UserClaims{})
+	if err != nil {
+		return nil, err
+	}
+
+	claims := userClaims.(*UserClaims)
+	if isLimitedScope(claims.Scope) {
+		return nil, definition.Unauthorized
+	}
+	return claims, nil
+}
+
+// ParsePasswordChangeToken only accepts the limited-scope token issued when a
+// login requires a password change.
+func (jh *JWTHandler) ParsePasswordChangeToken(jwtToken string) (*UserClaims, error) {
+	return jh.parseLimitedToken(jwtToken, ScopePasswordChange)
+}
+
+// ParseMFAToken only accepts the limited-scope token issued when a login still
+// needs its second factor.
+func (jh *JWTHandler) ParseMFAToken(jwtToken string) (*UserClaims, error) {
+	return jh.parseLimitedToken(jwtToken, ScopeMFA)
+}
+
+func (jh *JWTHandler) parseLimitedToken(jwtToken string, scope string) (*UserClaims, error) {
 	userClaims, err := jh.ParseJWT(jwtToken, &UserClaims{})
 	if err != nil {
 		return nil, err
 	}
 
-	return userClaims.(*UserClaims), nil
+	claims := userClaims.(*UserClaims)
+	if claims.Scope != scope {
+		return nil, definition.Unauthorized
+	}
+	return claims, nil
 }
 
+// ParseRefreshToken only accepts first-party refresh tokens, never an access,
+// limited-scope or OAuth token signed with the same secret.
 func (jh *JWTHandler) ParseRefreshToken(jwtToken string) (*RefreshTokenClaims, error) {
 	refreshClaims, err := jh.ParseJWT(jwtToken, &RefreshTokenClaims{})
 	if err != nil {
 		return nil, err
 	}
 
-	return refreshClaims.(*RefreshTokenClaims), nil
+	claims := refreshClaims.(*RefreshTokenClaims)
+	if claims.TokenUse != tokenUseRefresh || claims.Scope != "" || claims.ClientId != "" {
+		return nil, definition.Unauthorized
+	}
+	return claims, nil
+}
+
+// Middleware authenticates "Authorization: Bearer" access tokens and stores the
+// claims for ClaimsFromContext.
+func (jh *JWTHandler) Middleware(next http.Handler) http.Handler {
+	return BearerMiddleware(jh, next)
+}
+
+// BearerMiddleware authenticates the "Authorization: Bearer" credential with
+// verifier, e.g. a JWTHandler, an APIKeyManagerSQL or AccessTokenVerifiers of both.
+func BearerMiddleware(verifier AccessTokenVerifier, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found {
+			http.Error(w, definition.Unauthorized.Error(), http.StatusUnauthorized)
+			return
+		}
+		claims, err := verifier.ParseAccessToken(bearer)
+		if err != nil {
+			http.Error(w, definition.Unauthorized.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims)))
+	})
 }
 
 func NewJWTHandler(jwtSecret string, jwtTokenIssuer string, jwtTokenLifeSpan int) *JWTHandler {
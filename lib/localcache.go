@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// localAccountCache is the in-process tier in front of the Redis account cache:
+// a least recently used set of account records, indexed like the Redis tier.
+type localAccountCache struct {
+	mutex    sync.Mutex
+	capacity int
+	lifeSpan time.Duration
+	order    *list.List
+	byUUID   map[string]*list.Element
+	// byIndex maps index + ":" + value to the uuid
+	byIndex map[string]string
+}
+
+type localAccountEntry struct {
+	record    accountRecord
+	expiredAt time.Time
+}
+
+func (lc *localAccountCache) Get(uuid string) *AccountSQL {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	element, found := lc.byUUID[uuid]
+	if !found {
+		return nil
+	}
+	entry := element.Value.(*localAccountEntry)
+	if time.Now().After(entry.expiredAt) {
+		lc.remove(element)
+		return nil
+	}
+	lc.order.MoveToFront(element)
+	return entry.record.account()
+}
+
+func (lc *localAccountCache) GetBy(index string, value string) *AccountSQL {
+	if index == accountIndexUUID {
+		return lc.Get(value)
+	}
+
+	lc.mutex.Lock()
+	uuid, found := lc.byIndex[index+":"+value]
+	lc.mutex.Unlock()
+	if !found {
+		return nil
+	}
+
+	account := lc.Get(uuid)
+	if account == nil || newAccountRecord(account).indexes()[index] != value {
+		return nil
+	}
+	return account
+}
+
+func (lc *localAccountCache) Set(account *AccountSQL) {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	if element, found := lc.byUUID[account.GetUUID()]; found {
+		lc.remove(element)
+	}
+
+	record := newAccountRecord(account)
+	element := lc.order.PushFront(&localAccountEntry{
+		record:    record,
+		expiredAt: time.Now().Add(lc.lifeSpan),
+	})
+	lc.byUUID[record.UUID] = element
+	for index, value := range record.indexes() {
+		lc.byIndex[index+":"+value] = record.UUID
+	}
+
+	for lc.order.Len() > lc.capacity {
+		lc.remove(lc.order.Back())
+	}
+}
+
+func (lc *localAccountCache) Evict(uuid string) {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	if element, found := lc.byUUID[uuid]; found {
+		lc.remove(element)
+	}
+}
+
+// remove expects the mutex to be held.
+func (lc *localAccountCache) remove(element *list.Element) {
+	entry := element.Value.(*localAccountEntry)
+	lc.order.Remove(element)
+	delete(lc.byUUID, entry.record.UUID)
+	for index, value := range entry.record.indexes() {
+		key := index + ":" + value
+		if lc.byIndex[key] == entry.record.UUID {
+			delete(lc.byIndex, key)
+		}
+	}
+}
+
+func newLocalAccountCache(capacity int, lifeSpan time.Duration) *localAccountCache {
+	return &localAccountCache{
+		capacity: capacity,
+		lifeSpan: lifeSpan,
+		order:    list.New(),
+		byUUID:   map[string]*list.Element{},
+		byIndex:  map[string]string{},
+	}
+}
@@ -0,0 +1,77 @@
+package lib
+
+import "time"
+
+const (
+	ScopePasswordChange = "password_change"
+	ScopeMFA            = "mfa"
+)
+
+const limitedTokenLifeSpan = 15 * time.Minute
+
+type LoginStatus string
+
+const (
+	LoginSuccess                LoginStatus = "success"
+	LoginMFARequired            LoginStatus = "mfa_required"
+	LoginPasswordChangeRequired LoginStatus = "password_change_required"
+)
+
+type LoginResult struct {
+	Status              LoginStatus `json:"status"`
+	AccessToken         string      `json:"accessToken,omitempty"`
+	RefreshToken        string      `json:"refreshToken,omitempty"`
+	MFAToken            string      `json:"mfaToken,omitempty"`
+	PasswordChangeToken string      `json:"passwordChangeToken,omitempty"`
+	Account             *AccountSQL `json:"-"`
+}
+
+// IssueLoginResult hands out a regular token pair, or only a short-lived
+// password_change scoped token when the account has to change its password first.
+func (jh *JWTHandler) IssueLoginResult(account *AccountSQL, passwordChangeRequired bool) (*LoginResult, error) {
+	if passwordChangeRequired {
+		passwordChangeToken, err := account.GenerateScopedAccessToken(jh.jwtSecret, jh.jwtTokenIssuer, ScopePasswordChange, limitedTokenLifeSpan)
+		if err != nil {
+			return nil, err
+		}
+		return &LoginResult{
+			Status:              LoginPasswordChangeRequired,
+			PasswordChangeToken: passwordChangeToken,
+			Account:             account,
+		}, nil
+	}
+
+	accessToken, err := account.GenerateAccessToken(jh.jwtSecret, jh.jwtTokenIssuer, jh.jwtTokenLifeSpan)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := account.GenerateRefreshToken(jh.jwtSecret, jh.jwtTokenIssuer, jh.jwtTokenLifeSpan)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{
+		Status:       LoginSuccess,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		Account:      account,
+	}, nil
+}
+
+// IssueMFAChallenge hands out only a short-lived mfa scoped token. Once the second
+// factor is verified the caller completes the login with
+// AccountManagerSQL.CompleteLogin.
+func (jh *JWTHandler) IssueMFAChallenge(account *AccountSQL) (*LoginResult, error) {
+	mfaToken, err := account.GenerateScopedAccessToken(jh.jwtSecret, jh.jwtTokenIssuer, ScopeMFA, limitedTokenLifeSpan)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{
+		Status:   LoginMFARequired,
+		MFAToken: mfaToken,
+		Account:  account,
+	}, nil
+}
+
+func isLimitedScope(scope string) bool {
+	return scope == ScopePasswordChange || scope == ScopeMFA
+}
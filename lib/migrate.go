@@ -0,0 +1,344 @@
+package lib
+
+import (
+	"bytes"
+	"database/sql"
+	"embed"
+	"fmt"
+	"github.com/lefalya/commonuser/definition"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is one step of the schema. Migration files are named
+// <version>_<name>.up.sql and <version>_<name>.down.sql, and reference the
+// tables through {{table "Suffix"}} and the indexes through {{indexName "Suffix"}}
+// so one database can hold several entities. {{tableName "Suffix"}} is the
+// unquoted table name, for comparisons against the information schema.
+type Migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+// migrationData is what the migration templates see. IfExists and IfNotExists
+// are only set where ALTER TABLE accepts them on columns.
+type migrationData struct {
+	Entity           string
+	Dialect          string
+	Timestamp        string
+	CurrentTimestamp string
+	IfExists         string
+	IfNotExists      string
+}
+
+func newMigrationData(dialect Dialect, entityName string) migrationData {
+	data := migrationData{
+		Entity:           entityName,
+		Dialect:          dialect.Name(),
+		Timestamp:        dialect.TimestampType(),
+		CurrentTimestamp: dialect.CurrentTimestamp(),
+	}
+	if dialect.SupportsIfExists() {
+		data.IfExists = "IF EXISTS "
+		data.IfNotExists = "IF NOT EXISTS "
+	}
+	return data
+}
+
+// Migrations lists every embedded migration, oldest first.
+func Migrations() ([]Migration, error) {
+	entries, errRead := fs.ReadDir(migrationFiles, "migrations")
+	if errRead != nil {
+		return nil, errRead
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		fileName := entry.Name()
+		base, direction, found := strings.Cut(strings.TrimSuffix(fileName, ".sql"), ".")
+		if !found {
+			return nil, fmt.Errorf("migration %s lacks an up or down suffix", fileName)
+		}
+		versionPart, name, _ := strings.Cut(base, "_")
+		version, errVersion := strconv.Atoi(versionPart)
+		if errVersion != nil {
+			return nil, fmt.Errorf("migration %s lacks a numeric version", fileName)
+		}
+
+		content, errContent := migrationFiles.ReadFile(path.Join("migrations", fileName))
+		if errContent != nil {
+			return nil, errContent
+		}
+
+		migration, exist := byVersion[version]
+		if !exist {
+			migration = &Migration{Version: version, Name: name}
+			byVersion[version] = migration
+		}
+		switch direction {
+		case "up":
+			migration.up = string(content)
+		case "down":
+			migration.down = string(content)
+		default:
+			return nil, fmt.Errorf("migration %s lacks an up or down suffix", fileName)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Statements renders the up or down script of the migration for entityName in
+// dialect.
+func (m Migration) Statements(dialect Dialect, entityName string, up bool) ([]string, error) {
+	script := m.down
+	if up {
+		script = m.up
+	}
+
+	functions := template.FuncMap{
+		"table": func(suffix string) string {
+			return dialect.QuoteIdentifier(entityName + suffix)
+		},
+		"tableName": func(suffix string) string {
+			return entityName + suffix
+		},
+		"indexName": func(suffix string) string {
+			return dialect.QuoteIdentifier(entityName + suffix + "Index")
+		},
+	}
+	parsed, errParse := template.New(m.Name).Funcs(functions).Parse(script)
+	if errParse != nil {
+		return nil, errParse
+	}
+	var rendered bytes.Buffer
+	errExecute := parsed.Execute(&rendered, newMigrationData(dialect, entityName))
+	if errExecute != nil {
+		return nil, errExecute
+	}
+
+	var statements []string
+	for _, statement := range strings.Split(rendered.String(), ";") {
+		statement = strings.TrimSpace(statement)
+		if statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	return statements, nil
+}
+
+// Migrator applies the embedded migrations to the tables of one entity and
+// records the applied versions in <entity>SchemaMigration.
+type Migrator struct {
+	db         *sqlDB
+	entityName string
+	dryRun     io.Writer
+}
+
+func (mg *Migrator) tableName() string {
+	return mg.db.table(mg.entityName + "SchemaMigration")
+}
+
+// SetDryRun prints the statements Up and Down would execute to out instead of
+// running them. A nil out switches dry-run off.
+func (mg *Migrator) SetDryRun(out io.Writer) {
+	mg.dryRun = out
+}
+
+func (mg *Migrator) ensureVersionTable() error {
+	dialect := mg.db.dialect()
+	query := "CREATE TABLE IF NOT EXISTS " + mg.tableName() + " (version INTEGER PRIMARY KEY, name VARCHAR(255) NOT NULL, appliedat " + dialect.TimestampType() + " DEFAULT " + dialect.CurrentTimestamp() + ")"
+	_, errCreate := mg.db.Exec(query)
+	return errCreate
+}
+
+// CurrentVersion returns the newest applied version, 0 for a fresh database.
+func (mg *Migrator) CurrentVersion() (int, error) {
+	// a dry-run must not even create the version table
+	if mg.dryRun == nil {
+		errEnsure := mg.ensureVersionTable()
+		if errEnsure != nil {
+			return 0, errEnsure
+		}
+	}
+
+	version, errVersion := mg.appliedVersion()
+	if errVersion != nil {
+		if mg.dryRun != nil {
+			return 0, nil
+		}
+		return 0, errVersion
+	}
+	return version, nil
+}
+
+func (mg *Migrator) appliedVersion() (int, error) {
+	var version sql.NullInt64
+	errScan := mg.db.QueryRow("SELECT MAX(version) FROM " + mg.tableName()).Scan(&version)
+	if errScan != nil {
+		return 0, errScan
+	}
+	return int(version.Int64), nil
+}
+
+func LatestSchemaVersion() (int, error) {
+	migrations, errMigrations := Migrations()
+	if errMigrations != nil {
+		return 0, errMigrations
+	}
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// Up applies every pending migration and returns the ones applied.
+func (mg *Migrator) Up() ([]Migration, error) {
+	latest, errLatest := LatestSchemaVersion()
+	if errLatest != nil {
+		return nil, errLatest
+	}
+	return mg.UpTo(latest)
+}
+
+// UpTo applies the pending migrations up to and including version.
+func (mg *Migrator) UpTo(version int) ([]Migration, error) {
+	current, errCurrent := mg.CurrentVersion()
+	if errCurrent != nil {
+		return nil, errCurrent
+	}
+	migrations, errMigrations := Migrations()
+	if errMigrations != nil {
+		return nil, errMigrations
+	}
+
+	var applied []Migration
+	for _, migration := range migrations {
+		if migration.Version <= current || migration.Version > version {
+			continue
+		}
+		errApply := mg.apply(migration, true)
+		if errApply != nil {
+			return applied, fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, errApply)
+		}
+		applied = append(applied, migration)
+	}
+	return applied, nil
+}
+
+// Down reverts the newest steps applied migrations and returns the ones reverted.
+func (mg *Migrator) Down(steps int) ([]Migration, error) {
+	current, errCurrent := mg.CurrentVersion()
+	if errCurrent != nil {
+		return nil, errCurrent
+	}
+	migrations, errMigrations := Migrations()
+	if errMigrations != nil {
+		return nil, errMigrations
+	}
+
+	var reverted []Migration
+	for i := len(migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+		migration := migrations[i]
+		if migration.Version > current {
+			continue
+		}
+		errApply := mg.apply(migration, false)
+		if errApply != nil {
+			return reverted, fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, errApply)
+		}
+		reverted = append(reverted, migration)
+	}
+	return reverted, nil
+}
+
+// apply runs one migration together with its bookkeeping in a transaction.
+// MySQL commits DDL implicitly, so there a failed migration may be left half
+// applied.
+func (mg *Migrator) apply(migration Migration, up bool) error {
+	dialect := mg.db.dialect()
+	statements, errStatements := migration.Statements(dialect, mg.entityName, up)
+	if errStatements != nil {
+		return errStatements
+	}
+	if up {
+		statements = append(statements, "INSERT INTO "+mg.tableName()+" (version, name, appliedat) VALUES ("+strconv.Itoa(migration.Version)+", '"+migration.Name+"', "+dialect.CurrentTimestamp()+")")
+	} else {
+		statements = append(statements, "DELETE FROM "+mg.tableName()+" WHERE version = "+strconv.Itoa(migration.Version))
+	}
+
+	direction := "up"
+	if !up {
+		direction = "down"
+	}
+	return mg.execute(fmt.Sprintf("%d_%s (%s)", migration.Version, migration.Name, direction), statements)
+}
+
+// execute runs statements in a transaction, or prints them under label in
+// dry-run mode.
+func (mg *Migrator) execute(label string, statements []string) error {
+	if mg.dryRun != nil {
+		fmt.Fprintf(mg.dryRun, "-- %s\n", label)
+		for _, statement := range statements {
+			fmt.Fprintf(mg.dryRun, "%s;\n", statement)
+		}
+		return nil
+	}
+
+	tx, errBegin := mg.db.Begin()
+	if errBegin != nil {
+		return errBegin
+	}
+	for _, statement := range statements {
+		_, errExec := tx.Exec(statement)
+		if errExec != nil {
+			tx.Rollback()
+			return errExec
+		}
+	}
+	return tx.Commit()
+}
+
+// CheckSchema returns definition.SchemaOutdated while migrations are pending.
+// A schema newer than this library is accepted so that older instances keep
+// running during a rolling deploy. It only reads, so it also works with a
+// database user that may not run DDL; a missing version table counts as
+// outdated.
+func (mg *Migrator) CheckSchema() error {
+	current, errCurrent := mg.appliedVersion()
+	if errCurrent != nil {
+		return fmt.Errorf("%w: %s has no readable schema version: %w", definition.SchemaOutdated, mg.entityName, errCurrent)
+	}
+	latest, errLatest := LatestSchemaVersion()
+	if errLatest != nil {
+		return errLatest
+	}
+	if current < latest {
+		return fmt.Errorf("%w: %s is at version %d, expected %d", definition.SchemaOutdated, mg.entityName, current, latest)
+	}
+	return nil
+}
+
+func NewMigrator(db *sql.DB, entityName string) *Migrator {
+	return &Migrator{
+		db:         newSQLDB(db),
+		entityName: entityName,
+	}
+}
@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrationsRenderForEveryDialect(t *testing.T) {
+	migrations, errMigrations := Migrations()
+	if errMigrations != nil {
+		t.Fatal(errMigrations)
+	}
+	for _, dialect := range []Dialect{PostgreSQL, MySQL, SQLite} {
+		for _, migration := range migrations {
+			for _, up := range []bool{true, false} {
+				_, errStatements := migration.Statements(dialect, "account", up)
+				if errStatements != nil {
+					t.Errorf("%s %d_%s (up %t): %v", dialect.Name(), migration.Version, migration.Name, up, errStatements)
+				}
+			}
+		}
+	}
+}
+
+func TestSyncResetPasswordKeepsExistingColumns(t *testing.T) {
+	migrations, errMigrations := Migrations()
+	if errMigrations != nil {
+		t.Fatal(errMigrations)
+	}
+	for _, migration := range migrations {
+		if migration.Version != 2 {
+			continue
+		}
+		for _, dialect := range []Dialect{PostgreSQL, MySQL} {
+			statements, errStatements := migration.Statements(dialect, "account", true)
+			if errStatements != nil {
+				t.Fatal(errStatements)
+			}
+			for _, statement := range statements {
+				if strings.Contains(statement, "DROP COLUMN") {
+					t.Errorf("%s: %q drops data", dialect.Name(), statement)
+				}
+				if dialect == MySQL && strings.HasPrefix(statement, "ALTER TABLE") && strings.Contains(statement, "ADD COLUMN") {
+					t.Errorf("%s: %q fails when the column exists", dialect.Name(), statement)
+				}
+			}
+		}
+		return
+	}
+	t.Fatal("migration 2 not found")
+}
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS {{table "UpdateEmail"}};
+DROP TABLE IF EXISTS {{table "ResetPassword"}};
+DROP TABLE IF EXISTS {{table ""}};
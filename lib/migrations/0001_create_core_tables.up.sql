@@ -0,0 +1,32 @@
+CREATE TABLE IF NOT EXISTS {{table ""}} (
+	uuid VARCHAR(255) UNIQUE NOT NULL,
+	randId VARCHAR(255) UNIQUE,
+	createdat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	updatedat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	name VARCHAR(255),
+	username VARCHAR(255) UNIQUE,
+	password VARCHAR(255),
+	email VARCHAR(255) UNIQUE,
+	avatar VARCHAR(255),
+	suspended BOOLEAN DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS {{table "ResetPassword"}} (
+	email VARCHAR(255) UNIQUE NOT NULL,
+	uuid VARCHAR(255) UNIQUE,
+	accountuuid VARCHAR(255) UNIQUE,
+	createdat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	updatedat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	token VARCHAR(255) UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS {{table "UpdateEmail"}} (
+	uuid VARCHAR(255) UNIQUE NOT NULL,
+	randId VARCHAR(255) UNIQUE,
+	createdat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	updatedat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	accountuuid VARCHAR(255) UNIQUE,
+	previousemailaddress VARCHAR(255),
+	newemailaddress VARCHAR(255) UNIQUE,
+	resettoken VARCHAR(255)
+);
@@ -0,0 +1,16 @@
+{{if eq .Dialect "sqlite"}}
+CREATE TABLE {{table "ResetPasswordSync"}} (
+	email VARCHAR(255) UNIQUE,
+	uuid VARCHAR(255) UNIQUE,
+	accountuuid VARCHAR(255) UNIQUE,
+	createdat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	updatedat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	token VARCHAR(255) UNIQUE
+);
+INSERT INTO {{table "ResetPasswordSync"}} (email, uuid, accountuuid, createdat, updatedat, token) SELECT email, uuid, accountuuid, createdat, updatedat, token FROM {{table "ResetPassword"}};
+DROP TABLE {{table "ResetPassword"}};
+ALTER TABLE {{table "ResetPasswordSync"}} RENAME TO {{table "ResetPassword"}};
+{{else}}
+ALTER TABLE {{table "ResetPassword"}} DROP COLUMN {{.IfExists}}expiredat;
+ALTER TABLE {{table "ResetPassword"}} DROP COLUMN {{.IfExists}}randId;
+{{end}}
@@ -0,0 +1,29 @@
+{{if eq .Dialect "postgres"}}
+ALTER TABLE {{table "ResetPassword"}} ADD COLUMN IF NOT EXISTS randId VARCHAR(255) UNIQUE;
+ALTER TABLE {{table "ResetPassword"}} ADD COLUMN IF NOT EXISTS expiredat {{.Timestamp}};
+ALTER TABLE {{table "ResetPassword"}} ALTER COLUMN email DROP NOT NULL;
+{{else if eq .Dialect "mysql"}}
+SET @addColumn = (SELECT IF(COUNT(*) = 0, 'ALTER TABLE {{table "ResetPassword"}} ADD COLUMN randId VARCHAR(255) UNIQUE', 'SELECT 1') FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = '{{tableName "ResetPassword"}}' AND column_name = 'randId');
+PREPARE addColumn FROM @addColumn;
+EXECUTE addColumn;
+DEALLOCATE PREPARE addColumn;
+SET @addColumn = (SELECT IF(COUNT(*) = 0, 'ALTER TABLE {{table "ResetPassword"}} ADD COLUMN expiredat {{.Timestamp}}', 'SELECT 1') FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = '{{tableName "ResetPassword"}}' AND column_name = 'expiredat');
+PREPARE addColumn FROM @addColumn;
+EXECUTE addColumn;
+DEALLOCATE PREPARE addColumn;
+ALTER TABLE {{table "ResetPassword"}} MODIFY COLUMN email VARCHAR(255) NULL;
+{{else}}
+CREATE TABLE {{table "ResetPasswordSync"}} (
+	email VARCHAR(255) UNIQUE,
+	uuid VARCHAR(255) UNIQUE,
+	randId VARCHAR(255) UNIQUE,
+	accountuuid VARCHAR(255) UNIQUE,
+	createdat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	updatedat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	token VARCHAR(255) UNIQUE,
+	expiredat {{.Timestamp}}
+);
+INSERT INTO {{table "ResetPasswordSync"}} (email, uuid, accountuuid, createdat, updatedat, token) SELECT email, uuid, accountuuid, createdat, updatedat, token FROM {{table "ResetPassword"}};
+DROP TABLE {{table "ResetPassword"}};
+ALTER TABLE {{table "ResetPasswordSync"}} RENAME TO {{table "ResetPassword"}};
+{{end}}
@@ -0,0 +1,3 @@
+ALTER TABLE {{table "UpdateEmail"}} ADD COLUMN {{.IfNotExists}}resettoken VARCHAR(255);
+ALTER TABLE {{table "UpdateEmail"}} DROP COLUMN {{.IfExists}}expiredat;
+ALTER TABLE {{table "UpdateEmail"}} DROP COLUMN {{.IfExists}}updatetoken;
@@ -0,0 +1,3 @@
+ALTER TABLE {{table "UpdateEmail"}} ADD COLUMN {{.IfNotExists}}updatetoken VARCHAR(255);
+ALTER TABLE {{table "UpdateEmail"}} ADD COLUMN {{.IfNotExists}}expiredat {{.Timestamp}};
+ALTER TABLE {{table "UpdateEmail"}} DROP COLUMN {{.IfExists}}resettoken;
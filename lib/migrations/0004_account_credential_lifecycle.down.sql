@@ -0,0 +1,3 @@
+ALTER TABLE {{table ""}} DROP COLUMN {{.IfExists}}emailverified;
+ALTER TABLE {{table ""}} DROP COLUMN {{.IfExists}}mustchangepassword;
+ALTER TABLE {{table ""}} DROP COLUMN {{.IfExists}}passwordupdatedat;
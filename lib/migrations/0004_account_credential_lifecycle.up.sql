@@ -0,0 +1,3 @@
+ALTER TABLE {{table ""}} ADD COLUMN {{.IfNotExists}}passwordupdatedat {{.Timestamp}};
+ALTER TABLE {{table ""}} ADD COLUMN {{.IfNotExists}}mustchangepassword BOOLEAN DEFAULT FALSE;
+ALTER TABLE {{table ""}} ADD COLUMN {{.IfNotExists}}emailverified BOOLEAN DEFAULT FALSE;
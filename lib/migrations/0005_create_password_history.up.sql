@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS {{table "PasswordHistory"}} (
+	uuid VARCHAR(255) UNIQUE NOT NULL,
+	randId VARCHAR(255) UNIQUE,
+	createdat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	updatedat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	accountuuid VARCHAR(255) NOT NULL,
+	password VARCHAR(255) NOT NULL
+);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS {{table "EmailVerification"}} (
+	uuid VARCHAR(255) UNIQUE NOT NULL,
+	randId VARCHAR(255) UNIQUE,
+	createdat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	updatedat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	accountuuid VARCHAR(255) UNIQUE,
+	email VARCHAR(255),
+	token VARCHAR(255),
+	expiredat {{.Timestamp}}
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS {{table "AccountRole"}};
+DROP TABLE IF EXISTS {{table "RolePermission"}};
+DROP TABLE IF EXISTS {{table "Role"}};
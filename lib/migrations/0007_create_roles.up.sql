@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS {{table "Role"}} (
+	uuid VARCHAR(255) UNIQUE NOT NULL,
+	randId VARCHAR(255) UNIQUE,
+	createdat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	updatedat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	name VARCHAR(255) UNIQUE NOT NULL,
+	parent VARCHAR(255)
+);
+
+CREATE TABLE IF NOT EXISTS {{table "RolePermission"}} (
+	role VARCHAR(255) NOT NULL,
+	permission VARCHAR(255) NOT NULL,
+	UNIQUE (role, permission)
+);
+
+CREATE TABLE IF NOT EXISTS {{table "AccountRole"}} (
+	accountuuid VARCHAR(255) NOT NULL,
+	role VARCHAR(255) NOT NULL,
+	UNIQUE (accountuuid, role)
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS {{table "OrganizationInvitation"}};
+DROP TABLE IF EXISTS {{table "OrganizationMember"}};
+DROP TABLE IF EXISTS {{table "Organization"}};
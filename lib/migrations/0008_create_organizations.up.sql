@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS {{table "Organization"}} (
+	uuid VARCHAR(255) UNIQUE NOT NULL,
+	randId VARCHAR(255) UNIQUE,
+	createdat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	updatedat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	name VARCHAR(255) NOT NULL,
+	owneruuid VARCHAR(255) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS {{table "OrganizationMember"}} (
+	organizationuuid VARCHAR(255) NOT NULL,
+	accountuuid VARCHAR(255) NOT NULL,
+	role VARCHAR(255) NOT NULL,
+	createdat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	UNIQUE (organizationuuid, accountuuid)
+);
+
+CREATE TABLE IF NOT EXISTS {{table "OrganizationInvitation"}} (
+	uuid VARCHAR(255) UNIQUE NOT NULL,
+	randId VARCHAR(255) UNIQUE,
+	createdat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	updatedat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	organizationuuid VARCHAR(255) NOT NULL,
+	email VARCHAR(255) NOT NULL,
+	role VARCHAR(255) NOT NULL,
+	invitedby VARCHAR(255),
+	token VARCHAR(255),
+	expiredat {{.Timestamp}},
+	UNIQUE (organizationuuid, email)
+);
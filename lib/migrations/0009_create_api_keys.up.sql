@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS {{table "APIKey"}} (
+	uuid VARCHAR(255) UNIQUE NOT NULL,
+	randId VARCHAR(255) UNIQUE,
+	createdat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	updatedat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	accountuuid VARCHAR(255) NOT NULL,
+	name VARCHAR(255),
+	hint VARCHAR(255),
+	keyhash VARCHAR(255) UNIQUE NOT NULL,
+	scopes TEXT,
+	expiredat {{.Timestamp}} NULL,
+	lastusedat {{.Timestamp}} NULL,
+	revokedat {{.Timestamp}} NULL
+);
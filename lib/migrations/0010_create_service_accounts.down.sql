@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS {{table "ClientCredential"}};
+ALTER TABLE {{table ""}} DROP COLUMN {{.IfExists}}serviceaccount;
@@ -0,0 +1,13 @@
+ALTER TABLE {{table ""}} ADD COLUMN {{.IfNotExists}}serviceaccount BOOLEAN DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS {{table "ClientCredential"}} (
+	uuid VARCHAR(255) UNIQUE NOT NULL,
+	randId VARCHAR(255) UNIQUE,
+	createdat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	updatedat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	accountuuid VARCHAR(255) NOT NULL,
+	clientid VARCHAR(255) UNIQUE NOT NULL,
+	secrethash VARCHAR(255) NOT NULL,
+	scopes TEXT,
+	revokedat {{.Timestamp}} NULL
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS {{table "OAuthConsent"}};
+DROP TABLE IF EXISTS {{table "OAuthClient"}};
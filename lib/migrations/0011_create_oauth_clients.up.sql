@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS {{table "OAuthClient"}} (
+	uuid VARCHAR(255) UNIQUE NOT NULL,
+	randId VARCHAR(255) UNIQUE,
+	createdat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	updatedat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	clientid VARCHAR(255) UNIQUE NOT NULL,
+	secrethash VARCHAR(255),
+	name VARCHAR(255) NOT NULL,
+	redirecturis TEXT,
+	scopes TEXT,
+	public BOOLEAN DEFAULT FALSE,
+	firstparty BOOLEAN DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS {{table "OAuthConsent"}} (
+	accountuuid VARCHAR(255) NOT NULL,
+	clientid VARCHAR(255) NOT NULL,
+	scopes TEXT,
+	createdat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	updatedat {{.Timestamp}} DEFAULT {{.CurrentTimestamp}},
+	UNIQUE (accountuuid, clientid)
+);
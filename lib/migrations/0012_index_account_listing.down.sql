@@ -0,0 +1,3 @@
+DROP INDEX {{.IfExists}}{{indexName "UpdatedAt"}}{{if eq .Dialect "mysql"}} ON {{table ""}}{{end}};
+
+DROP INDEX {{.IfExists}}{{indexName "CreatedAt"}}{{if eq .Dialect "mysql"}} ON {{table ""}}{{end}};
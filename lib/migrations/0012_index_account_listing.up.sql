@@ -0,0 +1,3 @@
+CREATE INDEX {{.IfNotExists}}{{indexName "CreatedAt"}} ON {{table ""}} (createdat, uuid);
+
+CREATE INDEX {{.IfNotExists}}{{indexName "UpdatedAt"}} ON {{table ""}} (updatedat, uuid);
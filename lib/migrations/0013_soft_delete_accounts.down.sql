@@ -0,0 +1,3 @@
+DROP INDEX {{.IfExists}}{{indexName "DeletedAt"}}{{if eq .Dialect "mysql"}} ON {{table ""}}{{end}};
+
+ALTER TABLE {{table ""}} DROP COLUMN {{.IfExists}}deletedat;
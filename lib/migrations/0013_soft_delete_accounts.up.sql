@@ -0,0 +1,3 @@
+ALTER TABLE {{table ""}} ADD COLUMN {{.IfNotExists}}deletedat {{.Timestamp}} NULL;
+
+CREATE INDEX {{.IfNotExists}}{{indexName "DeletedAt"}} ON {{table ""}} (deletedat);
@@ -0,0 +1,2 @@
+UPDATE {{table ""}} SET username = NULL WHERE username = '';
+UPDATE {{table ""}} SET email = NULL WHERE email = '';
@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// OAuth 2.0 error codes, RFC 6749 section 5.2
+const (
+	OAuthInvalidRequest       = "invalid_request"
+	OAuthInvalidClient        = "invalid_client"
+	OAuthInvalidGrant         = "invalid_grant"
+	OAuthUnauthorizedClient   = "unauthorized_client"
+	OAuthUnsupportedGrantType = "unsupported_grant_type"
+	// RFC 6749 section 4.1.2.1 and OpenID Connect Core section 3.1.2.6
+	OAuthUnsupportedResponseType = "unsupported_response_type"
+	OAuthLoginRequired           = "login_required"
+	OAuthConsentRequired         = "consent_required"
+	// RFC 8628 section 3.5
+	OAuthAuthorizationPending = "authorization_pending"
+	OAuthSlowDown             = "slow_down"
+	OAuthExpiredToken         = "expired_token"
+	// RFC 7009 section 2.2.1
+	OAuthUnsupportedTokenType = "unsupported_token_type"
+	OAuthInvalidScope         = "invalid_scope"
+	OAuthAccessDenied         = "access_denied"
+	OAuthServerError          = "server_error"
+)
+
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IdToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code string, description string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	writeJSON(w, status, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// clientCredentialsFromRequest reads client_id and client_secret from HTTP Basic
+// authentication, falling back to the form body.
+func clientCredentialsFromRequest(r *http.Request) (string, string) {
+	clientId, clientSecret, ok := r.BasicAuth()
+	if ok {
+		return clientId, clientSecret
+	}
+	return r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+}
+
+// grantScopes narrows requested to allowed. An empty request receives every
+// allowed scope; asking for anything outside allowed fails.
+func grantScopes(requested string, allowed []string) ([]string, bool) {
+	if strings.TrimSpace(requested) == "" {
+		return allowed, true
+	}
+
+	allowedSet := make(map[string]bool, len(allowed))
+	for _, scope := range allowed {
+		allowedSet[scope] = true
+	}
+
+	scopes := strings.Fields(requested)
+	for _, scope := range scopes {
+		if !allowedSet[scope] {
+			return nil, false
+		}
+	}
+	return scopes, true
+}
@@ -0,0 +1,221 @@
+package lib
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"github.com/lefalya/commonuser/definition"
+	"github.com/lefalya/pageflow"
+	"strings"
+	"time"
+)
+
+type OAuthClientSQL struct {
+	*pageflow.SQLItem `bson:",inline" json:",inline"`
+	ClientId          string   `json:"clientid" db:"clientid"`
+	SecretHash        string   `json:"-" db:"secrethash"`
+	Name              string   `json:"name" db:"name"`
+	RedirectURIs      []string `json:"redirecturis" db:"redirecturis"`
+	Scopes            []string `json:"scopes" db:"scopes"`
+	// Public clients (SPAs, native apps) hold no secret and rely on PKCE alone.
+	Public bool `json:"public" db:"public"`
+	// FirstParty clients skip the consent screen.
+	FirstParty bool `json:"firstparty" db:"firstparty"`
+}
+
+func (oc *OAuthClientSQL) HasRedirectURI(redirectURI string) bool {
+	for _, registered := range oc.RedirectURIs {
+		if registered == redirectURI {
+			return true
+		}
+	}
+	return false
+}
+
+func NewOAuthClientSQL() *OAuthClientSQL {
+	client := &OAuthClientSQL{}
+	pageflow.InitSQLItem(client)
+	return client
+}
+
+// OAuthClientManagerSQL keeps the applications registered against the OAuth
+// provider together with the consent each account granted them.
+type OAuthClientManagerSQL struct {
+	db         *sqlDB
+	entityName string
+}
+
+func (cm *OAuthClientManagerSQL) clientTable() string {
+	return cm.db.table(cm.entityName + "OAuthClient")
+}
+
+func (cm *OAuthClientManagerSQL) consentTable() string {
+	return cm.db.table(cm.entityName + "OAuthConsent")
+}
+
+// Register returns the plaintext client secret, empty for public clients.
+func (cm *OAuthClientManagerSQL) Register(name string, redirectURIs []string, scopes []string, public bool, firstParty bool) (string, *OAuthClientSQL, error) {
+	clientId, errClientId := randomToken(16)
+	if errClientId != nil {
+		return "", nil, errClientId
+	}
+
+	client := NewOAuthClientSQL()
+	client.ClientId = clientId
+	client.Name = name
+	client.RedirectURIs = redirectURIs
+	client.Scopes = scopes
+	client.Public = public
+	client.FirstParty = firstParty
+
+	clientSecret := ""
+	if !public {
+		var errSecret error
+		clientSecret, errSecret = randomToken(32)
+		if errSecret != nil {
+			return "", nil, errSecret
+		}
+		client.SecretHash = hashAPIKey(clientSecret)
+	}
+
+	query := "INSERT INTO " + cm.clientTable() + " (uuid, randId, createdat, updatedat, clientid, secrethash, name, redirecturis, scopes, public, firstparty) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)"
+	_, errInsert := cm.db.Exec(
+		query,
+		client.GetUUID(),
+		client.GetRandId(),
+		client.GetCreatedAt(),
+		client.GetUpdatedAt(),
+		client.ClientId,
+		client.SecretHash,
+		client.Name,
+		strings.Join(client.RedirectURIs, " "),
+		strings.Join(client.Scopes, " "),
+		client.Public,
+		client.FirstParty)
+	if errInsert != nil {
+		return "", nil, errInsert
+	}
+	return clientSecret, client, nil
+}
+
+func (cm *OAuthClientManagerSQL) Find(clientId string) (*OAuthClientSQL, error) {
+	query := "SELECT uuid, randId, createdat, updatedat, clientid, secrethash, name, redirecturis, scopes, public, firstparty FROM " + cm.clientTable() + " WHERE clientid = $1"
+	client := NewOAuthClientSQL()
+	var redirectURIs, scopes string
+	err := cm.db.QueryRow(query, clientId).Scan(
+		&client.SQLItem.UUID,
+		&client.SQLItem.RandId,
+		&client.SQLItem.CreatedAt,
+		&client.SQLItem.UpdatedAt,
+		&client.ClientId,
+		&client.SecretHash,
+		&client.Name,
+		&redirectURIs,
+		&scopes,
+		&client.Public,
+		&client.FirstParty,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	client.RedirectURIs = strings.Fields(redirectURIs)
+	client.Scopes = strings.Fields(scopes)
+	return client, nil
+}
+
+func (cm *OAuthClientManagerSQL) Update(client *OAuthClientSQL) error {
+	query := "UPDATE " + cm.clientTable() + " SET updatedat = $1, name = $2, redirecturis = $3, scopes = $4, firstparty = $5 WHERE clientid = $6"
+	_, errUpdate := cm.db.Exec(query, time.Now().UTC(), client.Name, strings.Join(client.RedirectURIs, " "), strings.Join(client.Scopes, " "), client.FirstParty, client.ClientId)
+	if errUpdate != nil {
+		return errUpdate
+	}
+	return nil
+}
+
+// Delete removes the client with its consents. Its outstanding refresh tokens
+// are refused from then on, since the client no longer authenticates.
+func (cm *OAuthClientManagerSQL) Delete(clientId string) error {
+	queries := []string{
+		"DELETE FROM " + cm.consentTable() + " WHERE clientid = $1",
+		"DELETE FROM " + cm.clientTable() + " WHERE clientid = $1",
+	}
+	for _, query := range queries {
+		_, errDelete := cm.db.Exec(query, clientId)
+		if errDelete != nil {
+			return errDelete
+		}
+	}
+	return nil
+}
+
+// Authenticate checks the secret of confidential clients; public clients must
+// not present one.
+func (cm *OAuthClientManagerSQL) Authenticate(clientId string, clientSecret string) (*OAuthClientSQL, error) {
+	client, errFind := cm.Find(clientId)
+	if errFind != nil {
+		return nil, errFind
+	}
+	if client == nil {
+		return nil, definition.InvalidCredentials
+	}
+
+	if client.Public {
+		if clientSecret != "" {
+			return nil, definition.InvalidCredentials
+		}
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(hashAPIKey(clientSecret))) != 1 {
+		return nil, definition.InvalidCredentials
+	}
+	return client, nil
+}
+
+// FindConsent returns the scopes the account granted the client, nil when none.
+func (cm *OAuthClientManagerSQL) FindConsent(accountUUID string, clientId string) ([]string, error) {
+	query := "SELECT scopes FROM " + cm.consentTable() + " WHERE accountuuid = $1 AND clientid = $2"
+	var scopes string
+	err := cm.db.QueryRow(query, accountUUID, clientId).Scan(&scopes)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return strings.Fields(scopes), nil
+}
+
+func (cm *OAuthClientManagerSQL) GrantConsent(account *AccountSQL, clientId string, scopes []string) error {
+	timeNow := time.Now().UTC()
+	query := cm.db.dialect().Upsert(
+		cm.consentTable(),
+		[]string{"accountuuid", "clientid", "scopes", "createdat", "updatedat"},
+		[]string{"accountuuid", "clientid"},
+		[]string{"scopes", "updatedat"})
+	_, errUpsert := cm.db.Exec(query, account.GetUUID(), clientId, strings.Join(scopes, " "), timeNow, timeNow)
+	if errUpsert != nil {
+		return errUpsert
+	}
+	return nil
+}
+
+// RevokeConsent withdraws the client's access; OAuthProvider refuses the
+// refresh tokens it holds for the account from then on.
+func (cm *OAuthClientManagerSQL) RevokeConsent(account *AccountSQL, clientId string) error {
+	query := "DELETE FROM " + cm.consentTable() + " WHERE accountuuid = $1 AND clientid = $2"
+	_, errDelete := cm.db.Exec(query, account.GetUUID(), clientId)
+	if errDelete != nil {
+		return errDelete
+	}
+	return nil
+}
+
+func NewOAuthClientManagerSQL(db *sql.DB, entityName string) *OAuthClientManagerSQL {
+	return &OAuthClientManagerSQL{
+		db:         newSQLDB(db),
+		entityName: entityName,
+	}
+}
@@ -0,0 +1,674 @@
+package lib
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lefalya/commonuser/definition"
+	"github.com/redis/go-redis/v9"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeOpenId        = "openid"
+	ScopeProfile       = "profile"
+	ScopeEmail         = "email"
+	ScopeOfflineAccess = "offline_access"
+)
+
+const (
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeRefreshToken      = "refresh_token"
+)
+
+const (
+	codeChallengeMethodS256          = "S256"
+	defaultAuthorizationCodeLifeSpan = time.Minute
+	defaultOAuthRefreshTokenLifeSpan = 30 * 24 * time.Hour
+)
+
+type OAuthProviderConfig struct {
+	// Issuer is the public base URL the provider handler is mounted at.
+	Issuer string
+	// LoginURL receives anonymous visitors of the authorization endpoint, with
+	// the authorization URL to come back to in the return_to parameter.
+	LoginURL string
+	// ConsentURL receives the authorization request query when the account has
+	// not yet consented to the client's scopes. The page records the decision
+	// with OAuthClientManagerSQL.GrantConsent and sends the browser back to the
+	// authorization endpoint, or to AccessDeniedURL.
+	ConsentURL string
+	// SigningKey signs ID tokens with RS256; its public half is served as JWKS.
+	SigningKey                *rsa.PrivateKey
+	AuthorizationCodeLifeSpan time.Duration
+	RefreshTokenLifeSpan      time.Duration
+	// VerificationURL is the page where users enter device user codes, by
+	// default the VerificationHandler below the issuer.
+	VerificationURL    string
+	DeviceCodeLifeSpan time.Duration
+	DevicePollInterval time.Duration
+	// Authenticate resolves the signed in account of a browser request, e.g.
+	// CookieSessionHandler.Authenticate. When nil the claims stored in the request
+	// context by a middleware are used.
+	Authenticate func(w http.ResponseWriter, r *http.Request) (*UserClaims, error)
+}
+
+type IdTokenClaims struct {
+	Nonce             string           `json:"nonce,omitempty"`
+	AuthTime          *jwt.NumericDate `json:"auth_time,omitempty"`
+	Name              string           `json:"name,omitempty"`
+	PreferredUsername string           `json:"preferred_username,omitempty"`
+	Picture           string           `json:"picture,omitempty"`
+	Email             string           `json:"email,omitempty"`
+	EmailVerified     *bool            `json:"email_verified,omitempty"`
+	jwt.RegisteredClaims
+}
+
+type authorizationCode struct {
+	ClientId      string    `json:"clientid"`
+	AccountUUID   string    `json:"accountuuid"`
+	RedirectURI   string    `json:"redirecturi"`
+	Scope         string    `json:"scope"`
+	CodeChallenge string    `json:"codechallenge"`
+	Nonce         string    `json:"nonce,omitempty"`
+	AuthTime      time.Time `json:"authtime"`
+}
+
+type oauthRefreshToken struct {
+	ClientId    string    `json:"clientid"`
+	AccountUUID string    `json:"accountuuid"`
+	Scope       string    `json:"scope"`
+	AuthTime    time.Time `json:"authtime"`
+}
+
+// OAuthProvider turns commonuser into an OAuth 2.1 authorization server and
+// OpenID Connect provider. Authorization codes and refresh tokens are single-use
+// Redis records; access tokens are HS256 tokens of the JWTHandler marked for
+// OAuth use and
+// ID tokens are signed with the RSA key published at the JWKS endpoint.
+type OAuthProvider struct {
+	redis          redis.UniversalClient
+	entityName     string
+	clients        *OAuthClientManagerSQL
+	accountManager *AccountManagerSQL
+	jwtHandler     *JWTHandler
+	config         OAuthProviderConfig
+	keyId          string
+	sessionManager *SessionManager
+	apiKeyManager  *APIKeyManagerSQL
+}
+
+func (op *OAuthProvider) codeKey(code string) string {
+	return op.entityName + ":oauth:code:" + hashAPIKey(code)
+}
+
+func (op *OAuthProvider) refreshTokenKey(refreshToken string) string {
+	return op.entityName + ":oauth:refresh:" + hashAPIKey(refreshToken)
+}
+
+// Handler serves every endpoint below the issuer URL.
+func (op *OAuthProvider) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/authorize", op.AuthorizeHandler())
+	mux.Handle("/token", op.TokenHandler())
+	mux.Handle("/userinfo", op.UserInfoHandler())
+	mux.Handle("/device_authorization", op.DeviceAuthorizationHandler())
+	mux.Handle("/device", op.VerificationHandler())
+	mux.Handle("/introspect", op.IntrospectionHandler())
+	mux.Handle("/revoke", op.RevocationHandler())
+	mux.Handle("/jwks", op.JWKSHandler())
+	mux.Handle("/.well-known/openid-configuration", op.DiscoveryHandler())
+	return mux
+}
+
+func (op *OAuthProvider) authenticate(w http.ResponseWriter, r *http.Request) *UserClaims {
+	var claims *UserClaims
+	if op.config.Authenticate != nil {
+		claims, _ = op.config.Authenticate(w, r)
+	} else {
+		claims, _ = ClaimsFromContext(r.Context())
+	}
+	// only a first-party login may approve clients: OAuth tokens, API keys and
+	// scoped tokens are refused, as are session-less tokens once sessions are
+	// tracked
+	if claims == nil || claims.TokenUse != "" || claims.ClientId != "" || claims.Scope != "" {
+		return nil
+	}
+	if op.sessionManager != nil && claims.SessionId == "" {
+		return nil
+	}
+	return claims
+}
+
+// AuthorizeHandler serves the authorization endpoint. Only the code flow with
+// S256 PKCE is accepted, as OAuth 2.1 requires.
+func (op *OAuthProvider) AuthorizeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		client, errClient := op.clients.Find(query.Get("client_id"))
+		if errClient != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		redirectURI := query.Get("redirect_uri")
+		// an unverified redirect_uri must never receive a redirect
+		if client == nil || !client.HasRedirectURI(redirectURI) {
+			http.Error(w, "unknown client_id or redirect_uri", http.StatusBadRequest)
+			return
+		}
+
+		state := query.Get("state")
+		if query.Get("response_type") != "code" {
+			op.redirectError(w, r, redirectURI, state, OAuthUnsupportedResponseType, "only the code response type is supported")
+			return
+		}
+		if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != codeChallengeMethodS256 {
+			op.redirectError(w, r, redirectURI, state, OAuthInvalidRequest, "PKCE with the S256 method is required")
+			return
+		}
+		scopes, granted := grantScopes(query.Get("scope"), client.Scopes)
+		if !granted {
+			op.redirectError(w, r, redirectURI, state, OAuthInvalidScope, "requested scope exceeds the client's scopes")
+			return
+		}
+
+		promptNone := query.Get("prompt") == "none"
+		claims := op.authenticate(w, r)
+		if claims == nil {
+			if promptNone || op.config.LoginURL == "" {
+				op.redirectError(w, r, redirectURI, state, OAuthLoginRequired, "")
+				return
+			}
+			http.Redirect(w, r, appendQuery(op.config.LoginURL, url.Values{"return_to": {r.URL.String()}}), http.StatusFound)
+			return
+		}
+
+		if !client.FirstParty {
+			consented, errConsent := op.clients.FindConsent(claims.UUID, client.ClientId)
+			if errConsent != nil {
+				op.redirectError(w, r, redirectURI, state, OAuthServerError, "")
+				return
+			}
+			if !containsScopes(consented, scopes) {
+				if promptNone || op.config.ConsentURL == "" {
+					op.redirectError(w, r, redirectURI, state, OAuthConsentRequired, "")
+					return
+				}
+				http.Redirect(w, r, appendQuery(op.config.ConsentURL, query), http.StatusFound)
+				return
+			}
+		}
+
+		authTime := time.Now().UTC()
+		if claims.IssuedAt != nil {
+			authTime = claims.IssuedAt.Time
+		}
+		code, errCode := op.CreateAuthorizationCode(client, claims.UUID, redirectURI, scopes, query.Get("code_challenge"), query.Get("nonce"), authTime)
+		if errCode != nil {
+			op.redirectError(w, r, redirectURI, state, OAuthServerError, "")
+			return
+		}
+
+		params := url.Values{"code": {code}, "iss": {op.config.Issuer}}
+		if state != "" {
+			params.Set("state", state)
+		}
+		http.Redirect(w, r, appendQuery(redirectURI, params), http.StatusFound)
+	})
+}
+
+// AccessDeniedURL builds the redirect back to the client after the account
+// declined the consent screen for the given authorization request query.
+func (op *OAuthProvider) AccessDeniedURL(query url.Values) (string, error) {
+	client, errClient := op.clients.Find(query.Get("client_id"))
+	if errClient != nil {
+		return "", errClient
+	}
+	redirectURI := query.Get("redirect_uri")
+	if client == nil || !client.HasRedirectURI(redirectURI) {
+		return "", definition.InvalidCredentials
+	}
+	return appendQuery(redirectURI, op.errorParams(query.Get("state"), OAuthAccessDenied, "")), nil
+}
+
+func (op *OAuthProvider) errorParams(state string, code string, description string) url.Values {
+	params := url.Values{"error": {code}, "iss": {op.config.Issuer}}
+	if description != "" {
+		params.Set("error_description", description)
+	}
+	if state != "" {
+		params.Set("state", state)
+	}
+	return params
+}
+
+func (op *OAuthProvider) redirectError(w http.ResponseWriter, r *http.Request, redirectURI string, state string, code string, description string) {
+	http.Redirect(w, r, appendQuery(redirectURI, op.errorParams(state, code, description)), http.StatusFound)
+}
+
+// CreateAuthorizationCode stores a single-use code bound to the client, the
+// redirect URI and the PKCE challenge.
+func (op *OAuthProvider) CreateAuthorizationCode(client *OAuthClientSQL, accountUUID string, redirectURI string, scopes []string, codeChallenge string, nonce string, authTime time.Time) (string, error) {
+	code, errToken := randomToken(32)
+	if errToken != nil {
+		return "", errToken
+	}
+
+	payload, errMarshal := json.Marshal(authorizationCode{
+		ClientId:      client.ClientId,
+		AccountUUID:   accountUUID,
+		RedirectURI:   redirectURI,
+		Scope:         strings.Join(scopes, " "),
+		CodeChallenge: codeChallenge,
+		Nonce:         nonce,
+		AuthTime:      authTime,
+	})
+	if errMarshal != nil {
+		return "", errMarshal
+	}
+
+	errSet := op.redis.Set(context.Background(), op.codeKey(code), payload, op.config.AuthorizationCodeLifeSpan).Err()
+	if errSet != nil {
+		return "", errSet
+	}
+	return code, nil
+}
+
+// ExchangeAuthorizationCode performs the authorization_code grant. Errors are
+// definition.InvalidCredentials for a failed client authentication and
+// definition.InvalidToken for an unusable code.
+func (op *OAuthProvider) ExchangeAuthorizationCode(clientId string, clientSecret string, code string, redirectURI string, codeVerifier string) (*OAuthTokenResponse, error) {
+	client, errClient := op.clients.Authenticate(clientId, clientSecret)
+	if errClient != nil {
+		return nil, errClient
+	}
+
+	payload, errGet := op.redis.GetDel(context.Background(), op.codeKey(code)).Bytes()
+	if errGet != nil {
+		if errors.Is(errGet, redis.Nil) {
+			return nil, definition.InvalidToken
+		}
+		return nil, errGet
+	}
+	var grant authorizationCode
+	errUnmarshal := json.Unmarshal(payload, &grant)
+	if errUnmarshal != nil {
+		return nil, errUnmarshal
+	}
+
+	if grant.ClientId != client.ClientId || grant.RedirectURI != redirectURI {
+		return nil, definition.InvalidToken
+	}
+	if !verifyCodeChallenge(grant.CodeChallenge, codeVerifier) {
+		return nil, definition.InvalidToken
+	}
+
+	return op.issueTokens(client, grant.AccountUUID, strings.Fields(grant.Scope), grant.Nonce, grant.AuthTime)
+}
+
+// ExchangeRefreshToken performs the refresh_token grant. Refresh tokens rotate:
+// the presented one is consumed and a new one is returned. requestedScope may
+// narrow the original grant. Tokens of a deleted client, or of a third-party
+// client whose consent was revoked or narrowed, stop working.
+func (op *OAuthProvider) ExchangeRefreshToken(clientId string, clientSecret string, refreshToken string, requestedScope string) (*OAuthTokenResponse, error) {
+	client, errClient := op.clients.Authenticate(clientId, clientSecret)
+	if errClient != nil {
+		return nil, errClient
+	}
+
+	payload, errGet := op.redis.GetDel(context.Background(), op.refreshTokenKey(refreshToken)).Bytes()
+	if errGet != nil {
+		if errors.Is(errGet, redis.Nil) {
+			return nil, definition.InvalidToken
+		}
+		return nil, errGet
+	}
+	var grant oauthRefreshToken
+	errUnmarshal := json.Unmarshal(payload, &grant)
+	if errUnmarshal != nil {
+		return nil, errUnmarshal
+	}
+	if grant.ClientId != client.ClientId {
+		return nil, definition.InvalidToken
+	}
+
+	scopes, granted := grantScopes(requestedScope, strings.Fields(grant.Scope))
+	if !granted {
+		return nil, definition.InvalidScope
+	}
+	if !client.FirstParty {
+		consented, errConsent := op.clients.FindConsent(grant.AccountUUID, client.ClientId)
+		if errConsent != nil {
+			return nil, errConsent
+		}
+		if !containsScopes(consented, scopes) {
+			return nil, definition.InvalidToken
+		}
+	}
+	return op.issueTokens(client, grant.AccountUUID, scopes, "", grant.AuthTime)
+}
+
+func (op *OAuthProvider) issueTokens(client *OAuthClientSQL, accountUUID string, scopes []string, nonce string, authTime time.Time) (*OAuthTokenResponse, error) {
+	account, errAccount := op.accountManager.FindByUUID(accountUUID)
+	if errAccount != nil {
+		return nil, errAccount
+	}
+	if account == nil || account.IsSuspended() || account.ServiceAccount {
+		return nil, definition.InvalidToken
+	}
+	if op.accountManager.roleManager != nil {
+		errRoles := op.accountManager.roleManager.LoadRoles(account)
+		if errRoles != nil {
+			return nil, errRoles
+		}
+	}
+
+	scope := strings.Join(scopes, " ")
+	lifeSpan := time.Hour * time.Duration(op.jwtHandler.jwtTokenLifeSpan)
+	accessToken, errSign := signOAuthAccessToken(op.jwtHandler, account, client.ClientId, scope, lifeSpan)
+	if errSign != nil {
+		return nil, errSign
+	}
+
+	response := &OAuthTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(lifeSpan.Seconds()),
+		Scope:       scope,
+	}
+	if containsScopes(scopes, []string{ScopeOfflineAccess}) {
+		refreshToken, errRefresh := op.storeRefreshToken(client, account, scope, authTime)
+		if errRefresh != nil {
+			return nil, errRefresh
+		}
+		response.RefreshToken = refreshToken
+	}
+	if containsScopes(scopes, []string{ScopeOpenId}) {
+		idToken, errIdToken := op.signIdToken(account, client, scopes, nonce, authTime, lifeSpan)
+		if errIdToken != nil {
+			return nil, errIdToken
+		}
+		response.IdToken = idToken
+	}
+	return response, nil
+}
+
+// storeRefreshToken records a single-use refresh token; only grants that include
+// offline_access get one.
+func (op *OAuthProvider) storeRefreshToken(client *OAuthClientSQL, account *AccountSQL, scope string, authTime time.Time) (string, error) {
+	refreshToken, errToken := randomToken(32)
+	if errToken != nil {
+		return "", errToken
+	}
+	payload, errMarshal := json.Marshal(oauthRefreshToken{
+		ClientId:    client.ClientId,
+		AccountUUID: account.GetUUID(),
+		Scope:       scope,
+		AuthTime:    authTime,
+	})
+	if errMarshal != nil {
+		return "", errMarshal
+	}
+	errSet := op.redis.Set(context.Background(), op.refreshTokenKey(refreshToken), payload, op.config.RefreshTokenLifeSpan).Err()
+	if errSet != nil {
+		return "", errSet
+	}
+	return refreshToken, nil
+}
+
+// signOAuthAccessToken signs an access token that JWTHandler.ParseAccessToken
+// refuses, so a client's token never passes for a first-party login.
+func signOAuthAccessToken(jwtHandler *JWTHandler, account *AccountSQL, clientId string, scope string, lifeSpan time.Duration) (string, error) {
+	claims := account.newUserClaims(jwtHandler.jwtTokenIssuer, lifeSpan)
+	claims.Scope = scope
+	claims.ClientId = clientId
+	claims.TokenUse = tokenUseOAuthAccess
+	claims.Audience = jwt.ClaimStrings{clientId}
+	return signToken(jwtHandler.jwtSecret, claims)
+}
+
+func (op *OAuthProvider) signIdToken(account *AccountSQL, client *OAuthClientSQL, scopes []string, nonce string, authTime time.Time, lifeSpan time.Duration) (string, error) {
+	timeNow := time.Now().UTC()
+	claims := IdTokenClaims{
+		Nonce:    nonce,
+		AuthTime: jwt.NewNumericDate(authTime),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    op.config.Issuer,
+			Subject:   account.GetUUID(),
+			Audience:  jwt.ClaimStrings{client.ClientId},
+			IssuedAt:  jwt.NewNumericDate(timeNow),
+			ExpiresAt: jwt.NewNumericDate(timeNow.Add(lifeSpan)),
+		},
+	}
+	if containsScopes(scopes, []string{ScopeProfile}) {
+		claims.Name = account.Name
+		claims.PreferredUsername = account.Username
+		claims.Picture = account.Avatar
+	}
+	if containsScopes(scopes, []string{ScopeEmail}) {
+		emailVerified := account.IsEmailVerified()
+		claims.Email = account.Email
+		claims.EmailVerified = &emailVerified
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = op.keyId
+	return token.SignedString(op.config.SigningKey)
+}
+
+// TokenHandler serves the token endpoint for the authorization_code,
+// refresh_token and device_code grants.
+func (op *OAuthProvider) TokenHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeOAuthError(w, http.StatusMethodNotAllowed, OAuthInvalidRequest, "token endpoint only accepts POST")
+			return
+		}
+
+		clientId, clientSecret := clientCredentialsFromRequest(r)
+		var response *OAuthTokenResponse
+		var errGrant error
+		switch r.PostFormValue("grant_type") {
+		case GrantTypeAuthorizationCode:
+			response, errGrant = op.ExchangeAuthorizationCode(clientId, clientSecret, r.PostFormValue("code"), r.PostFormValue("redirect_uri"), r.PostFormValue("code_verifier"))
+		case GrantTypeRefreshToken:
+			response, errGrant = op.ExchangeRefreshToken(clientId, clientSecret, r.PostFormValue("refresh_token"), r.PostFormValue("scope"))
+		case GrantTypeDeviceCode:
+			response, errGrant = op.ExchangeDeviceCode(clientId, clientSecret, r.PostFormValue("device_code"))
+		default:
+			writeOAuthError(w, http.StatusBadRequest, OAuthUnsupportedGrantType, "")
+			return
+		}
+
+		if errGrant != nil {
+			writeTokenError(w, errGrant)
+			return
+		}
+		writeJSON(w, http.StatusOK, response)
+	})
+}
+
+func writeTokenError(w http.ResponseWriter, err error) {
+	switch err {
+	case definition.InvalidCredentials:
+		writeOAuthError(w, http.StatusUnauthorized, OAuthInvalidClient, "client authentication failed")
+	case definition.InvalidToken:
+		writeOAuthError(w, http.StatusBadRequest, OAuthInvalidGrant, "")
+	case definition.InvalidScope:
+		writeOAuthError(w, http.StatusBadRequest, OAuthInvalidScope, "")
+	case definition.AuthorizationPending:
+		writeOAuthError(w, http.StatusBadRequest, OAuthAuthorizationPending, "")
+	case definition.SlowDown:
+		writeOAuthError(w, http.StatusBadRequest, OAuthSlowDown, "")
+	case definition.AccessDenied:
+		writeOAuthError(w, http.StatusBadRequest, OAuthAccessDenied, "")
+	case definition.RequestExpired:
+		writeOAuthError(w, http.StatusBadRequest, OAuthExpiredToken, "")
+	case definition.Forbidden:
+		writeOAuthError(w, http.StatusBadRequest, OAuthUnauthorizedClient, "")
+	case definition.UnsupportedTokenType:
+		writeOAuthError(w, http.StatusBadRequest, OAuthUnsupportedTokenType, "")
+	default:
+		writeOAuthError(w, http.StatusInternalServerError, OAuthServerError, "")
+	}
+}
+
+// UserInfo describes the token's account limited to the scopes it was granted.
+func (op *OAuthProvider) UserInfo(claims *UserClaims) (map[string]any, error) {
+	scopes := strings.Fields(claims.Scope)
+	if !containsScopes(scopes, []string{ScopeOpenId}) {
+		return nil, definition.Forbidden
+	}
+
+	userInfo := map[string]any{"sub": claims.UUID}
+	if containsScopes(scopes, []string{ScopeProfile}) {
+		userInfo["name"] = claims.Name
+		userInfo["preferred_username"] = claims.Username
+		userInfo["picture"] = claims.Avatar
+	}
+	if containsScopes(scopes, []string{ScopeEmail}) {
+		userInfo["email"] = claims.Email
+	}
+	return userInfo, nil
+}
+
+func (op *OAuthProvider) UserInfoHandler() http.Handler {
+	return BearerMiddleware(op, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := ClaimsFromContext(r.Context())
+		userInfo, errUserInfo := op.UserInfo(claims)
+		if errUserInfo != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+			http.Error(w, errUserInfo.Error(), http.StatusForbidden)
+			return
+		}
+		writeJSON(w, http.StatusOK, userInfo)
+	}))
+}
+
+// Discovery returns the OpenID Connect provider metadata.
+func (op *OAuthProvider) Discovery() map[string]any {
+	return map[string]any{
+		"issuer":                                         op.config.Issuer,
+		"authorization_endpoint":                         op.config.Issuer + "/authorize",
+		"token_endpoint":                                 op.config.Issuer + "/token",
+		"userinfo_endpoint":                              op.config.Issuer + "/userinfo",
+		"jwks_uri":                                       op.config.Issuer + "/jwks",
+		"device_authorization_endpoint":                  op.config.Issuer + "/device_authorization",
+		"introspection_endpoint":                         op.config.Issuer + "/introspect",
+		"revocation_endpoint":                            op.config.Issuer + "/revoke",
+		"response_types_supported":                       []string{"code"},
+		"grant_types_supported":                          []string{GrantTypeAuthorizationCode, GrantTypeRefreshToken, GrantTypeDeviceCode},
+		"subject_types_supported":                        []string{"public"},
+		"id_token_signing_alg_values_supported":          []string{jwt.SigningMethodRS256.Alg()},
+		"scopes_supported":                               []string{ScopeOpenId, ScopeProfile, ScopeEmail, ScopeOfflineAccess},
+		"claims_supported":                               []string{"sub", "name", "preferred_username", "picture", "email", "email_verified"},
+		"token_endpoint_auth_methods_supported":          []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":               []string{codeChallengeMethodS256},
+		"authorization_response_iss_parameter_supported": true,
+	}
+}
+
+func (op *OAuthProvider) DiscoveryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, op.Discovery())
+	})
+}
+
+// JWKS returns the JSON Web Key Set holding the ID token verification key.
+func (op *OAuthProvider) JWKS() map[string]any {
+	publicKey := op.config.SigningKey.PublicKey
+	return map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": jwt.SigningMethodRS256.Alg(),
+			"kid": op.keyId,
+			"n":   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+		}},
+	}
+}
+
+func (op *OAuthProvider) JWKSHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, op.JWKS())
+	})
+}
+
+// rsaKeyId is the RFC 7638 thumbprint of the public key.
+func rsaKeyId(publicKey *rsa.PublicKey) string {
+	n := base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+	e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+	sum := sha256.Sum256([]byte(`{"e":"` + e + `","kty":"RSA","n":"` + n + `"}`))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func verifyCodeChallenge(codeChallenge string, codeVerifier string) bool {
+	// RFC 7636 section 4.1
+	if len(codeVerifier) < 43 || len(codeVerifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(codeVerifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(codeChallenge)) == 1
+}
+
+// containsScopes reports whether granted covers every scope of required.
+func containsScopes(granted []string, required []string) bool {
+	grantedSet := make(map[string]bool, len(granted))
+	for _, scope := range granted {
+		grantedSet[scope] = true
+	}
+	for _, scope := range required {
+		if !grantedSet[scope] {
+			return false
+		}
+	}
+	return true
+}
+
+func appendQuery(rawURL string, params url.Values) string {
+	separator := "?"
+	if strings.Contains(rawURL, "?") {
+		separator = "&"
+	}
+	return rawURL + separator + params.Encode()
+}
+
+func NewOAuthProvider(redis redis.UniversalClient, entityName string, clients *OAuthClientManagerSQL, accountManager *AccountManagerSQL, jwtHandler *JWTHandler, config OAuthProviderConfig) (*OAuthProvider, error) {
+	if config.SigningKey == nil {
+		return nil, definition.MissingSigningKey
+	}
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	if config.AuthorizationCodeLifeSpan == 0 {
+		config.AuthorizationCodeLifeSpan = defaultAuthorizationCodeLifeSpan
+	}
+	if config.RefreshTokenLifeSpan == 0 {
+		config.RefreshTokenLifeSpan = defaultOAuthRefreshTokenLifeSpan
+	}
+	if config.DeviceCodeLifeSpan == 0 {
+		config.DeviceCodeLifeSpan = defaultDeviceCodeLifeSpan
+	}
+	if config.DevicePollInterval == 0 {
+		config.DevicePollInterval = defaultDevicePollInterval
+	}
+
+	return &OAuthProvider{
+		redis:          redis,
+		entityName:     entityName,
+		clients:        clients,
+		accountManager: accountManager,
+		jwtHandler:     jwtHandler,
+		config:         config,
+		keyId:          rsaKeyId(&config.SigningKey.PublicKey),
+	}, nil
+}
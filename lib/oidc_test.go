@@ -0,0 +1,337 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/lefalya/commonuser/definition"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewOAuthProviderRequiresSigningKey(t *testing.T) {
+	_, errProvider := NewOAuthProvider(newFakeRedis(), "test", nil, nil, NewJWTHandler("secret", "issuer", 1), OAuthProviderConfig{})
+	if !errors.Is(errProvider, definition.MissingSigningKey) {
+		t.Fatalf("got %v, want %v", errProvider, definition.MissingSigningKey)
+	}
+}
+
+func TestOAuthAccessTokenIsNotALoginToken(t *testing.T) {
+	jwtHandler := NewJWTHandler("secret", "issuer", 1)
+	account := newTestAccount()
+
+	oauthToken, errSign := signOAuthAccessToken(jwtHandler, account, "app", "openid profile", time.Hour)
+	if errSign != nil {
+		t.Fatal(errSign)
+	}
+	if _, err := jwtHandler.ParseAccessToken(oauthToken); err == nil {
+		t.Error("ParseAccessToken accepted an OAuth access token")
+	}
+	if _, err := jwtHandler.ParseRefreshToken(oauthToken); err == nil {
+		t.Error("ParseRefreshToken accepted an OAuth access token")
+	}
+	claims, errParse := jwtHandler.ParseOAuthAccessToken(oauthToken)
+	if errParse != nil {
+		t.Fatal(errParse)
+	}
+	if claims.ClientId != "app" || claims.Scope != "openid profile" || claims.UUID != account.GetUUID() {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	loginToken, errLogin := signToken(jwtHandler.jwtSecret, account.newUserClaims(jwtHandler.jwtTokenIssuer, time.Hour))
+	if errLogin != nil {
+		t.Fatal(errLogin)
+	}
+	if _, err := jwtHandler.ParseOAuthAccessToken(loginToken); err == nil {
+		t.Error("ParseOAuthAccessToken accepted a login access token")
+	}
+	if _, err := jwtHandler.ParseAccessToken(loginToken); err != nil {
+		t.Errorf("ParseAccessToken refused a login access token: %v", err)
+	}
+}
+
+func TestOAuthProviderRefusesRevokedAccessToken(t *testing.T) {
+	provider := newTestOAuthProvider(t)
+	accessToken, errSign := signOAuthAccessToken(provider.jwtHandler, newTestAccount(), "app", "openid", time.Hour)
+	if errSign != nil {
+		t.Fatal(errSign)
+	}
+
+	if _, err := provider.ParseAccessToken(accessToken); err != nil {
+		t.Fatalf("ParseAccessToken refused a fresh token: %v", err)
+	}
+	if err := provider.Revoke(&OAuthClientSQL{ClientId: "other"}, accessToken); !errors.Is(err, definition.Forbidden) {
+		t.Fatalf("another client revoked the token: %v", err)
+	}
+	if err := provider.Revoke(&OAuthClientSQL{ClientId: "app"}, accessToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.ParseAccessToken(accessToken); !errors.Is(err, definition.Unauthorized) {
+		t.Fatalf("got %v for a revoked token, want %v", err, definition.Unauthorized)
+	}
+}
+
+func TestUserInfoHandlerLimitsClaimsToScope(t *testing.T) {
+	provider := newTestOAuthProvider(t)
+	account := newTestAccount()
+
+	tests := []struct {
+		scope  string
+		status int
+		fields []string
+	}{
+		{scope: "profile", status: http.StatusForbidden},
+		{scope: "openid", status: http.StatusOK, fields: []string{`"sub"`}},
+		{scope: "openid email", status: http.StatusOK, fields: []string{`"sub"`, `"email"`}},
+		{scope: "openid profile", status: http.StatusOK, fields: []string{`"sub"`, `"preferred_username"`}},
+	}
+	for _, test := range tests {
+		accessToken, errSign := signOAuthAccessToken(provider.jwtHandler, account, "app", test.scope, time.Hour)
+		if errSign != nil {
+			t.Fatal(errSign)
+		}
+		request := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+		request.Header.Set("Authorization", "Bearer "+accessToken)
+		recorder := httptest.NewRecorder()
+		provider.UserInfoHandler().ServeHTTP(recorder, request)
+
+		if recorder.Code != test.status {
+			t.Errorf("scope %q: got status %d, want %d", test.scope, recorder.Code, test.status)
+			continue
+		}
+		for _, field := range test.fields {
+			if !strings.Contains(recorder.Body.String(), field) {
+				t.Errorf("scope %q: %s missing from %s", test.scope, field, recorder.Body.String())
+			}
+		}
+		if test.scope == "openid" && strings.Contains(recorder.Body.String(), `"email"`) {
+			t.Errorf("scope %q: email leaked in %s", test.scope, recorder.Body.String())
+		}
+	}
+}
+
+func TestUserInfoHandlerRefusesLoginToken(t *testing.T) {
+	provider := newTestOAuthProvider(t)
+	claims := newTestAccount().newUserClaims(provider.jwtHandler.jwtTokenIssuer, time.Hour)
+	claims.Scope = ScopeOpenId
+	loginToken, errSign := signToken(provider.jwtHandler.jwtSecret, claims)
+	if errSign != nil {
+		t.Fatal(errSign)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+	request.Header.Set("Authorization", "Bearer "+loginToken)
+	recorder := httptest.NewRecorder()
+	provider.UserInfoHandler().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	codeVerifier := strings.Repeat("verifier-", 6)
+	sum := sha256.Sum256([]byte(codeVerifier))
+	codeChallenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	if !verifyCodeChallenge(codeChallenge, codeVerifier) {
+		t.Error("the matching code verifier did not verify")
+	}
+	if verifyCodeChallenge(codeChallenge, codeVerifier[:42]) {
+		t.Error("a code verifier shorter than 43 characters verified")
+	}
+	if verifyCodeChallenge(codeChallenge, strings.ToUpper(codeVerifier)) {
+		t.Error("a wrong code verifier verified")
+	}
+}
+
+// newTestOAuthFlow registers a third-party client the account consented to,
+// and signs that account in on every browser request.
+func newTestOAuthFlow(t *testing.T, scopes []string) (*OAuthProvider, *OAuthClientSQL, string, *AccountSQL) {
+	t.Helper()
+	db := newTestDB(t)
+	redis := newFakeRedis()
+	accounts := NewAccountManagerSQL(db, redis, testEntityName)
+	account := newTestMember("ada@example.com")
+	if err := accounts.Create(*account); err != nil {
+		t.Fatal(err)
+	}
+
+	clients := NewOAuthClientManagerSQL(db, testEntityName)
+	clientSecret, client, errRegister := clients.Register("Notebook", []string{"https://app.example.com/callback"}, scopes, false, false)
+	if errRegister != nil {
+		t.Fatal(errRegister)
+	}
+	if err := clients.GrantConsent(account, client.ClientId, scopes); err != nil {
+		t.Fatal(err)
+	}
+
+	var provider *OAuthProvider
+	provider = newTestOAuthProviderWith(t, redis, clients, accounts, OAuthProviderConfig{
+		Authenticate: func(w http.ResponseWriter, r *http.Request) (*UserClaims, error) {
+			claims := account.newUserClaims(provider.jwtHandler.jwtTokenIssuer, time.Hour)
+			return &claims, nil
+		},
+	})
+	return provider, client, clientSecret, account
+}
+
+// authorize runs the authorization endpoint and returns the redirect query.
+func authorize(t *testing.T, provider *OAuthProvider, client *OAuthClientSQL, scope string, codeVerifier string) url.Values {
+	t.Helper()
+	sum := sha256.Sum256([]byte(codeVerifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ClientId},
+		"redirect_uri":          {client.RedirectURIs[0]},
+		"scope":                 {scope},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {codeChallengeMethodS256},
+	}
+	recorder := httptest.NewRecorder()
+	provider.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/authorize?"+query.Encode(), nil))
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("got status %d from the authorization endpoint, want %d", recorder.Code, http.StatusFound)
+	}
+	location, errParse := url.Parse(recorder.Header().Get("Location"))
+	if errParse != nil {
+		t.Fatal(errParse)
+	}
+	return location.Query()
+}
+
+// exchange posts form to the token endpoint.
+func exchange(provider *OAuthProvider, form url.Values) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	provider.Handler().ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestOAuthAuthorizationCodeRoundTrip(t *testing.T) {
+	provider, client, clientSecret, account := newTestOAuthFlow(t, []string{ScopeOpenId, ScopeEmail, ScopeOfflineAccess})
+	codeVerifier := strings.Repeat("verifier-", 6)
+
+	redirect := authorize(t, provider, client, "openid email offline_access", codeVerifier)
+	if redirect.Get("state") != "xyz" || redirect.Get("code") == "" {
+		t.Fatalf("unexpected redirect %v", redirect)
+	}
+	recorder := exchange(provider, url.Values{
+		"grant_type":    {GrantTypeAuthorizationCode},
+		"code":          {redirect.Get("code")},
+		"redirect_uri":  {client.RedirectURIs[0]},
+		"code_verifier": {codeVerifier},
+		"client_id":     {client.ClientId},
+		"client_secret": {clientSecret},
+	})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d from the token endpoint: %s", recorder.Code, recorder.Body.String())
+	}
+	var tokens OAuthTokenResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if tokens.IdToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("missing tokens in %+v", tokens)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+	request.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	recorder = httptest.NewRecorder()
+	provider.Handler().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d from the userinfo endpoint", recorder.Code)
+	}
+	var userInfo map[string]any
+	if err := json.Unmarshal(recorder.Body.Bytes(), &userInfo); err != nil {
+		t.Fatal(err)
+	}
+	if userInfo["sub"] != account.GetUUID() || userInfo["email"] != account.Email {
+		t.Errorf("unexpected userinfo %v", userInfo)
+	}
+
+	if recorder := exchange(provider, url.Values{
+		"grant_type":    {GrantTypeAuthorizationCode},
+		"code":          {redirect.Get("code")},
+		"redirect_uri":  {client.RedirectURIs[0]},
+		"code_verifier": {codeVerifier},
+		"client_id":     {client.ClientId},
+		"client_secret": {clientSecret},
+	}); recorder.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a reused code, want %d", recorder.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOAuthRefreshTokenRequiresOfflineAccess(t *testing.T) {
+	provider, client, clientSecret, account := newTestOAuthFlow(t, []string{ScopeOpenId, ScopeOfflineAccess})
+
+	tests := []struct {
+		scopes  []string
+		refresh bool
+	}{
+		{scopes: []string{ScopeOpenId}, refresh: false},
+		{scopes: []string{ScopeOpenId, ScopeOfflineAccess}, refresh: true},
+	}
+	for _, test := range tests {
+		tokens, errIssue := provider.issueTokens(client, account.GetUUID(), test.scopes, "", time.Now())
+		if errIssue != nil {
+			t.Fatal(errIssue)
+		}
+		if (tokens.RefreshToken != "") != test.refresh {
+			t.Errorf("scopes %v: got refresh token %q, want one: %v", test.scopes, tokens.RefreshToken, test.refresh)
+		}
+	}
+
+	tokens, errIssue := provider.issueTokens(client, account.GetUUID(), []string{ScopeOpenId, ScopeOfflineAccess}, "", time.Now())
+	if errIssue != nil {
+		t.Fatal(errIssue)
+	}
+	if _, err := provider.ExchangeRefreshToken(client.ClientId, clientSecret, tokens.RefreshToken, ScopeOpenId); err != nil {
+		t.Errorf("narrowing the scope refused: %v", err)
+	}
+}
+
+func TestOAuthRefreshTokenStopsAfterConsentRevoked(t *testing.T) {
+	provider, client, clientSecret, account := newTestOAuthFlow(t, []string{ScopeOpenId, ScopeOfflineAccess})
+	tokens, errIssue := provider.issueTokens(client, account.GetUUID(), []string{ScopeOpenId, ScopeOfflineAccess}, "", time.Now())
+	if errIssue != nil {
+		t.Fatal(errIssue)
+	}
+
+	refreshed, errRefresh := provider.ExchangeRefreshToken(client.ClientId, clientSecret, tokens.RefreshToken, "")
+	if errRefresh != nil {
+		t.Fatal(errRefresh)
+	}
+	if err := provider.clients.RevokeConsent(account, client.ClientId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.ExchangeRefreshToken(client.ClientId, clientSecret, refreshed.RefreshToken, ""); !errors.Is(err, definition.InvalidToken) {
+		t.Fatalf("got %v after the consent was revoked, want %v", err, definition.InvalidToken)
+	}
+}
+
+func TestAuthorizeHandlerRefusesAPIKey(t *testing.T) {
+	provider, client, _, account := newTestOAuthFlow(t, []string{ScopeOpenId})
+	apiKeys, errManager := NewAPIKeyManagerSQL(provider.clients.db.DB, testEntityName, "ck_")
+	if errManager != nil {
+		t.Fatal(errManager)
+	}
+	key, _, errCreate := apiKeys.Create(account, "ci", []string{"reports:read"}, time.Time{})
+	if errCreate != nil {
+		t.Fatal(errCreate)
+	}
+	provider.config.Authenticate = func(w http.ResponseWriter, r *http.Request) (*UserClaims, error) {
+		return apiKeys.ParseAccessToken(key)
+	}
+
+	redirect := authorize(t, provider, client, ScopeOpenId, strings.Repeat("verifier-", 6))
+	if redirect.Get("error") != OAuthLoginRequired || redirect.Get("code") != "" {
+		t.Fatalf("an API key passed as a login: %v", redirect)
+	}
+}
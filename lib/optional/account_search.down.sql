@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS {{indexName "UsernameTrigram"}};
+
+DROP INDEX IF EXISTS {{indexName "Search"}};
+
+ALTER TABLE {{table ""}} DROP COLUMN IF EXISTS searchvector;
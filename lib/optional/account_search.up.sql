@@ -0,0 +1,11 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+ALTER TABLE {{table ""}} ADD COLUMN IF NOT EXISTS searchvector tsvector GENERATED ALWAYS AS (
+	setweight(to_tsvector('simple', coalesce(name, '')), 'A') ||
+	setweight(to_tsvector('simple', coalesce(username, '')), 'A') ||
+	setweight(to_tsvector('simple', coalesce(email, '')), 'B')
+) STORED;
+
+CREATE INDEX IF NOT EXISTS {{indexName "Search"}} ON {{table ""}} USING GIN (searchvector);
+
+CREATE INDEX IF NOT EXISTS {{indexName "UsernameTrigram"}} ON {{table ""}} USING GIN (username gin_trgm_ops);
@@ -0,0 +1,512 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"github.com/lefalya/commonuser/definition"
+	"github.com/lefalya/pageflow"
+	"time"
+)
+
+const (
+	OrganizationRoleOwner  = "owner"
+	OrganizationRoleAdmin  = "admin"
+	OrganizationRoleMember = "member"
+)
+
+type OrganizationSQL struct {
+	*pageflow.SQLItem `bson:",inline" json:",inline"`
+	Name              string `json:"name" db:"name"`
+	OwnerUUID         string `json:"owneruuid" db:"owneruuid"`
+}
+
+func NewOrganizationSQL() *OrganizationSQL {
+	organization := &OrganizationSQL{}
+	pageflow.InitSQLItem(organization)
+	return organization
+}
+
+type OrganizationMemberSQL struct {
+	OrganizationUUID string    `json:"organizationuuid" db:"organizationuuid"`
+	AccountUUID      string    `json:"accountuuid" db:"accountuuid"`
+	Role             string    `json:"role" db:"role"`
+	CreatedAt        time.Time `json:"createdat" db:"createdat"`
+}
+
+type OrganizationInvitationSQL struct {
+	*pageflow.SQLItem `bson:",inline" json:",inline"`
+	OrganizationUUID  string    `db:"organizationuuid"`
+	Email             string    `db:"email"`
+	Role              string    `db:"role"`
+	InvitedBy         string    `db:"invitedby"`
+	Token             string    `db:"token"`
+	ExpiredAt         time.Time `db:"expiredat"`
+}
+
+func (oi *OrganizationInvitationSQL) SetOrganizationUUID(organization *OrganizationSQL) {
+	oi.OrganizationUUID = organization.GetUUID()
+}
+
+func (oi *OrganizationInvitationSQL) SetEmail(email string) {
+	oi.Email = NormalizeEmail(email)
+}
+
+func (oi *OrganizationInvitationSQL) SetRole(role string) {
+	oi.Role = role
+}
+
+func (oi *OrganizationInvitationSQL) SetInvitedBy(account *AccountSQL) {
+	oi.InvitedBy = account.GetUUID()
+}
+
+func (oi *OrganizationInvitationSQL) SetToken() {
+	oi.Token = pageflow.RandId()
+}
+
+func (oi *OrganizationInvitationSQL) SetExpiredAt() {
+	oi.ExpiredAt = time.Now().UTC().Add(time.Hour * 24 * 7)
+}
+
+func (oi *OrganizationInvitationSQL) Validate(token string) error {
+	time := time.Now().UTC()
+	if time.After(oi.ExpiredAt) {
+		return definition.RequestExpired
+	}
+	if oi.Token != token {
+		return definition.InvalidToken
+	}
+	return nil
+}
+
+func NewOrganizationInvitationSQL() *OrganizationInvitationSQL {
+	invitation := &OrganizationInvitationSQL{}
+	pageflow.InitSQLItem(invitation)
+	return invitation
+}
+
+type OrganizationManagerSQL struct {
+	db             *sqlDB
+	entityName     string
+	notifier       Notifier
+	sessionManager *SessionManager
+}
+
+func (om *OrganizationManagerSQL) SetNotifier(notifier Notifier) {
+	om.notifier = notifier
+}
+
+// SetSessionManager makes SetActiveOrganization remember the organization in
+// the session, so refreshed tokens keep carrying it.
+func (om *OrganizationManagerSQL) SetSessionManager(sessionManager *SessionManager) {
+	om.sessionManager = sessionManager
+}
+
+// validateMemberRole only lets admin and member be granted; ownership moves
+// through TransferOwnership.
+func validateMemberRole(role string) error {
+	if role != OrganizationRoleAdmin && role != OrganizationRoleMember {
+		return definition.InvalidOrganizationRole
+	}
+	return nil
+}
+
+func (om *OrganizationManagerSQL) organizationTable() string {
+	return om.db.table(om.entityName + "Organization")
+}
+
+func (om *OrganizationManagerSQL) memberTable() string {
+	return om.db.table(om.entityName + "OrganizationMember")
+}
+
+func (om *OrganizationManagerSQL) invitationTable() string {
+	return om.db.table(om.entityName + "OrganizationInvitation")
+}
+
+// Create inserts the organization and makes owner its first member.
+func (om *OrganizationManagerSQL) Create(owner *AccountSQL, name string) (*OrganizationSQL, error) {
+	organization := NewOrganizationSQL()
+	organization.Name = name
+	organization.OwnerUUID = owner.GetUUID()
+
+	tx, errBegin := om.db.Begin()
+	if errBegin != nil {
+		return nil, errBegin
+	}
+	defer tx.Rollback()
+
+	query := "INSERT INTO " + om.organizationTable() + " (uuid, randId, createdat, updatedat, name, owneruuid) VALUES ($1, $2, $3, $4, $5, $6)"
+	_, errInsert := tx.Exec(query, organization.GetUUID(), organization.GetRandId(), organization.GetCreatedAt(), organization.GetUpdatedAt(), organization.Name, organization.OwnerUUID)
+	if errInsert != nil {
+		return nil, errInsert
+	}
+
+	errMember := om.insertMember(tx, organization.GetUUID(), owner.GetUUID(), OrganizationRoleOwner)
+	if errMember != nil {
+		return nil, errMember
+	}
+
+	errCommit := tx.Commit()
+	if errCommit != nil {
+		return nil, errCommit
+	}
+	return organization, nil
+}
+
+func (om *OrganizationManagerSQL) Find(organizationUUID string) (*OrganizationSQL, error) {
+	query := "SELECT uuid, randId, createdat, updatedat, name, owneruuid FROM " + om.organizationTable() + " WHERE uuid = $1"
+	organization := NewOrganizationSQL()
+	err := om.db.QueryRow(query, organizationUUID).Scan(
+		&organization.SQLItem.UUID,
+		&organization.SQLItem.RandId,
+		&organization.SQLItem.CreatedAt,
+		&organization.SQLItem.UpdatedAt,
+		&organization.Name,
+		&organization.OwnerUUID,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return organization, nil
+}
+
+func (om *OrganizationManagerSQL) Rename(organization *OrganizationSQL, name string) error {
+	query := "UPDATE " + om.organizationTable() + " SET name = $1, updatedat = $2 WHERE uuid = $3"
+	_, errUpdate := om.db.Exec(query, name, time.Now().UTC(), organization.GetUUID())
+	if errUpdate != nil {
+		return errUpdate
+	}
+	organization.Name = name
+	return nil
+}
+
+func (om *OrganizationManagerSQL) Delete(organization *OrganizationSQL) error {
+	queries := []string{
+		"DELETE FROM " + om.invitationTable() + " WHERE organizationuuid = $1",
+		"DELETE FROM " + om.memberTable() + " WHERE organizationuuid = $1",
+		"DELETE FROM " + om.organizationTable() + " WHERE uuid = $1",
+	}
+	ctx := context.Background()
+	return RunInTx(ctx, om.db.DB, func(tx *Tx) error {
+		for _, query := range queries {
+			_, errDelete := tx.ExecContext(ctx, query, organization.GetUUID())
+			if errDelete != nil {
+				return errDelete
+			}
+		}
+		return nil
+	})
+}
+
+func (om *OrganizationManagerSQL) insertMember(db sqlConn, organizationUUID string, accountUUID string, role string) error {
+	query := "INSERT INTO " + om.memberTable() + " (organizationuuid, accountuuid, role, createdat) VALUES ($1, $2, $3, $4)"
+	_, errInsert := db.ExecContext(context.Background(), query, organizationUUID, accountUUID, role, time.Now().UTC())
+	if errInsert != nil {
+		if db.dialect().IsUniqueViolation(errInsert) {
+			return definition.MemberExist
+		}
+		return errInsert
+	}
+	return nil
+}
+
+// AddMember adds account as admin or member; definition.InvalidOrganizationRole
+// refuses any other role, the owner included.
+func (om *OrganizationManagerSQL) AddMember(organization *OrganizationSQL, account *AccountSQL, role string) error {
+	errRole := validateMemberRole(role)
+	if errRole != nil {
+		return errRole
+	}
+	return om.insertMember(om.db, organization.GetUUID(), account.GetUUID(), role)
+}
+
+func (om *OrganizationManagerSQL) UpdateMemberRole(organization *OrganizationSQL, accountUUID string, role string) error {
+	if accountUUID == organization.OwnerUUID {
+		return definition.Forbidden
+	}
+	errRole := validateMemberRole(role)
+	if errRole != nil {
+		return errRole
+	}
+
+	query := "UPDATE " + om.memberTable() + " SET role = $1 WHERE organizationuuid = $2 AND accountuuid = $3"
+	result, errUpdate := om.db.Exec(query, role, organization.GetUUID(), accountUUID)
+	if errUpdate != nil {
+		return errUpdate
+	}
+	return requireAffected(result, definition.NotOrganizationMember)
+}
+
+// RemoveMember refuses to remove the owner; transfer the ownership first.
+func (om *OrganizationManagerSQL) RemoveMember(organization *OrganizationSQL, accountUUID string) error {
+	if accountUUID == organization.OwnerUUID {
+		return definition.Forbidden
+	}
+
+	query := "DELETE FROM " + om.memberTable() + " WHERE organizationuuid = $1 AND accountuuid = $2"
+	result, errDelete := om.db.Exec(query, organization.GetUUID(), accountUUID)
+	if errDelete != nil {
+		return errDelete
+	}
+	return requireAffected(result, definition.NotOrganizationMember)
+}
+
+func (om *OrganizationManagerSQL) FindMember(organizationUUID string, accountUUID string) (*OrganizationMemberSQL, error) {
+	query := "SELECT organizationuuid, accountuuid, role, createdat FROM " + om.memberTable() + " WHERE organizationuuid = $1 AND accountuuid = $2"
+	member := &OrganizationMemberSQL{}
+	err := om.db.QueryRow(query, organizationUUID, accountUUID).Scan(&member.OrganizationUUID, &member.AccountUUID, &member.Role, &member.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return member, nil
+}
+
+func (om *OrganizationManagerSQL) FindMembers(organization *OrganizationSQL) ([]OrganizationMemberSQL, error) {
+	query := "SELECT organizationuuid, accountuuid, role, createdat FROM " + om.memberTable() + " WHERE organizationuuid = $1 ORDER BY createdat"
+	return om.queryMembers(query, organization.GetUUID())
+}
+
+// FindMemberships lists every organization the account belongs to.
+func (om *OrganizationManagerSQL) FindMemberships(account *AccountSQL) ([]OrganizationMemberSQL, error) {
+	query := "SELECT organizationuuid, accountuuid, role, createdat FROM " + om.memberTable() + " WHERE accountuuid = $1 ORDER BY createdat"
+	return om.queryMembers(query, account.GetUUID())
+}
+
+func (om *OrganizationManagerSQL) queryMembers(query string, param string) ([]OrganizationMemberSQL, error) {
+	rows, errQuery := om.db.Query(query, param)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	var members []OrganizationMemberSQL
+	for rows.Next() {
+		member := OrganizationMemberSQL{}
+		errScan := rows.Scan(&member.OrganizationUUID, &member.AccountUUID, &member.Role, &member.CreatedAt)
+		if errScan != nil {
+			return nil, errScan
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// TransferOwnership hands the organization to an existing member; the previous
+// owner stays on as admin. definition.OwnershipChanged reports that organization
+// no longer names the current owner, e.g. after a concurrent transfer.
+func (om *OrganizationManagerSQL) TransferOwnership(organization *OrganizationSQL, newOwner *AccountSQL) error {
+	ctx := context.Background()
+	errTransfer := RunInTx(ctx, om.db.DB, func(tx *Tx) error {
+		var role string
+		query := "SELECT role FROM " + om.memberTable() + " WHERE organizationuuid = $1 AND accountuuid = $2"
+		errFind := tx.QueryRowContext(ctx, query, organization.GetUUID(), newOwner.GetUUID()).Scan(&role)
+		if errFind != nil {
+			if errFind == sql.ErrNoRows {
+				return definition.NotOrganizationMember
+			}
+			return errFind
+		}
+
+		update := "UPDATE " + om.organizationTable() + " SET owneruuid = $1, updatedat = $2 WHERE uuid = $3 AND owneruuid = $4"
+		result, errUpdate := tx.ExecContext(ctx, update, newOwner.GetUUID(), time.Now().UTC(), organization.GetUUID(), organization.OwnerUUID)
+		if errUpdate != nil {
+			return errUpdate
+		}
+		errAffected := requireAffected(result, definition.OwnershipChanged)
+		if errAffected != nil {
+			return errAffected
+		}
+
+		statements := []struct {
+			query string
+			args  []any
+		}{
+			{"UPDATE " + om.memberTable() + " SET role = $1 WHERE organizationuuid = $2 AND accountuuid = $3", []any{OrganizationRoleAdmin, organization.GetUUID(), organization.OwnerUUID}},
+			{"UPDATE " + om.memberTable() + " SET role = $1 WHERE organizationuuid = $2 AND accountuuid = $3", []any{OrganizationRoleOwner, organization.GetUUID(), newOwner.GetUUID()}},
+		}
+		for _, statement := range statements {
+			_, errExec := tx.ExecContext(ctx, statement.query, statement.args...)
+			if errExec != nil {
+				return errExec
+			}
+		}
+		return nil
+	})
+	if errTransfer != nil {
+		return errTransfer
+	}
+	organization.OwnerUUID = newOwner.GetUUID()
+	return nil
+}
+
+// CreateInvitation invites email into the organization with role and hands the
+// token to the notifier as Data["token"]. A pending invitation for the same
+// email is replaced.
+func (om *OrganizationManagerSQL) CreateInvitation(organization *OrganizationSQL, inviter *AccountSQL, email string, role string) (*OrganizationInvitationSQL, error) {
+	errRole := validateMemberRole(role)
+	if errRole != nil {
+		return nil, errRole
+	}
+
+	invitation := NewOrganizationInvitationSQL()
+	invitation.SetOrganizationUUID(organization)
+	invitation.SetEmail(email)
+	invitation.SetRole(role)
+	invitation.SetInvitedBy(inviter)
+	invitation.SetToken()
+	invitation.SetExpiredAt()
+
+	_, errDelete := om.db.Exec("DELETE FROM "+om.invitationTable()+" WHERE organizationuuid = $1 AND email = $2", invitation.OrganizationUUID, invitation.Email)
+	if errDelete != nil {
+		return nil, errDelete
+	}
+
+	query := "INSERT INTO " + om.invitationTable() + " (uuid, randId, createdat, updatedat, organizationuuid, email, role, invitedby, token, expiredat) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)"
+	_, errInsert := om.db.Exec(
+		query,
+		invitation.GetUUID(),
+		invitation.GetRandId(),
+		invitation.GetCreatedAt(),
+		invitation.GetUpdatedAt(),
+		invitation.OrganizationUUID,
+		invitation.Email,
+		invitation.Role,
+		invitation.InvitedBy,
+		invitation.Token,
+		invitation.ExpiredAt)
+	if errInsert != nil {
+		return nil, errInsert
+	}
+
+	if om.notifier != nil {
+		errNotify := notify(context.Background(), om.notifier, Notification{
+			Event:   NotificationOrganizationInvitation,
+			Account: inviter,
+			Data: map[string]string{
+				"organizationuuid": organization.GetUUID(),
+				"organization":     organization.Name,
+				"email":            invitation.Email,
+				"role":             invitation.Role,
+				"token":            invitation.Token,
+			},
+		})
+		if errNotify != nil {
+			return nil, errNotify
+		}
+	}
+	return invitation, nil
+}
+
+func (om *OrganizationManagerSQL) FindInvitation(organizationUUID string, email string) (*OrganizationInvitationSQL, error) {
+	query := "SELECT uuid, randId, createdat, updatedat, organizationuuid, email, role, invitedby, token, expiredat FROM " + om.invitationTable() + " WHERE organizationuuid = $1 AND email = $2"
+	invitation := NewOrganizationInvitationSQL()
+	err := om.db.QueryRow(query, organizationUUID, NormalizeEmail(email)).Scan(
+		&invitation.SQLItem.UUID,
+		&invitation.SQLItem.RandId,
+		&invitation.SQLItem.CreatedAt,
+		&invitation.SQLItem.UpdatedAt,
+		&invitation.OrganizationUUID,
+		&invitation.Email,
+		&invitation.Role,
+		&invitation.InvitedBy,
+		&invitation.Token,
+		&invitation.ExpiredAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return invitation, nil
+}
+
+func (om *OrganizationManagerSQL) DeleteInvitation(invitation *OrganizationInvitationSQL) error {
+	query := "DELETE FROM " + om.invitationTable() + " WHERE uuid = $1"
+	_, errDelete := om.db.Exec(query, invitation.GetUUID())
+	if errDelete != nil {
+		return errDelete
+	}
+	return nil
+}
+
+// AcceptInvitation joins account to the organization it was invited to by email.
+// The membership and the consumed invitation commit together, so an invitation
+// accepted concurrently only adds one member.
+func (om *OrganizationManagerSQL) AcceptInvitation(organizationUUID string, account *AccountSQL, token string) error {
+	invitation, errFind := om.FindInvitation(organizationUUID, account.Email)
+	if errFind != nil {
+		return errFind
+	}
+	if invitation == nil {
+		return definition.RequestNotFound
+	}
+
+	errValidate := invitation.Validate(token)
+	if errValidate != nil {
+		if errValidate == definition.RequestExpired {
+			om.DeleteInvitation(invitation)
+		}
+		return errValidate
+	}
+
+	ctx := context.Background()
+	return RunInTx(ctx, om.db.DB, func(tx *Tx) error {
+		query := "DELETE FROM " + om.invitationTable() + " WHERE uuid = $1 AND token = $2"
+		result, errDelete := tx.ExecContext(ctx, query, invitation.GetUUID(), invitation.Token)
+		if errDelete != nil {
+			return errDelete
+		}
+		errAffected := requireAffected(result, definition.RequestNotFound)
+		if errAffected != nil {
+			return errAffected
+		}
+		return om.insertMember(tx, organizationUUID, account.GetUUID(), invitation.Role)
+	})
+}
+
+// SetActiveOrganization selects the organization carried by the account's next
+// access tokens. An empty organizationUUID clears it. With SetSessionManager the
+// choice is stored in the session sessionId, so token refreshes keep it.
+func (om *OrganizationManagerSQL) SetActiveOrganization(account *AccountSQL, sessionId string, organizationUUID string) error {
+	if organizationUUID != "" {
+		member, errFind := om.FindMember(organizationUUID, account.GetUUID())
+		if errFind != nil {
+			return errFind
+		}
+		if member == nil {
+			return definition.NotOrganizationMember
+		}
+	}
+	if om.sessionManager != nil && sessionId != "" {
+		errSession := om.sessionManager.SetOrganization(account.GetUUID(), sessionId, organizationUUID)
+		if errSession != nil {
+			return errSession
+		}
+	}
+	account.ActiveOrganization = organizationUUID
+	return nil
+}
+
+func NewOrganizationManagerSQL(db *sql.DB, entityName string) *OrganizationManagerSQL {
+	return &OrganizationManagerSQL{
+		db:         newSQLDB(db),
+		entityName: entityName,
+	}
+}
+
+func requireAffected(result sql.Result, errNone error) error {
+	affected, errAffected := result.RowsAffected()
+	if errAffected != nil {
+		return errAffected
+	}
+	if affected == 0 {
+		return errNone
+	}
+	return nil
+}
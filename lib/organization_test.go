@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"errors"
+	"github.com/lefalya/commonuser/definition"
+	"testing"
+)
+
+func TestMemberRoleMustBeAdminOrMember(t *testing.T) {
+	organizations := NewOrganizationManagerSQL(nil, "test")
+	organization := &OrganizationSQL{OwnerUUID: "owner"}
+	account := newTestAccount()
+
+	for _, role := range []string{OrganizationRoleOwner, "", "superuser"} {
+		if err := organizations.AddMember(organization, account, role); !errors.Is(err, definition.InvalidOrganizationRole) {
+			t.Errorf("AddMember with role %q: got %v, want %v", role, err, definition.InvalidOrganizationRole)
+		}
+		if err := organizations.UpdateMemberRole(organization, account.GetUUID(), role); !errors.Is(err, definition.InvalidOrganizationRole) {
+			t.Errorf("UpdateMemberRole with role %q: got %v, want %v", role, err, definition.InvalidOrganizationRole)
+		}
+		if _, err := organizations.CreateInvitation(organization, account, "bob@example.com", role); !errors.Is(err, definition.InvalidOrganizationRole) {
+			t.Errorf("CreateInvitation with role %q: got %v, want %v", role, err, definition.InvalidOrganizationRole)
+		}
+	}
+}
+
+func newTestMember(email string) *AccountSQL {
+	account := NewAccountSQL()
+	account.SetEmail(email)
+	return account
+}
+
+func TestTransferOwnership(t *testing.T) {
+	organizations := NewOrganizationManagerSQL(newTestDB(t), testEntityName)
+	owner, admin, outsider := newTestMember("owner@example.com"), newTestMember("admin@example.com"), newTestMember("outsider@example.com")
+
+	organization, errCreate := organizations.Create(owner, "Analytical Engines")
+	if errCreate != nil {
+		t.Fatal(errCreate)
+	}
+	if err := organizations.AddMember(organization, admin, OrganizationRoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	stale := *organization
+
+	if err := organizations.TransferOwnership(organization, outsider); !errors.Is(err, definition.NotOrganizationMember) {
+		t.Errorf("got %v for a non-member, want %v", err, definition.NotOrganizationMember)
+	}
+	if err := organizations.TransferOwnership(organization, admin); err != nil {
+		t.Fatal(err)
+	}
+	if err := organizations.TransferOwnership(&stale, admin); !errors.Is(err, definition.OwnershipChanged) {
+		t.Errorf("got %v for a stale owner, want %v", err, definition.OwnershipChanged)
+	}
+
+	stored, errFind := organizations.Find(organization.GetUUID())
+	if errFind != nil || stored.OwnerUUID != admin.GetUUID() {
+		t.Fatalf("owner not transferred: %+v, %v", stored, errFind)
+	}
+	for account, role := range map[*AccountSQL]string{owner: OrganizationRoleAdmin, admin: OrganizationRoleOwner} {
+		member, errMember := organizations.FindMember(organization.GetUUID(), account.GetUUID())
+		if errMember != nil || member == nil || member.Role != role {
+			t.Errorf("%s: got %+v, %v, want role %s", account.Email, member, errMember, role)
+		}
+	}
+}
+
+func TestAcceptInvitationIsSingleUse(t *testing.T) {
+	organizations := NewOrganizationManagerSQL(newTestDB(t), testEntityName)
+	owner, invitee := newTestMember("owner@example.com"), newTestMember("invitee@example.com")
+
+	organization, errCreate := organizations.Create(owner, "Analytical Engines")
+	if errCreate != nil {
+		t.Fatal(errCreate)
+	}
+	invitation, errInvite := organizations.CreateInvitation(organization, owner, invitee.Email, OrganizationRoleMember)
+	if errInvite != nil {
+		t.Fatal(errInvite)
+	}
+
+	if err := organizations.AcceptInvitation(organization.GetUUID(), invitee, "wrong"); !errors.Is(err, definition.InvalidToken) {
+		t.Errorf("got %v for a wrong token, want %v", err, definition.InvalidToken)
+	}
+	if err := organizations.AcceptInvitation(organization.GetUUID(), invitee, invitation.Token); err != nil {
+		t.Fatal(err)
+	}
+	if err := organizations.AcceptInvitation(organization.GetUUID(), invitee, invitation.Token); !errors.Is(err, definition.RequestNotFound) {
+		t.Errorf("got %v for a used invitation, want %v", err, definition.RequestNotFound)
+	}
+
+	member, errMember := organizations.FindMember(organization.GetUUID(), invitee.GetUUID())
+	if errMember != nil || member == nil || member.Role != OrganizationRoleMember {
+		t.Errorf("got %+v, %v", member, errMember)
+	}
+}
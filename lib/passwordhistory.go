@@ -0,0 +1,213 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"github.com/lefalya/commonuser/definition"
+	"github.com/lefalya/pageflow"
+	"github.com/matthewhartstonge/argon2"
+)
+
+type PasswordHistorySQL struct {
+	*pageflow.SQLItem `bson:",inline" json:",inline"`
+	AccountUUID       string `db:"accountuuid"`
+	Password          string `json:"-" db:"password"`
+}
+
+func NewPasswordHistorySQL() *PasswordHistorySQL {
+	history := &PasswordHistorySQL{}
+	pageflow.InitSQLItem(history)
+	return history
+}
+
+// PasswordHistoryManagerSQL keeps the last `depth` argon2 hashes of every account
+// so that a new password can be checked for reuse.
+type PasswordHistoryManagerSQL struct {
+	db         *sqlDB
+	entityName string
+	depth      int
+	tx         *Tx
+}
+
+// WithTx returns a copy of the manager that works inside tx.
+func (ph *PasswordHistoryManagerSQL) WithTx(tx *Tx) *PasswordHistoryManagerSQL {
+	bound := *ph
+	bound.tx = tx
+	return &bound
+}
+
+func (ph *PasswordHistoryManagerSQL) conn() sqlConn {
+	if ph.tx != nil {
+		return ph.tx
+	}
+	return ph.db
+}
+
+func (ph *PasswordHistoryManagerSQL) tableName() string {
+	return ph.db.table(ph.entityName + "PasswordHistory")
+}
+
+func (ph *PasswordHistoryManagerSQL) Record(account *AccountSQL) error {
+	return ph.RecordContext(context.Background(), account)
+}
+
+func (ph *PasswordHistoryManagerSQL) RecordContext(ctx context.Context, account *AccountSQL) error {
+	history := NewPasswordHistorySQL()
+	history.AccountUUID = account.GetUUID()
+	history.Password = account.Password
+
+	query := "INSERT INTO " + ph.tableName() + " (uuid, randId, createdat, updatedat, accountuuid, password) VALUES ($1, $2, $3, $4, $5, $6)"
+	_, errInsert := ph.conn().ExecContext(
+		ctx,
+		query,
+		history.GetUUID(),
+		history.GetRandId(),
+		history.GetCreatedAt(),
+		history.GetUpdatedAt(),
+		history.AccountUUID,
+		history.Password)
+	if errInsert != nil {
+		return errInsert
+	}
+
+	return ph.PruneContext(ctx, account)
+}
+
+func (ph *PasswordHistoryManagerSQL) FindRecent(account *AccountSQL) ([]PasswordHistorySQL, error) {
+	return ph.FindRecentContext(context.Background(), account)
+}
+
+func (ph *PasswordHistoryManagerSQL) FindRecentContext(ctx context.Context, account *AccountSQL) ([]PasswordHistorySQL, error) {
+	query := "SELECT uuid, randId, createdat, updatedat, accountuuid, password FROM " + ph.tableName() + " WHERE accountuuid = $1 ORDER BY createdat DESC LIMIT $2"
+	rows, errQuery := ph.conn().QueryContext(ctx, query, account.GetUUID(), ph.depth)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	var histories []PasswordHistorySQL
+	for rows.Next() {
+		history := NewPasswordHistorySQL()
+		errScan := rows.Scan(
+			&history.SQLItem.UUID,
+			&history.SQLItem.RandId,
+			&history.SQLItem.CreatedAt,
+			&history.SQLItem.UpdatedAt,
+			&history.AccountUUID,
+			&history.Password,
+		)
+		if errScan != nil {
+			return nil, errScan
+		}
+		histories = append(histories, *history)
+	}
+	return histories, rows.Err()
+}
+
+// IsReused reports whether password matches the account's current password or
+// any of its last `depth` previous passwords.
+func (ph *PasswordHistoryManagerSQL) IsReused(account *AccountSQL, password string) (bool, error) {
+	return ph.IsReusedContext(context.Background(), account, password)
+}
+
+func (ph *PasswordHistoryManagerSQL) IsReusedContext(ctx context.Context, account *AccountSQL, password string) (bool, error) {
+	hashes := []string{}
+	if account.IsPasswordExist() {
+		hashes = append(hashes, account.Password)
+	}
+
+	histories, errFind := ph.FindRecentContext(ctx, account)
+	if errFind != nil {
+		return false, errFind
+	}
+	for _, history := range histories {
+		hashes = append(hashes, history.Password)
+	}
+
+	for _, hash := range hashes {
+		match, errVerify := argon2.VerifyEncoded([]byte(password), []byte(hash))
+		if errVerify != nil {
+			return false, errVerify
+		}
+		if match {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Prune deletes every history row of the account beyond the configured depth.
+func (ph *PasswordHistoryManagerSQL) Prune(account *AccountSQL) error {
+	return ph.PruneContext(context.Background(), account)
+}
+
+func (ph *PasswordHistoryManagerSQL) PruneContext(ctx context.Context, account *AccountSQL) error {
+	// the derived table lets MySQL accept a LIMIT inside the subquery
+	query := "DELETE FROM " + ph.tableName() + " WHERE accountuuid = $1 AND uuid NOT IN (SELECT uuid FROM (SELECT uuid FROM " + ph.tableName() + " WHERE accountuuid = $1 ORDER BY createdat DESC LIMIT $2) AS recent)"
+	_, errDelete := ph.conn().ExecContext(ctx, query, account.GetUUID(), ph.depth)
+	if errDelete != nil {
+		return errDelete
+	}
+	return nil
+}
+
+func (ph *PasswordHistoryManagerSQL) DeleteAll(account *AccountSQL) error {
+	return ph.DeleteAllContext(context.Background(), account)
+}
+
+func (ph *PasswordHistoryManagerSQL) DeleteAllContext(ctx context.Context, account *AccountSQL) error {
+	query := "DELETE FROM " + ph.tableName() + " WHERE accountuuid = $1"
+	_, errDelete := ph.conn().ExecContext(ctx, query, account.GetUUID())
+	if errDelete != nil {
+		return errDelete
+	}
+	return nil
+}
+
+func NewPasswordHistoryManagerSQL(db *sql.DB, entityName string, depth int) *PasswordHistoryManagerSQL {
+	return &PasswordHistoryManagerSQL{
+		db:         newSQLDB(db),
+		entityName: entityName,
+		depth:      depth,
+	}
+}
+
+// applyNewPassword validates password against policy and history, then hashes it
+// into account. The caller persists it with storePassword.
+func applyNewPassword(ctx context.Context, account *AccountSQL, password string, policy *PasswordPolicy, history *PasswordHistoryManagerSQL) error {
+	if policy != nil {
+		errValidate := policy.Validate(password, account.Base)
+		if errValidate != nil {
+			return errValidate
+		}
+	}
+
+	if history != nil {
+		reused, errReused := history.IsReusedContext(ctx, account, password)
+		if errReused != nil {
+			return errReused
+		}
+		if reused {
+			return definition.PasswordReused
+		}
+	}
+
+	return account.SetPassword(password)
+}
+
+func storePassword(ctx context.Context, db sqlConn, entityName string, account *AccountSQL, history *PasswordHistoryManagerSQL) error {
+	query := "UPDATE " + db.table(entityName) + " SET updatedat = $1, password = $2, passwordupdatedat = $3, mustchangepassword = $4 WHERE uuid = $5 AND deletedat IS NULL"
+	result, errUpdate := db.ExecContext(ctx, query, account.PasswordUpdatedAt, account.Password, account.PasswordUpdatedAt, account.MustChangePassword, account.GetUUID())
+	if errUpdate != nil {
+		return errUpdate
+	}
+	errAffected := requireAffected(result, definition.AccountNotFound)
+	if errAffected != nil {
+		return errAffected
+	}
+
+	if history != nil {
+		return history.RecordContext(ctx, account)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/lefalya/commonuser/definition"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	PasswordTooShort            = "password_too_short"
+	PasswordTooLong             = "password_too_long"
+	PasswordMissingUpper        = "password_missing_upper"
+	PasswordMissingLower        = "password_missing_lower"
+	PasswordMissingDigit        = "password_missing_digit"
+	PasswordMissingSymbol       = "password_missing_symbol"
+	PasswordTooWeak             = "password_too_weak"
+	PasswordContainsPersonal    = "password_contains_personal_info"
+	PasswordFoundInBreachedList = "password_breached"
+)
+
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError carries every rule the password failed, so the UI can
+// render them all at once. It matches definition.PasswordPolicyViolated with errors.Is.
+type PasswordPolicyError struct {
+	Violations []PasswordViolation `json:"violations"`
+}
+
+func (pe *PasswordPolicyError) Error() string {
+	messages := make([]string, 0, len(pe.Violations))
+	for _, violation := range pe.Violations {
+		messages = append(messages, violation.Message)
+	}
+	return definition.PasswordPolicyViolated.Error() + ": " + strings.Join(messages, "; ")
+}
+
+func (pe *PasswordPolicyError) Unwrap() error {
+	return definition.PasswordPolicyViolated
+}
+
+func (pe *PasswordPolicyError) Has(code string) bool {
+	for _, violation := range pe.Violations {
+		if violation.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+type PasswordPolicy struct {
+	MinLength          int
+	MaxLength          int
+	RequireUpper       bool
+	RequireLower       bool
+	RequireDigit       bool
+	RequireSymbol      bool
+	MinStrength        int // 0 - 4, see EstimatePasswordStrength
+	RejectPersonalInfo bool
+	BreachedPasswords  *BreachedPasswordList
+}
+
+func (pp *PasswordPolicy) Validate(password string, base *Base) error {
+	var violations []PasswordViolation
+	addViolation := func(code string, message string) {
+		violations = append(violations, PasswordViolation{Code: code, Message: message})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if pp.MinLength > 0 && length < pp.MinLength {
+		addViolation(PasswordTooShort, fmt.Sprintf("password must be at least %d characters", pp.MinLength))
+	}
+	if pp.MaxLength > 0 && length > pp.MaxLength {
+		// the remaining checks get expensive on long input, an oversized password
+		// fails right away
+		addViolation(PasswordTooLong, fmt.Sprintf("password must be at most %d characters", pp.MaxLength))
+		return &PasswordPolicyError{Violations: violations}
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+	if pp.RequireUpper && !hasUpper {
+		addViolation(PasswordMissingUpper, "password must contain an uppercase letter")
+	}
+	if pp.RequireLower && !hasLower {
+		addViolation(PasswordMissingLower, "password must contain a lowercase letter")
+	}
+	if pp.RequireDigit && !hasDigit {
+		addViolation(PasswordMissingDigit, "password must contain a digit")
+	}
+	if pp.RequireSymbol && !hasSymbol {
+		addViolation(PasswordMissingSymbol, "password must contain a symbol")
+	}
+
+	personalInfo := personalInputs(base)
+	if pp.RejectPersonalInfo {
+		lowered := strings.ToLower(password)
+		for _, input := range personalInfo {
+			if strings.Contains(lowered, input) {
+				addViolation(PasswordContainsPersonal, "password must not contain your name, username or email")
+				break
+			}
+		}
+	}
+
+	if pp.MinStrength > 0 && EstimatePasswordStrength(password, personalInfo...) < pp.MinStrength {
+		addViolation(PasswordTooWeak, "password is too easy to guess")
+	}
+
+	if pp.BreachedPasswords != nil && password != "" {
+		breached, err := pp.BreachedPasswords.Contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			addViolation(PasswordFoundInBreachedList, "password has appeared in a data breach")
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// personalInputs collects the lowercased name parts, username and email local
+// part of an account, skipping anything too short to be meaningful.
+func personalInputs(base *Base) []string {
+	if base == nil {
+		return nil
+	}
+
+	var candidates []string
+	candidates = append(candidates, strings.Fields(base.Name)...)
+	candidates = append(candidates, base.Username)
+	if at := strings.LastIndex(base.Email, "@"); at > 0 {
+		candidates = append(candidates, base.Email[:at])
+	}
+
+	inputs := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		candidate = strings.ToLower(strings.TrimSpace(candidate))
+		if utf8.RuneCountInString(candidate) >= 3 {
+			inputs = append(inputs, candidate)
+		}
+	}
+	return inputs
+}
+
+func DefaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{
+		MinLength:          8,
+		MaxLength:          128,
+		MinStrength:        2,
+		RejectPersonalInfo: true,
+	}
+}
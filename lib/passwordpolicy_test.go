@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"errors"
+	"github.com/lefalya/commonuser/definition"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyViolations(t *testing.T) {
+	base := &Base{Name: "Ada Lovelace", Username: "ada", Email: "countess@example.com"}
+	strict := &PasswordPolicy{
+		MinLength:          10,
+		MaxLength:          64,
+		RequireUpper:       true,
+		RequireLower:       true,
+		RequireDigit:       true,
+		RequireSymbol:      true,
+		RejectPersonalInfo: true,
+	}
+
+	tests := []struct {
+		name       string
+		policy     *PasswordPolicy
+		password   string
+		violations []string
+	}{
+		{name: "compliant", policy: strict, password: "Tr1cky-Ferns-Glow", violations: nil},
+		{name: "short", policy: strict, password: "Ab1-", violations: []string{PasswordTooShort}},
+		{name: "long", policy: strict, password: strings.Repeat("Ab1-", 20), violations: []string{PasswordTooLong}},
+		{name: "character classes", policy: strict, password: "aaaaaaaaaaaa", violations: []string{PasswordMissingUpper, PasswordMissingDigit, PasswordMissingSymbol}},
+		{name: "name", policy: strict, password: "Lovelace-2024!", violations: []string{PasswordContainsPersonal}},
+		{name: "email local part", policy: strict, password: "Countess-2024!", violations: []string{PasswordContainsPersonal}},
+		{name: "weak", policy: &PasswordPolicy{MinStrength: 3}, password: "password1", violations: []string{PasswordTooWeak}},
+		{name: "zero policy", policy: &PasswordPolicy{}, password: "", violations: nil},
+	}
+	for _, test := range tests {
+		errValidate := test.policy.Validate(test.password, base)
+		if test.violations == nil {
+			if errValidate != nil {
+				t.Errorf("%s: unexpected error %v", test.name, errValidate)
+			}
+			continue
+		}
+
+		var policyError *PasswordPolicyError
+		if !errors.As(errValidate, &policyError) {
+			t.Errorf("%s: got %v, want a PasswordPolicyError", test.name, errValidate)
+			continue
+		}
+		if !errors.Is(errValidate, definition.PasswordPolicyViolated) {
+			t.Errorf("%s: %v does not match definition.PasswordPolicyViolated", test.name, errValidate)
+		}
+		if len(policyError.Violations) != len(test.violations) {
+			t.Errorf("%s: got violations %+v, want %v", test.name, policyError.Violations, test.violations)
+			continue
+		}
+		for _, code := range test.violations {
+			if !policyError.Has(code) {
+				t.Errorf("%s: violation %s missing from %+v", test.name, code, policyError.Violations)
+			}
+		}
+	}
+}
+
+func TestPersonalInputsSkipsShortParts(t *testing.T) {
+	inputs := personalInputs(&Base{Name: "Jo Ann Smith", Username: "js", Email: "jo.smith@example.com"})
+	want := []string{"ann", "smith", "jo.smith"}
+	if strings.Join(inputs, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", inputs, want)
+	}
+	if personalInputs(nil) != nil {
+		t.Error("a nil base produced inputs")
+	}
+}
@@ -0,0 +1,258 @@
+package lib
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// commonPasswords is ordered by popularity; a match costs its rank in guesses.
+var commonPasswords = []string{
+	"password", "123456", "12345678", "qwerty", "123456789", "12345", "1234", "111111",
+	"1234567", "dragon", "123123", "baseball", "abc123", "football", "monkey", "letmein",
+	"696969", "shadow", "master", "666666", "qwertyuiop", "123321", "mustang", "1234567890",
+	"michael", "654321", "superman", "1qaz2wsx", "7777777", "121212", "000000", "qazwsx",
+	"123qwe", "killer", "trustno1", "jordan", "jennifer", "zxcvbnm", "asdfgh", "hunter",
+	"buster", "soccer", "harley", "batman", "andrew", "tigger", "sunshine", "iloveyou",
+	"2000", "charlie", "robert", "thomas", "hockey", "ranger", "daniel", "starwars",
+	"klaster", "112233", "george", "computer", "michelle", "jessica", "pepper", "1111",
+	"zxcvbn", "555555", "11111111", "131313", "freedom", "777777", "pass", "maggie",
+	"159753", "aaaaaa", "ginger", "princess", "joshua", "cheese", "amanda", "summer",
+	"love", "ashley", "nicole", "chelsea", "biteme", "matthew", "access", "yankees",
+	"987654321", "dallas", "austin", "thunder", "taylor", "matrix", "welcome", "admin",
+	"login", "secret", "passw0rd", "changeme", "default", "letmein1", "hello", "world",
+}
+
+var keyboardRows = []string{
+	"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm",
+}
+
+var leetSubstitutions = map[rune]rune{
+	'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '1': 'i', '!': 'i',
+	'|': 'l', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't', '2': 'z',
+}
+
+// maxEstimatedLength bounds the work of EstimatePasswordStrength, whose
+// matchers look at every substring. Longer passwords are scored on their prefix,
+// which can only underestimate them.
+const maxEstimatedLength = 128
+
+type strengthMatch struct {
+	start int
+	end   int
+	bits  float64
+}
+
+// EstimatePasswordStrength scores a password from 0 (trivially guessable) to 4
+// (very strong) in the spirit of zxcvbn: the password is segmented into the
+// cheapest combination of dictionary words, user inputs, repeats, sequences,
+// keyboard runs, years and brute-forced characters, and the resulting guess
+// count is bucketed.
+func EstimatePasswordStrength(password string, userInputs ...string) int {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return 0
+	}
+	if len(runes) > maxEstimatedLength {
+		runes = runes[:maxEstimatedLength]
+	}
+
+	matches := dictionaryMatches(runes, userInputs)
+	matches = append(matches, repeatMatches(runes)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, keyboardMatches(runes)...)
+	matches = append(matches, yearMatches(runes)...)
+
+	bruteforceBits := math.Log2(float64(characterPool(runes)))
+	cost := make([]float64, len(runes)+1)
+	for i := 1; i <= len(runes); i++ {
+		cost[i] = cost[i-1] + bruteforceBits
+		for _, match := range matches {
+			if match.end == i {
+				// one extra bit per segment accounts for guessing how the pieces are joined
+				cost[i] = math.Min(cost[i], cost[match.start]+match.bits+1)
+			}
+		}
+	}
+
+	guessBits := cost[len(runes)]
+	switch {
+	case guessBits < math.Log2(1e3):
+		return 0
+	case guessBits < math.Log2(1e6):
+		return 1
+	case guessBits < math.Log2(1e8):
+		return 2
+	case guessBits < math.Log2(1e10):
+		return 3
+	default:
+		return 4
+	}
+}
+
+func characterPool(runes []rune) int {
+	var hasLower, hasUpper, hasDigit, hasSymbol, hasOther bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			hasLower = true
+		case r >= 'A' && r <= 'Z':
+			hasUpper = true
+		case r >= '0' && r <= '9':
+			hasDigit = true
+		case r < unicode.MaxASCII:
+			hasSymbol = true
+		default:
+			hasOther = true
+		}
+	}
+
+	pool := 0
+	if hasLower {
+		pool += 26
+	}
+	if hasUpper {
+		pool += 26
+	}
+	if hasDigit {
+		pool += 10
+	}
+	if hasSymbol {
+		pool += 33
+	}
+	if hasOther {
+		pool += 100
+	}
+	return pool
+}
+
+func dictionaryMatches(runes []rune, userInputs []string) []strengthMatch {
+	ranked := make(map[string]int, len(commonPasswords)+len(userInputs))
+	for i, input := range userInputs {
+		input = strings.ToLower(input)
+		if _, exist := ranked[input]; !exist && input != "" {
+			ranked[input] = i + 1
+		}
+	}
+	for i, word := range commonPasswords {
+		if _, exist := ranked[word]; !exist {
+			ranked[word] = i + 1
+		}
+	}
+
+	lowered := make([]rune, len(runes))
+	unleeted := make([]rune, len(runes))
+	for i, r := range runes {
+		lowered[i] = unicode.ToLower(r)
+		unleeted[i] = lowered[i]
+		if substitute, ok := leetSubstitutions[lowered[i]]; ok {
+			unleeted[i] = substitute
+		}
+	}
+
+	var matches []strengthMatch
+	for start := 0; start < len(runes); start++ {
+		for end := start + 3; end <= len(runes); end++ {
+			plain := string(lowered[start:end])
+			rank, found := ranked[plain]
+			variations := 1.0
+			if !found {
+				rank, found = ranked[string(unleeted[start:end])]
+				variations = 2
+			}
+			if !found {
+				continue
+			}
+			if string(runes[start:end]) != plain {
+				variations *= 2
+			}
+			matches = append(matches, strengthMatch{start: start, end: end, bits: math.Log2(float64(rank) * variations)})
+		}
+	}
+	return matches
+}
+
+func repeatMatches(runes []rune) []strengthMatch {
+	var matches []strengthMatch
+	for start := 0; start < len(runes); {
+		end := start + 1
+		for end < len(runes) && runes[end] == runes[start] {
+			end++
+		}
+		if end-start >= 3 {
+			pool := characterPool(runes[start : start+1])
+			matches = append(matches, strengthMatch{start: start, end: end, bits: math.Log2(float64(pool * (end - start)))})
+		}
+		start = end
+	}
+	return matches
+}
+
+func sequenceMatches(runes []rune) []strengthMatch {
+	var matches []strengthMatch
+	for start := 0; start < len(runes)-2; {
+		delta := runes[start+1] - runes[start]
+		end := start + 1
+		if delta == 1 || delta == -1 {
+			for end < len(runes) && runes[end]-runes[end-1] == delta {
+				end++
+			}
+		}
+		if end-start >= 3 {
+			startGuesses := 26.0
+			switch {
+			case runes[start] == 'a' || runes[start] == 'A' || runes[start] == '0' || runes[start] == '1':
+				startGuesses = 4
+			case unicode.IsDigit(runes[start]):
+				startGuesses = 10
+			}
+			if delta < 0 {
+				startGuesses *= 2
+			}
+			matches = append(matches, strengthMatch{start: start, end: end, bits: math.Log2(startGuesses * float64(end-start))})
+			start = end
+			continue
+		}
+		start++
+	}
+	return matches
+}
+
+func keyboardMatches(runes []rune) []strengthMatch {
+	lowered := strings.ToLower(string(runes))
+	loweredRunes := []rune(lowered)
+
+	var matches []strengthMatch
+	for start := 0; start < len(loweredRunes); start++ {
+		for end := start + 3; end <= len(loweredRunes); end++ {
+			segment := string(loweredRunes[start:end])
+			for _, row := range keyboardRows {
+				if strings.Contains(row, segment) || strings.Contains(reverseString(row), segment) {
+					matches = append(matches, strengthMatch{start: start, end: end, bits: math.Log2(float64(len(keyboardRows) * len(row) * (end - start)))})
+					break
+				}
+			}
+		}
+	}
+	return matches
+}
+
+func yearMatches(runes []rune) []strengthMatch {
+	var matches []strengthMatch
+	for start := 0; start+4 <= len(runes); start++ {
+		segment := string(runes[start : start+4])
+		if (strings.HasPrefix(segment, "19") || strings.HasPrefix(segment, "20")) &&
+			unicode.IsDigit(runes[start+2]) && unicode.IsDigit(runes[start+3]) {
+			matches = append(matches, strengthMatch{start: start, end: start + 4, bits: math.Log2(120)})
+		}
+	}
+	return matches
+}
+
+func reverseString(value string) string {
+	runes := []rune(value)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
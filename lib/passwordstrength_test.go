@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEstimatePasswordStrength(t *testing.T) {
+	tests := []struct {
+		password   string
+		userInputs []string
+		min        int
+		max        int
+	}{
+		{password: "", min: 0, max: 0},
+		{password: "password", min: 0, max: 0},
+		{password: "P@ssw0rd", min: 0, max: 1},
+		{password: "qwertyuiop", min: 0, max: 1},
+		{password: "aaaaaaaaaaaa", min: 0, max: 1},
+		{password: "abcdefgh", min: 0, max: 1},
+		{password: "1987", min: 0, max: 0},
+		{password: "Lovelace", userInputs: []string{"lovelace"}, min: 0, max: 0},
+		{password: "k7#Vq2!mZp9$Lr", min: 4, max: 4},
+		{password: "staple-Orbit-quiet-Heron-91", min: 3, max: 4},
+		{password: strings.Repeat("x", 10000), min: 0, max: 1},
+	}
+	for _, test := range tests {
+		score := EstimatePasswordStrength(test.password, test.userInputs...)
+		if score < test.min || score > test.max {
+			t.Errorf("%.20q: got %d, want between %d and %d", test.password, score, test.min, test.max)
+		}
+	}
+}
+
+func TestEstimatePasswordStrengthPenalisesUserInputs(t *testing.T) {
+	password := "Zanzibar-Quokka"
+	without := EstimatePasswordStrength(password)
+	with := EstimatePasswordStrength(password, "zanzibar", "quokka")
+	if with >= without {
+		t.Errorf("user inputs did not lower the score: %d without, %d with", without, with)
+	}
+}
@@ -0,0 +1,16 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// randomToken returns size bytes of crypto/rand entropy, base64url encoded.
+func randomToken(size int) (string, error) {
+	buffer := make([]byte, size)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
@@ -0,0 +1,384 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/lefalya/commonuser/definition"
+	"github.com/lefalya/pageflow"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const permissionCacheLifeSpan = time.Hour
+
+type RoleSQL struct {
+	*pageflow.SQLItem `bson:",inline" json:",inline"`
+	Name              string `json:"name" db:"name"`
+	Parent            string `json:"parent,omitempty" db:"parent"`
+}
+
+func NewRoleSQL() *RoleSQL {
+	role := &RoleSQL{}
+	pageflow.InitSQLItem(role)
+	return role
+}
+
+// RoleManagerSQL stores roles, their permissions and their assignment to
+// accounts. A role inherits every permission of its parent chain. Resolved
+// permission sets are cached in Redis per account; the cache is versioned so a
+// change to any role invalidates every account at once.
+type RoleManagerSQL struct {
+	db         *sqlDB
+	redis      redis.UniversalClient
+	entityName string
+}
+
+func (rm *RoleManagerSQL) roleTable() string {
+	return rm.db.table(rm.entityName + "Role")
+}
+
+func (rm *RoleManagerSQL) permissionTable() string {
+	return rm.db.table(rm.entityName + "RolePermission")
+}
+
+func (rm *RoleManagerSQL) accountRoleTable() string {
+	return rm.db.table(rm.entityName + "AccountRole")
+}
+
+func (rm *RoleManagerSQL) versionKey() string {
+	return rm.entityName + ":permissions:version"
+}
+
+func (rm *RoleManagerSQL) permissionKey(version int64, accountUUID string) string {
+	return rm.entityName + ":permissions:" + strconv.FormatInt(version, 10) + ":" + accountUUID
+}
+
+func (rm *RoleManagerSQL) CreateRole(name string, parent string) (*RoleSQL, error) {
+	role := NewRoleSQL()
+	role.Name = name
+	role.Parent = parent
+
+	query := "INSERT INTO " + rm.roleTable() + " (uuid, randId, createdat, updatedat, name, parent) VALUES ($1, $2, $3, $4, $5, $6)"
+	_, errInsert := rm.db.Exec(query, role.GetUUID(), role.GetRandId(), role.GetCreatedAt(), role.GetUpdatedAt(), role.Name, role.Parent)
+	if errInsert != nil {
+		return nil, errInsert
+	}
+	return role, rm.invalidateAll()
+}
+
+func (rm *RoleManagerSQL) FindRole(name string) (*RoleSQL, error) {
+	return rm.findRole(context.Background(), name)
+}
+
+func (rm *RoleManagerSQL) findRole(ctx context.Context, name string) (*RoleSQL, error) {
+	query := "SELECT uuid, randId, createdat, updatedat, name, parent FROM " + rm.roleTable() + " WHERE name = $1"
+	role := NewRoleSQL()
+	err := rm.db.QueryRowContext(ctx, query, name).Scan(
+		&role.SQLItem.UUID,
+		&role.SQLItem.RandId,
+		&role.SQLItem.CreatedAt,
+		&role.SQLItem.UpdatedAt,
+		&role.Name,
+		&role.Parent,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return role, nil
+}
+
+func (rm *RoleManagerSQL) SetParent(name string, parent string) error {
+	query := "UPDATE " + rm.roleTable() + " SET parent = $1, updatedat = $2 WHERE name = $3"
+	_, errUpdate := rm.db.Exec(query, parent, time.Now().UTC(), name)
+	if errUpdate != nil {
+		return errUpdate
+	}
+	return rm.invalidateAll()
+}
+
+// DeleteRole removes the role with its permissions and assignments in one
+// transaction. Its child roles lose their parent rather than inheriting from a
+// role created later under the same name.
+func (rm *RoleManagerSQL) DeleteRole(name string) error {
+	ctx := context.Background()
+	statements := []struct {
+		query string
+		args  []any
+	}{
+		{"DELETE FROM " + rm.accountRoleTable() + " WHERE role = $1", []any{name}},
+		{"DELETE FROM " + rm.permissionTable() + " WHERE role = $1", []any{name}},
+		{"UPDATE " + rm.roleTable() + " SET parent = '', updatedat = $1 WHERE parent = $2", []any{time.Now().UTC(), name}},
+		{"DELETE FROM " + rm.roleTable() + " WHERE name = $1", []any{name}},
+	}
+	errDelete := RunInTx(ctx, rm.db.DB, func(tx *Tx) error {
+		for _, statement := range statements {
+			_, errExec := tx.ExecContext(ctx, statement.query, statement.args...)
+			if errExec != nil {
+				return errExec
+			}
+		}
+		return nil
+	})
+	if errDelete != nil {
+		return errDelete
+	}
+	return rm.invalidateAll()
+}
+
+func (rm *RoleManagerSQL) GrantPermission(role string, permission string) error {
+	query := "INSERT INTO " + rm.permissionTable() + " (role, permission) VALUES ($1, $2)"
+	_, errInsert := rm.db.Exec(query, role, permission)
+	if errInsert != nil {
+		return errInsert
+	}
+	return rm.invalidateAll()
+}
+
+func (rm *RoleManagerSQL) RevokePermission(role string, permission string) error {
+	query := "DELETE FROM " + rm.permissionTable() + " WHERE role = $1 AND permission = $2"
+	_, errDelete := rm.db.Exec(query, role, permission)
+	if errDelete != nil {
+		return errDelete
+	}
+	return rm.invalidateAll()
+}
+
+func (rm *RoleManagerSQL) AssignRole(account *AccountSQL, role string) error {
+	return rm.AssignRoleContext(context.Background(), account, role)
+}
+
+func (rm *RoleManagerSQL) AssignRoleContext(ctx context.Context, account *AccountSQL, role string) error {
+	existing, errFind := rm.findRole(ctx, role)
+	if errFind != nil {
+		return errFind
+	}
+	if existing == nil {
+		return definition.RoleNotFound
+	}
+
+	query := "INSERT INTO " + rm.accountRoleTable() + " (accountuuid, role) VALUES ($1, $2)"
+	_, errInsert := rm.db.ExecContext(ctx, query, account.GetUUID(), role)
+	if errInsert != nil {
+		return errInsert
+	}
+	return rm.invalidate(ctx, account.GetUUID())
+}
+
+func (rm *RoleManagerSQL) UnassignRole(account *AccountSQL, role string) error {
+	return rm.UnassignRoleContext(context.Background(), account, role)
+}
+
+func (rm *RoleManagerSQL) UnassignRoleContext(ctx context.Context, account *AccountSQL, role string) error {
+	query := "DELETE FROM " + rm.accountRoleTable() + " WHERE accountuuid = $1 AND role = $2"
+	_, errDelete := rm.db.ExecContext(ctx, query, account.GetUUID(), role)
+	if errDelete != nil {
+		return errDelete
+	}
+	return rm.invalidate(ctx, account.GetUUID())
+}
+
+// FindRoles returns the roles directly assigned to the account.
+func (rm *RoleManagerSQL) FindRoles(accountUUID string) ([]string, error) {
+	return rm.FindRolesContext(context.Background(), accountUUID)
+}
+
+func (rm *RoleManagerSQL) FindRolesContext(ctx context.Context, accountUUID string) ([]string, error) {
+	query := "SELECT role FROM " + rm.accountRoleTable() + " WHERE accountuuid = $1 ORDER BY role"
+	return queryStrings(ctx, rm.db, query, accountUUID)
+}
+
+// LoadRoles fills account.Roles so that issued access tokens carry them.
+func (rm *RoleManagerSQL) LoadRoles(account *AccountSQL) error {
+	return rm.LoadRolesContext(context.Background(), account)
+}
+
+func (rm *RoleManagerSQL) LoadRolesContext(ctx context.Context, account *AccountSQL) error {
+	roles, errFind := rm.FindRolesContext(ctx, account.GetUUID())
+	if errFind != nil {
+		return errFind
+	}
+	account.Roles = roles
+	return nil
+}
+
+// Permissions resolves every permission granted to the account through its
+// roles and their ancestors, serving from the Redis cache when possible.
+func (rm *RoleManagerSQL) Permissions(accountUUID string) ([]string, error) {
+	ctx := context.Background()
+	version, errVersion := rm.redis.Get(ctx, rm.versionKey()).Int64()
+	if errVersion != nil && !errors.Is(errVersion, redis.Nil) {
+		return nil, errVersion
+	}
+
+	cacheKey := rm.permissionKey(version, accountUUID)
+	cached, errGet := rm.redis.Get(ctx, cacheKey).Bytes()
+	if errGet == nil {
+		var permissions []string
+		errUnmarshal := json.Unmarshal(cached, &permissions)
+		if errUnmarshal == nil {
+			return permissions, nil
+		}
+	} else if !errors.Is(errGet, redis.Nil) {
+		return nil, errGet
+	}
+
+	permissions, errResolve := rm.resolvePermissions(ctx, accountUUID)
+	if errResolve != nil {
+		return nil, errResolve
+	}
+
+	payload, errMarshal := json.Marshal(permissions)
+	if errMarshal != nil {
+		return nil, errMarshal
+	}
+	errSet := rm.redis.Set(ctx, cacheKey, payload, permissionCacheLifeSpan).Err()
+	if errSet != nil {
+		return nil, errSet
+	}
+	return permissions, nil
+}
+
+func (rm *RoleManagerSQL) resolvePermissions(ctx context.Context, accountUUID string) ([]string, error) {
+	roles, errFind := rm.FindRolesContext(ctx, accountUUID)
+	if errFind != nil {
+		return nil, errFind
+	}
+
+	visited := map[string]bool{}
+	granted := map[string]bool{}
+	for len(roles) > 0 {
+		role := roles[0]
+		roles = roles[1:]
+		if role == "" || visited[role] {
+			continue
+		}
+		visited[role] = true
+
+		permissions, errPermissions := queryStrings(ctx, rm.db, "SELECT permission FROM "+rm.permissionTable()+" WHERE role = $1", role)
+		if errPermissions != nil {
+			return nil, errPermissions
+		}
+		for _, permission := range permissions {
+			granted[permission] = true
+		}
+
+		existing, errRole := rm.findRole(ctx, role)
+		if errRole != nil {
+			return nil, errRole
+		}
+		if existing != nil && existing.Parent != "" {
+			roles = append(roles, existing.Parent)
+		}
+	}
+
+	permissions := make([]string, 0, len(granted))
+	for permission := range granted {
+		permissions = append(permissions, permission)
+	}
+	sort.Strings(permissions)
+	return permissions, nil
+}
+
+// HasPermission only looks at the account's roles; use Require to also honour
+// the scope of a token.
+func (rm *RoleManagerSQL) HasPermission(accountUUID string, permission string) (bool, error) {
+	permissions, err := rm.Permissions(accountUUID)
+	if err != nil {
+		return false, err
+	}
+	for _, granted := range permissions {
+		if granted == permission {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Require returns definition.Forbidden unless the token's account holds
+// permission. A token with a scope, such as an OAuth or API key token, must
+// also have been granted permission as one of its scopes.
+func (rm *RoleManagerSQL) Require(claims *UserClaims, permission string) error {
+	if claims == nil {
+		return definition.Unauthorized
+	}
+	if claims.Scope != "" && !containsScopes(strings.Fields(claims.Scope), []string{permission}) {
+		return definition.Forbidden
+	}
+	allowed, err := rm.HasPermission(claims.UUID, permission)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return definition.Forbidden
+	}
+	return nil
+}
+
+// RequireMiddleware guards next with Require, reading the claims stored by
+// JWTHandler.Middleware or CookieSessionHandler.Middleware.
+func (rm *RoleManagerSQL) RequireMiddleware(permission string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := ClaimsFromContext(r.Context())
+		errRequire := rm.Require(claims, permission)
+		if errRequire != nil {
+			switch {
+			case errors.Is(errRequire, definition.Unauthorized):
+				http.Error(w, errRequire.Error(), http.StatusUnauthorized)
+			case errors.Is(errRequire, definition.Forbidden):
+				http.Error(w, errRequire.Error(), http.StatusForbidden)
+			default:
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rm *RoleManagerSQL) invalidate(ctx context.Context, accountUUID string) error {
+	version, errVersion := rm.redis.Get(ctx, rm.versionKey()).Int64()
+	if errVersion != nil && !errors.Is(errVersion, redis.Nil) {
+		return errVersion
+	}
+	return rm.redis.Del(ctx, rm.permissionKey(version, accountUUID)).Err()
+}
+
+func (rm *RoleManagerSQL) invalidateAll() error {
+	return rm.redis.Incr(context.Background(), rm.versionKey()).Err()
+}
+
+func NewRoleManagerSQL(db *sql.DB, redis redis.UniversalClient, entityName string) *RoleManagerSQL {
+	return &RoleManagerSQL{
+		db:         newSQLDB(db),
+		redis:      redis,
+		entityName: entityName,
+	}
+}
+
+func queryStrings(ctx context.Context, db *sqlDB, query string, args ...any) ([]string, error) {
+	rows, errQuery := db.QueryContext(ctx, query, args...)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		errScan := rows.Scan(&value)
+		if errScan != nil {
+			return nil, errScan
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
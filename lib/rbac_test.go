@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"errors"
+	"github.com/lefalya/commonuser/definition"
+	"strings"
+	"testing"
+)
+
+func TestRequireRefusesPermissionOutsideScope(t *testing.T) {
+	roleManager := &RoleManagerSQL{}
+
+	errRequire := roleManager.Require(&UserClaims{UUID: "account", Scope: "invoices:read"}, "invoices:write")
+	if !errors.Is(errRequire, definition.Forbidden) {
+		t.Fatalf("got %v, want %v", errRequire, definition.Forbidden)
+	}
+	if errRequire := roleManager.Require(nil, "invoices:read"); !errors.Is(errRequire, definition.Unauthorized) {
+		t.Fatalf("got %v, want %v", errRequire, definition.Unauthorized)
+	}
+}
+
+func newTestRoleManager(t *testing.T) *RoleManagerSQL {
+	t.Helper()
+	roleManager := NewRoleManagerSQL(newTestDB(t), newFakeRedis(), testEntityName)
+	for _, role := range []struct{ name, parent, permission string }{
+		{name: "viewer", permission: "invoices:read"},
+		{name: "editor", parent: "viewer", permission: "invoices:write"},
+		{name: "admin", parent: "editor", permission: "accounts:manage"},
+	} {
+		if _, err := roleManager.CreateRole(role.name, role.parent); err != nil {
+			t.Fatal(err)
+		}
+		if err := roleManager.GrantPermission(role.name, role.permission); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return roleManager
+}
+
+func TestPermissionsFollowTheParentChain(t *testing.T) {
+	roleManager := newTestRoleManager(t)
+	account := newTestAccount()
+	if err := roleManager.AssignRole(account, "editor"); err != nil {
+		t.Fatal(err)
+	}
+
+	permissions, errPermissions := roleManager.Permissions(account.GetUUID())
+	if errPermissions != nil {
+		t.Fatal(errPermissions)
+	}
+	if got := strings.Join(permissions, " "); got != "invoices:read invoices:write" {
+		t.Errorf("got %q", got)
+	}
+
+	tests := []struct {
+		claims     *UserClaims
+		permission string
+		want       error
+	}{
+		{claims: &UserClaims{UUID: account.GetUUID()}, permission: "invoices:read", want: nil},
+		{claims: &UserClaims{UUID: account.GetUUID()}, permission: "accounts:manage", want: definition.Forbidden},
+		{claims: &UserClaims{UUID: account.GetUUID(), Scope: "invoices:read"}, permission: "invoices:read", want: nil},
+		{claims: &UserClaims{UUID: account.GetUUID(), Scope: "invoices:read"}, permission: "invoices:write", want: definition.Forbidden},
+	}
+	for _, test := range tests {
+		if err := roleManager.Require(test.claims, test.permission); !errors.Is(err, test.want) {
+			t.Errorf("%s with scope %q: got %v, want %v", test.permission, test.claims.Scope, err, test.want)
+		}
+	}
+
+	if err := roleManager.AssignRole(account, "missing"); !errors.Is(err, definition.RoleNotFound) {
+		t.Errorf("got %v for an unknown role, want %v", err, definition.RoleNotFound)
+	}
+}
+
+func TestDeleteRoleDetachesChildren(t *testing.T) {
+	roleManager := newTestRoleManager(t)
+	account := newTestAccount()
+	if err := roleManager.AssignRole(account, "viewer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := roleManager.DeleteRole("viewer"); err != nil {
+		t.Fatal(err)
+	}
+
+	roles, errRoles := roleManager.FindRoles(account.GetUUID())
+	if errRoles != nil || len(roles) != 0 {
+		t.Errorf("assignments survived the role: %v, %v", roles, errRoles)
+	}
+	editor, errFind := roleManager.FindRole("editor")
+	if errFind != nil || editor == nil || editor.Parent != "" {
+		t.Fatalf("the child role kept its parent: %+v, %v", editor, errFind)
+	}
+
+	// a new role under the old name must not be inherited, nor get the old grants
+	if _, err := roleManager.CreateRole("viewer", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := roleManager.GrantPermission("viewer", "reports:read"); err != nil {
+		t.Fatal(err)
+	}
+	if err := roleManager.AssignRole(account, "editor"); err != nil {
+		t.Fatal(err)
+	}
+	permissions, errPermissions := roleManager.Permissions(account.GetUUID())
+	if errPermissions != nil {
+		t.Fatal(errPermissions)
+	}
+	if got := strings.Join(permissions, " "); got != "invoices:write" {
+		t.Errorf("got %q, want only the editor's own permission", got)
+	}
+}
@@ -0,0 +1,170 @@
+package lib
+
+import (
+	"context"
+	"github.com/lefalya/commonuser/definition"
+	"golang.org/x/text/unicode/norm"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{2,31}$`)
+
+type Registration struct {
+	Name     string
+	Username string
+	Email    string
+	Password string
+	Avatar   string
+}
+
+// NormalizeEmail strips invisible formatting characters, applies Unicode NFKC
+// normalisation, lowercases and trims an email address so that visually
+// identical addresses compare equal.
+func NormalizeEmail(email string) string {
+	return foldIdentifier(email)
+}
+
+func NormalizeUsername(username string) string {
+	return foldIdentifier(username)
+}
+
+func foldIdentifier(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, value)
+	// NFKC folds compatibility forms such as fullwidth letters and composes
+	// decomposed sequences; lowercasing can decompose again, so it runs first
+	return strings.TrimSpace(norm.NFKC.String(strings.ToLower(value)))
+}
+
+func validateRegistration(registration Registration) error {
+	if utf8.RuneCountInString(registration.Name) > 255 {
+		return definition.InvalidName
+	}
+
+	if registration.Username != "" && !usernamePattern.MatchString(registration.Username) {
+		return definition.InvalidUsername
+	}
+
+	if len(registration.Email) > 255 {
+		return definition.InvalidEmail
+	}
+	address, errParse := mail.ParseAddress(registration.Email)
+	if errParse != nil || address.Address != registration.Email || address.Name != "" {
+		return definition.InvalidEmail
+	}
+	return nil
+}
+
+// Register signs a new account up: it normalises and validates the fields,
+// applies the password policy, then checks availability, inserts the account,
+// records its password history and optionally starts email verification within
+// one transaction, and issues tokens when a JWTHandler is configured.
+func (asql *AccountManagerSQL) Register(registration Registration) (*LoginResult, error) {
+	return asql.RegisterContext(context.Background(), registration)
+}
+
+func (asql *AccountManagerSQL) RegisterContext(ctx context.Context, registration Registration) (*LoginResult, error) {
+	registration.Name = strings.TrimSpace(registration.Name)
+	registration.Email = NormalizeEmail(registration.Email)
+	registration.Username = NormalizeUsername(registration.Username)
+
+	errValidate := validateRegistration(registration)
+	if errValidate != nil {
+		return nil, errValidate
+	}
+
+	account := NewAccountSQL()
+	account.SetName(registration.Name)
+	account.SetUsername(registration.Username)
+	account.SetEmail(registration.Email)
+	account.SetAvatar(registration.Avatar)
+
+	errSetPassword := account.SetPasswordWithPolicy(registration.Password, asql.passwordPolicy)
+	if errSetPassword != nil {
+		return nil, errSetPassword
+	}
+
+	errRegister := asql.inTx(ctx, func(accounts *AccountManagerSQL) error {
+		errInsert := accounts.insertIfAvailable(ctx, *account)
+		if errInsert != nil {
+			return errInsert
+		}
+		errCache := accounts.cacheAccount(ctx, account)
+		if errCache != nil {
+			return errCache
+		}
+
+		if accounts.passwordHistory != nil {
+			errRecord := accounts.passwordHistory.RecordContext(ctx, account)
+			if errRecord != nil {
+				return errRecord
+			}
+		}
+
+		if accounts.emailVerification != nil {
+			_, errVerification := accounts.emailVerification.CreateRequestContext(ctx, account)
+			if errVerification != nil {
+				return errVerification
+			}
+		}
+		return nil
+	})
+	if errRegister != nil {
+		return nil, errRegister
+	}
+
+	return asql.issueLoginResult(ctx, account)
+}
+
+func (asql *AccountManagerSQL) insertIfAvailable(ctx context.Context, account AccountSQL) error {
+	conn := asql.conn()
+	errAvailable := checkAvailability(ctx, conn, asql.entityName, account.Email, account.Username)
+	if errAvailable != nil {
+		return errAvailable
+	}
+
+	errInsert := insertAccount(ctx, conn, asql.entityName, account)
+	if errInsert != nil && conn.dialect().IsUniqueViolation(errInsert) {
+		// a concurrent registration won the race between check and insert; the
+		// failed insert may have aborted the transaction, so the conflicting
+		// column is looked up outside of it
+		errConflict := checkAvailability(ctx, asql.db, asql.entityName, account.Email, account.Username)
+		if errConflict != nil {
+			return errConflict
+		}
+	}
+	return errInsert
+}
+
+// checkAvailability counts soft-deleted accounts too, so their username and
+// email stay reserved until they are purged.
+func checkAvailability(ctx context.Context, conn sqlConn, entityName string, email string, username string) error {
+	var count int
+	errEmail := conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+conn.table(entityName)+" WHERE email = $1", email).Scan(&count)
+	if errEmail != nil {
+		return errEmail
+	}
+	if count > 0 {
+		return definition.EmailTaken
+	}
+
+	if username == "" {
+		return nil
+	}
+	errUsername := conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+conn.table(entityName)+" WHERE username = $1", username).Scan(&count)
+	if errUsername != nil {
+		return errUsername
+	}
+	if count > 0 {
+		return definition.UsernameTaken
+	}
+	return nil
+}
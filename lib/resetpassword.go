@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"database/sql"
 	"github.com/lefalya/commonuser/definition"
 	"github.com/lefalya/pageflow"
@@ -45,22 +46,72 @@ func NewResetPasswordSQL() *ResetPasswordRequestSQL {
 }
 
 type ResetPasswordManagerSQL struct {
-	base       *pageflow.Base[AccountSQL]
-	db         *sql.DB
-	entityName string
+	cache           *accountCache
+	db              *sqlDB
+	entityName      string
+	passwordPolicy  *PasswordPolicy
+	passwordHistory *PasswordHistoryManagerSQL
+	tx              *Tx
+}
+
+// WithTx returns a copy of the manager, together with its password history,
+// that works inside tx. Its cache writes wait for the commit.
+func (ar *ResetPasswordManagerSQL) WithTx(tx *Tx) *ResetPasswordManagerSQL {
+	bound := *ar
+	bound.tx = tx
+	if bound.passwordHistory != nil {
+		bound.passwordHistory = bound.passwordHistory.WithTx(tx)
+	}
+	return &bound
+}
+
+// SetInvalidationBus broadcasts the manager's cache invalidations.
+func (ar *ResetPasswordManagerSQL) SetInvalidationBus(bus *InvalidationBus) {
+	ar.cache.bus = bus
+}
+
+func (ar *ResetPasswordManagerSQL) conn() sqlConn {
+	if ar.tx != nil {
+		return ar.tx
+	}
+	return ar.db
+}
+
+func (ar *ResetPasswordManagerSQL) inTx(ctx context.Context, fn func(resets *ResetPasswordManagerSQL) error) error {
+	if ar.tx != nil {
+		return fn(ar)
+	}
+	return RunInTx(ctx, ar.db.DB, func(tx *Tx) error {
+		return fn(ar.WithTx(tx))
+	})
+}
+
+func (ar *ResetPasswordManagerSQL) SetPasswordPolicy(policy *PasswordPolicy) {
+	ar.passwordPolicy = policy
+}
+
+func (ar *ResetPasswordManagerSQL) SetPasswordHistory(history *PasswordHistoryManagerSQL) {
+	ar.passwordHistory = history
+}
+
+func (ar *ResetPasswordManagerSQL) tableName() string {
+	return ar.db.table(ar.entityName + "ResetPassword")
 }
 
 func (ar *ResetPasswordManagerSQL) Create(account *AccountSQL) (*ResetPasswordRequestSQL, error) {
+	return ar.CreateContext(context.Background(), account)
+}
+
+func (ar *ResetPasswordManagerSQL) CreateContext(ctx context.Context, account *AccountSQL) (*ResetPasswordRequestSQL, error) {
 	requestResetPassword := NewResetPasswordSQL()
 	requestResetPassword.SetAccountUUID(account)
 	requestResetPassword.SetToken()
 	requestResetPassword.SetExpiredAt()
 
-	tableName := ar.entityName + "ResetPassword"
-	query := `INSERT INTO $1 (uuid, randId, createdat, updatedat, accountuuid, token, expiredat) VALUES ($2, $3, $4, $5, $6, $7, $8)`
-	_, errInsert := ar.db.Exec(
+	query := `INSERT INTO ` + ar.tableName() + ` (uuid, randId, createdat, updatedat, accountuuid, token, expiredat) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, errInsert := ar.conn().ExecContext(
+		ctx,
 		query,
-		tableName,
 		requestResetPassword.GetUUID(),
 		requestResetPassword.GetRandId(),
 		requestResetPassword.GetCreatedAt(),
@@ -77,9 +128,35 @@ func (ar *ResetPasswordManagerSQL) Create(account *AccountSQL) (*ResetPasswordRe
 }
 
 func (ar *ResetPasswordManagerSQL) Find(account *AccountSQL) (*ResetPasswordRequestSQL, error) {
-	tableName := ar.entityName + "ResetPassword"
-	query := "SELECT * FROM " + tableName + "ResetPassword WHERE accountuuid = $1"
-	row := ar.db.QueryRow(query, account.Email)
+	return ar.FindContext(context.Background(), account)
+}
+
+func (ar *ResetPasswordManagerSQL) FindContext(ctx context.Context, account *AccountSQL) (*ResetPasswordRequestSQL, error) {
+	resetPasswordRequest, err := ar.findByAccount(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	if resetPasswordRequest == nil {
+		return nil, nil
+	}
+
+	if resetPasswordRequest.ExpiredAt.Before(time.Now().UTC()) {
+		ar.DeleteContext(ctx, resetPasswordRequest)
+		newResetPasswordRequest, err := ar.CreateContext(ctx, account)
+		if err != nil {
+			return nil, err
+		}
+		return newResetPasswordRequest, nil
+	} else {
+		return nil, definition.RequestExist
+	}
+
+	return resetPasswordRequest, nil
+}
+
+func (ar *ResetPasswordManagerSQL) findByAccount(ctx context.Context, account *AccountSQL) (*ResetPasswordRequestSQL, error) {
+	query := "SELECT uuid, randId, createdat, updatedat, accountuuid, token, expiredat FROM " + ar.tableName() + " WHERE accountuuid = $1"
+	row := ar.conn().QueryRowContext(ctx, query, account.GetUUID())
 	resetPasswordRequest := NewResetPasswordSQL()
 	err := row.Scan(
 		&resetPasswordRequest.SQLItem.UUID,
@@ -96,35 +173,77 @@ func (ar *ResetPasswordManagerSQL) Find(account *AccountSQL) (*ResetPasswordRequ
 		}
 		return nil, err
 	}
+	return resetPasswordRequest, nil
+}
 
-	if resetPasswordRequest.ExpiredAt.Before(time.Now().UTC()) {
-		ar.Delete(resetPasswordRequest)
-		newResetPasswordRequest, err := ar.Create(account)
-		if err != nil {
-			return nil, err
+// ResetPassword consumes the account's reset request and stores the new password
+// once it satisfies the manager's password policy and history. Both happen in
+// one transaction, so a request resets the password once, and the cached
+// account is invalidated after the commit.
+func (ar *ResetPasswordManagerSQL) ResetPassword(account *AccountSQL, token string, password string) error {
+	return ar.ResetPasswordContext(context.Background(), account, token, password)
+}
+
+func (ar *ResetPasswordManagerSQL) ResetPasswordContext(ctx context.Context, account *AccountSQL, token string, password string) error {
+	request, errFind := ar.findByAccount(ctx, account)
+	if errFind != nil {
+		return errFind
+	}
+	if request == nil {
+		return definition.RequestNotFound
+	}
+
+	errValidate := request.Validate(token)
+	if errValidate != nil {
+		if errValidate == definition.RequestExpired {
+			ar.DeleteContext(ctx, request)
 		}
-		return newResetPasswordRequest, nil
-	} else {
-		return nil, definition.RequestExist
+		return errValidate
 	}
 
-	return resetPasswordRequest, nil
+	errApply := applyNewPassword(ctx, account, password, ar.passwordPolicy, ar.passwordHistory)
+	if errApply != nil {
+		return errApply
+	}
+
+	return ar.inTx(ctx, func(resets *ResetPasswordManagerSQL) error {
+		// only the reset that deletes the request may use it
+		query := "DELETE FROM " + resets.tableName() + " WHERE uuid = $1 AND token = $2"
+		result, errDelete := resets.conn().ExecContext(ctx, query, request.GetUUID(), token)
+		if errDelete != nil {
+			return errDelete
+		}
+		errAffected := requireAffected(result, definition.InvalidToken)
+		if errAffected != nil {
+			return errAffected
+		}
+
+		errStore := storePassword(ctx, resets.conn(), resets.entityName, account, resets.passwordHistory)
+		if errStore != nil {
+			return errStore
+		}
+
+		return invalidateAccount(ctx, resets.tx, resets.cache, *account, AccountChanged)
+	})
 }
 
 func (ar *ResetPasswordManagerSQL) Delete(requestSQL *ResetPasswordRequestSQL) error {
-	tableName := ar.entityName + "ResetPassword"
-	query := "DELETE FROM " + tableName + "ResetPassword WHERE uuid = $1"
-	_, errDelete := ar.db.Exec(query, requestSQL.GetUUID())
+	return ar.DeleteContext(context.Background(), requestSQL)
+}
+
+func (ar *ResetPasswordManagerSQL) DeleteContext(ctx context.Context, requestSQL *ResetPasswordRequestSQL) error {
+	query := "DELETE FROM " + ar.tableName() + " WHERE uuid = $1"
+	_, errDelete := ar.conn().ExecContext(ctx, query, requestSQL.GetUUID())
 	if errDelete != nil {
 		return errDelete
 	}
 	return nil
 }
 
-func NewResetPasswordManagerSQL(db *sql.DB, redis *redis.Client, entityName string) *ResetPasswordManagerSQL {
-	base := pageflow.NewBase[AccountSQL](redis, entityName+":%s")
+func NewResetPasswordManagerSQL(db *sql.DB, redis redis.UniversalClient, entityName string) *ResetPasswordManagerSQL {
 	return &ResetPasswordManagerSQL{
-		base: base,
-		db:   db,
+		cache:      newAccountCache(redis, entityName),
+		db:         newSQLDB(db),
+		entityName: entityName,
 	}
 }
@@ -0,0 +1,43 @@
+package lib
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestResetPasswordIsSingleUse(t *testing.T) {
+	db := newTestDB(t)
+	redis := newFakeRedis()
+	account := newTestMember("ada@example.com")
+	if err := NewAccountManagerSQL(db, redis, testEntityName).Create(*account); err != nil {
+		t.Fatal(err)
+	}
+	resets := NewResetPasswordManagerSQL(db, redis, testEntityName)
+	request, errCreate := resets.Create(account)
+	if errCreate != nil {
+		t.Fatal(errCreate)
+	}
+
+	const attempts = 4
+	errs := make([]error, attempts)
+	var wait sync.WaitGroup
+	for i := range errs {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			attempt := *account
+			errs[i] = resets.ResetPassword(&attempt, request.Token, "correct horse battery staple")
+		}()
+	}
+	wait.Wait()
+
+	succeeded := 0
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("%d resets succeeded with one token, want 1: %v", succeeded, errs)
+	}
+}
@@ -0,0 +1,234 @@
+package lib
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"github.com/lefalya/commonuser/definition"
+	"github.com/lefalya/pageflow"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const GrantTypeClientCredentials = "client_credentials"
+
+type ClientCredentialSQL struct {
+	*pageflow.SQLItem `bson:",inline" json:",inline"`
+	AccountUUID       string    `json:"accountuuid" db:"accountuuid"`
+	ClientId          string    `json:"clientid" db:"clientid"`
+	SecretHash        string    `json:"-" db:"secrethash"`
+	Scopes            []string  `json:"scopes,omitempty" db:"scopes"`
+	RevokedAt         time.Time `json:"revokedat,omitempty" db:"revokedat"`
+}
+
+func NewClientCredentialSQL() *ClientCredentialSQL {
+	credential := &ClientCredentialSQL{}
+	pageflow.InitSQLItem(credential)
+	return credential
+}
+
+// ServiceAccountManagerSQL manages non-human accounts. They live in the account
+// table flagged as serviceaccount, never log in with a password and instead
+// exchange client credentials for access tokens (OAuth2 client_credentials).
+type ServiceAccountManagerSQL struct {
+	db         *sqlDB
+	entityName string
+	jwtHandler *JWTHandler
+}
+
+func (sm *ServiceAccountManagerSQL) credentialTable() string {
+	return sm.db.table(sm.entityName + "ClientCredential")
+}
+
+func (sm *ServiceAccountManagerSQL) Create(name string) (*AccountSQL, error) {
+	account := NewAccountSQL()
+	account.SetName(name)
+	account.ServiceAccount = true
+
+	errInsert := insertAccount(context.Background(), sm.db, sm.entityName, *account)
+	if errInsert != nil {
+		return nil, errInsert
+	}
+	return account, nil
+}
+
+// CreateCredential returns the plaintext client secret, which cannot be recovered
+// afterwards. A service account may hold several credentials to allow rotation.
+func (sm *ServiceAccountManagerSQL) CreateCredential(account *AccountSQL, scopes []string) (string, *ClientCredentialSQL, error) {
+	if !account.ServiceAccount {
+		return "", nil, definition.Forbidden
+	}
+	for _, scope := range scopes {
+		if isLimitedScope(scope) || strings.ContainsAny(scope, " \t\n") {
+			return "", nil, definition.InvalidScope
+		}
+	}
+
+	clientId, errClientId := randomToken(16)
+	if errClientId != nil {
+		return "", nil, errClientId
+	}
+	clientSecret, errSecret := randomToken(32)
+	if errSecret != nil {
+		return "", nil, errSecret
+	}
+
+	credential := NewClientCredentialSQL()
+	credential.AccountUUID = account.GetUUID()
+	credential.ClientId = clientId
+	credential.SecretHash = hashAPIKey(clientSecret)
+	credential.Scopes = scopes
+
+	query := "INSERT INTO " + sm.credentialTable() + " (uuid, randId, createdat, updatedat, accountuuid, clientid, secrethash, scopes) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+	_, errInsert := sm.db.Exec(
+		query,
+		credential.GetUUID(),
+		credential.GetRandId(),
+		credential.GetCreatedAt(),
+		credential.GetUpdatedAt(),
+		credential.AccountUUID,
+		credential.ClientId,
+		credential.SecretHash,
+		strings.Join(credential.Scopes, " "))
+	if errInsert != nil {
+		return "", nil, errInsert
+	}
+	return clientSecret, credential, nil
+}
+
+func (sm *ServiceAccountManagerSQL) FindCredential(clientId string) (*ClientCredentialSQL, error) {
+	query := "SELECT uuid, randId, createdat, updatedat, accountuuid, clientid, secrethash, scopes, revokedat FROM " + sm.credentialTable() + " WHERE clientid = $1"
+	credential := NewClientCredentialSQL()
+	var scopes string
+	var revokedAt sql.NullTime
+	err := sm.db.QueryRow(query, clientId).Scan(
+		&credential.SQLItem.UUID,
+		&credential.SQLItem.RandId,
+		&credential.SQLItem.CreatedAt,
+		&credential.SQLItem.UpdatedAt,
+		&credential.AccountUUID,
+		&credential.ClientId,
+		&credential.SecretHash,
+		&scopes,
+		&revokedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	credential.Scopes = strings.Fields(scopes)
+	credential.RevokedAt = revokedAt.Time
+	return credential, nil
+}
+
+func (sm *ServiceAccountManagerSQL) RevokeCredential(clientId string) error {
+	timeNow := time.Now().UTC()
+	query := "UPDATE " + sm.credentialTable() + " SET revokedat = $1, updatedat = $2 WHERE clientid = $3 AND revokedat IS NULL"
+	result, errUpdate := sm.db.Exec(query, timeNow, timeNow, clientId)
+	if errUpdate != nil {
+		return errUpdate
+	}
+	return requireAffected(result, definition.RequestNotFound)
+}
+
+// AuthenticateClient verifies a client id and secret pair and returns the
+// service account behind it.
+func (sm *ServiceAccountManagerSQL) AuthenticateClient(clientId string, clientSecret string) (*AccountSQL, *ClientCredentialSQL, error) {
+	credential, errFind := sm.FindCredential(clientId)
+	if errFind != nil {
+		return nil, nil, errFind
+	}
+	if credential == nil || !credential.RevokedAt.IsZero() {
+		return nil, nil, definition.InvalidCredentials
+	}
+	if subtle.ConstantTimeCompare([]byte(credential.SecretHash), []byte(hashAPIKey(clientSecret))) != 1 {
+		return nil, nil, definition.InvalidCredentials
+	}
+
+	account, errAccount := findOneAccount(context.Background(), sm.db, "SELECT "+accountColumns+" FROM "+sm.db.table(sm.entityName)+" WHERE uuid = $1 AND deletedat IS NULL", credential.AccountUUID)
+	if errAccount != nil {
+		return nil, nil, errAccount
+	}
+	if account == nil || !account.ServiceAccount {
+		return nil, nil, definition.InvalidCredentials
+	}
+	if account.IsSuspended() {
+		return nil, nil, definition.AccountSuspended
+	}
+	return account, credential, nil
+}
+
+// IssueToken performs the client_credentials grant. requestedScope is the space
+// delimited OAuth scope parameter; empty grants every scope of the credential.
+func (sm *ServiceAccountManagerSQL) IssueToken(clientId string, clientSecret string, requestedScope string) (*OAuthTokenResponse, error) {
+	account, credential, errAuthenticate := sm.AuthenticateClient(clientId, clientSecret)
+	if errAuthenticate != nil {
+		return nil, errAuthenticate
+	}
+
+	scopes, granted := grantScopes(requestedScope, credential.Scopes)
+	if !granted {
+		return nil, definition.InvalidScope
+	}
+
+	scope := strings.Join(scopes, " ")
+	lifeSpan := time.Hour * time.Duration(sm.jwtHandler.jwtTokenLifeSpan)
+	accessToken, errSign := signOAuthAccessToken(sm.jwtHandler, account, credential.ClientId, scope, lifeSpan)
+	if errSign != nil {
+		return nil, errSign
+	}
+
+	return &OAuthTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(lifeSpan.Seconds()),
+		Scope:       scope,
+	}, nil
+}
+
+// ParseAccessToken verifies the tokens issued by IssueToken, so that
+// BearerMiddleware can authenticate service accounts.
+func (sm *ServiceAccountManagerSQL) ParseAccessToken(accessToken string) (*UserClaims, error) {
+	return sm.jwtHandler.ParseOAuthAccessToken(accessToken)
+}
+
+// TokenHandler serves the OAuth2 token endpoint for the client_credentials grant.
+func (sm *ServiceAccountManagerSQL) TokenHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeOAuthError(w, http.StatusMethodNotAllowed, OAuthInvalidRequest, "token endpoint only accepts POST")
+			return
+		}
+		if r.PostFormValue("grant_type") != GrantTypeClientCredentials {
+			writeOAuthError(w, http.StatusBadRequest, OAuthUnsupportedGrantType, "only client_credentials is supported")
+			return
+		}
+
+		clientId, clientSecret := clientCredentialsFromRequest(r)
+		response, errIssue := sm.IssueToken(clientId, clientSecret, r.PostFormValue("scope"))
+		if errIssue != nil {
+			switch errIssue {
+			case definition.InvalidCredentials, definition.AccountSuspended:
+				writeOAuthError(w, http.StatusUnauthorized, OAuthInvalidClient, "client authentication failed")
+			case definition.InvalidScope:
+				writeOAuthError(w, http.StatusBadRequest, OAuthInvalidScope, "requested scope exceeds the client's scopes")
+			default:
+				writeOAuthError(w, http.StatusInternalServerError, OAuthServerError, "")
+			}
+			return
+		}
+		writeJSON(w, http.StatusOK, response)
+	})
+}
+
+func NewServiceAccountManagerSQL(db *sql.DB, entityName string, jwtHandler *JWTHandler) *ServiceAccountManagerSQL {
+	return &ServiceAccountManagerSQL{
+		db:         newSQLDB(db),
+		entityName: entityName,
+		jwtHandler: jwtHandler,
+	}
+}
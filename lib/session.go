@@ -0,0 +1,340 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/lefalya/commonuser/definition"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+type Session struct {
+	Id          string    `json:"id"`
+	AccountUUID string    `json:"accountuuid"`
+	UserAgent   string    `json:"useragent,omitempty"`
+	IP          string    `json:"ip,omitempty"`
+	CreatedAt   time.Time `json:"createdat"`
+	LastSeenAt  time.Time `json:"lastseenat"`
+	CSRFToken   string    `json:"csrftoken,omitempty"`
+	// Organization is the active organization of the session's tokens.
+	Organization string `json:"organization,omitempty"`
+}
+
+// SessionManager keeps one Redis record per login so that an account can list
+// and revoke the devices it is signed in on. A session ends after idleTimeout
+// without activity or absoluteTimeout after its creation, whichever is first.
+//
+// A session is addressed by its account and id. Its key carries the account's
+// hash tag like the account's session index, so in cluster mode both share a
+// slot and are written in one MULTI.
+type SessionManager struct {
+	redis           redis.UniversalClient
+	entityName      string
+	idleTimeout     time.Duration
+	absoluteTimeout time.Duration
+}
+
+func (sm *SessionManager) sessionKey(accountUUID string, sessionId string) string {
+	return sm.entityName + ":session:{" + accountUUID + "}:" + sessionId
+}
+
+func (sm *SessionManager) accountSessionsKey(accountUUID string) string {
+	return sm.entityName + ":sessions:{" + accountUUID + "}"
+}
+
+func (sm *SessionManager) ttl(session *Session) time.Duration {
+	ttl := sm.idleTimeout
+	remaining := time.Until(session.CreatedAt.Add(sm.absoluteTimeout))
+	if remaining < ttl {
+		ttl = remaining
+	}
+	return ttl
+}
+
+func (sm *SessionManager) save(ctx context.Context, session *Session) error {
+	ttl := sm.ttl(session)
+	if ttl <= 0 {
+		return definition.SessionNotFound
+	}
+
+	payload, errMarshal := json.Marshal(session)
+	if errMarshal != nil {
+		return errMarshal
+	}
+
+	pipeline := sm.redis.TxPipeline()
+	pipeline.Set(ctx, sm.sessionKey(session.AccountUUID, session.Id), payload, ttl)
+	pipeline.ZAdd(ctx, sm.accountSessionsKey(session.AccountUUID), redis.Z{
+		Score:  float64(session.CreatedAt.Unix()),
+		Member: session.Id,
+	})
+	pipeline.Expire(ctx, sm.accountSessionsKey(session.AccountUUID), sm.absoluteTimeout)
+	_, errExec := pipeline.Exec(ctx)
+	return errExec
+}
+
+func (sm *SessionManager) Create(account *AccountSQL, userAgent string, ip string) (*Session, error) {
+	return sm.CreateContext(context.Background(), account, userAgent, ip)
+}
+
+func (sm *SessionManager) CreateContext(ctx context.Context, account *AccountSQL, userAgent string, ip string) (*Session, error) {
+	sessionId, errToken := randomToken(24)
+	if errToken != nil {
+		return nil, errToken
+	}
+
+	timeNow := time.Now().UTC()
+	session := &Session{
+		Id:          sessionId,
+		AccountUUID: account.GetUUID(),
+		UserAgent:   userAgent,
+		IP:          ip,
+		CreatedAt:   timeNow,
+		LastSeenAt:  timeNow,
+	}
+
+	errSave := sm.save(ctx, session)
+	if errSave != nil {
+		return nil, errSave
+	}
+	return session, nil
+}
+
+// Find returns nil when the account has no such session or it has timed out.
+func (sm *SessionManager) Find(accountUUID string, sessionId string) (*Session, error) {
+	return sm.FindContext(context.Background(), accountUUID, sessionId)
+}
+
+func (sm *SessionManager) FindContext(ctx context.Context, accountUUID string, sessionId string) (*Session, error) {
+	payload, errGet := sm.redis.Get(ctx, sm.sessionKey(accountUUID, sessionId)).Bytes()
+	if errGet != nil {
+		if errors.Is(errGet, redis.Nil) {
+			return nil, nil
+		}
+		return nil, errGet
+	}
+
+	session := &Session{}
+	errUnmarshal := json.Unmarshal(payload, session)
+	if errUnmarshal != nil {
+		return nil, errUnmarshal
+	}
+	if sm.ttl(session) <= 0 {
+		return nil, nil
+	}
+	return session, nil
+}
+
+// Touch records activity on the session and pushes its idle timeout forward.
+func (sm *SessionManager) Touch(accountUUID string, sessionId string, ip string) (*Session, error) {
+	return sm.TouchContext(context.Background(), accountUUID, sessionId, ip)
+}
+
+func (sm *SessionManager) TouchContext(ctx context.Context, accountUUID string, sessionId string, ip string) (*Session, error) {
+	session, errFind := sm.FindContext(ctx, accountUUID, sessionId)
+	if errFind != nil {
+		return nil, errFind
+	}
+	if session == nil {
+		return nil, definition.SessionNotFound
+	}
+
+	session.LastSeenAt = time.Now().UTC()
+	if ip != "" {
+		session.IP = ip
+	}
+	errSave := sm.save(ctx, session)
+	if errSave != nil {
+		return nil, errSave
+	}
+	return session, nil
+}
+
+func (sm *SessionManager) SetCSRFToken(accountUUID string, sessionId string, csrfToken string) error {
+	return sm.SetCSRFTokenContext(context.Background(), accountUUID, sessionId, csrfToken)
+}
+
+func (sm *SessionManager) SetCSRFTokenContext(ctx context.Context, accountUUID string, sessionId string, csrfToken string) error {
+	session, errFind := sm.FindContext(ctx, accountUUID, sessionId)
+	if errFind != nil {
+		return errFind
+	}
+	if session == nil {
+		return definition.SessionNotFound
+	}
+
+	session.CSRFToken = csrfToken
+	return sm.save(ctx, session)
+}
+
+func (sm *SessionManager) SetOrganization(accountUUID string, sessionId string, organizationUUID string) error {
+	return sm.SetOrganizationContext(context.Background(), accountUUID, sessionId, organizationUUID)
+}
+
+func (sm *SessionManager) SetOrganizationContext(ctx context.Context, accountUUID string, sessionId string, organizationUUID string) error {
+	session, errFind := sm.FindContext(ctx, accountUUID, sessionId)
+	if errFind != nil {
+		return errFind
+	}
+	if session == nil {
+		return definition.SessionNotFound
+	}
+
+	session.Organization = organizationUUID
+	return sm.save(ctx, session)
+}
+
+// ValidateAccessToken rejects access tokens whose session has been revoked or timed out.
+func (sm *SessionManager) ValidateAccessToken(claims *UserClaims) (*Session, error) {
+	return sm.ValidateAccessTokenContext(context.Background(), claims)
+}
+
+func (sm *SessionManager) ValidateAccessTokenContext(ctx context.Context, claims *UserClaims) (*Session, error) {
+	return sm.validate(ctx, claims.UUID, claims.SessionId)
+}
+
+// ValidateRefreshToken checks that the refresh token's session is still alive
+// and records the activity. Tokens issued without a session are rejected.
+func (sm *SessionManager) ValidateRefreshToken(claims *RefreshTokenClaims) (*Session, error) {
+	return sm.ValidateRefreshTokenContext(context.Background(), claims)
+}
+
+func (sm *SessionManager) ValidateRefreshTokenContext(ctx context.Context, claims *RefreshTokenClaims) (*Session, error) {
+	session, errValidate := sm.validate(ctx, claims.UUID, claims.SessionId)
+	if errValidate != nil {
+		return nil, errValidate
+	}
+	return sm.TouchContext(ctx, session.AccountUUID, session.Id, "")
+}
+
+func (sm *SessionManager) validate(ctx context.Context, accountUUID string, sessionId string) (*Session, error) {
+	if sessionId == "" {
+		return nil, definition.SessionNotFound
+	}
+	session, errFind := sm.FindContext(ctx, accountUUID, sessionId)
+	if errFind != nil {
+		return nil, errFind
+	}
+	if session == nil || session.AccountUUID != accountUUID {
+		return nil, definition.SessionNotFound
+	}
+	return session, nil
+}
+
+// List returns the account's live sessions, oldest first, and forgets the ones
+// that already timed out.
+func (sm *SessionManager) List(account *AccountSQL) ([]Session, error) {
+	return sm.ListContext(context.Background(), account)
+}
+
+func (sm *SessionManager) ListContext(ctx context.Context, account *AccountSQL) ([]Session, error) {
+	sessionIds, errRange := sm.redis.ZRange(ctx, sm.accountSessionsKey(account.GetUUID()), 0, -1).Result()
+	if errRange != nil {
+		return nil, errRange
+	}
+
+	var sessions []Session
+	var staleIds []interface{}
+	for _, sessionId := range sessionIds {
+		session, errFind := sm.FindContext(ctx, account.GetUUID(), sessionId)
+		if errFind != nil {
+			return nil, errFind
+		}
+		if session == nil {
+			staleIds = append(staleIds, sessionId)
+			continue
+		}
+		sessions = append(sessions, *session)
+	}
+
+	if len(staleIds) > 0 {
+		errRem := sm.redis.ZRem(ctx, sm.accountSessionsKey(account.GetUUID()), staleIds...).Err()
+		if errRem != nil {
+			return nil, errRem
+		}
+	}
+	return sessions, nil
+}
+
+func (sm *SessionManager) Revoke(account *AccountSQL, sessionId string) error {
+	return sm.RevokeContext(context.Background(), account, sessionId)
+}
+
+func (sm *SessionManager) RevokeContext(ctx context.Context, account *AccountSQL, sessionId string) error {
+	pipeline := sm.redis.TxPipeline()
+	removed := pipeline.ZRem(ctx, sm.accountSessionsKey(account.GetUUID()), sessionId)
+	pipeline.Del(ctx, sm.sessionKey(account.GetUUID(), sessionId))
+	_, errExec := pipeline.Exec(ctx)
+	if errExec != nil {
+		return errExec
+	}
+	if removed.Val() == 0 {
+		return definition.SessionNotFound
+	}
+	return nil
+}
+
+func (sm *SessionManager) RevokeOthers(account *AccountSQL, currentSessionId string) error {
+	return sm.RevokeOthersContext(context.Background(), account, currentSessionId)
+}
+
+func (sm *SessionManager) RevokeOthersContext(ctx context.Context, account *AccountSQL, currentSessionId string) error {
+	return sm.revokeAll(ctx, account, currentSessionId)
+}
+
+func (sm *SessionManager) RevokeAllSessions(account *AccountSQL) error {
+	return sm.RevokeAllSessionsContext(context.Background(), account)
+}
+
+func (sm *SessionManager) RevokeAllSessionsContext(ctx context.Context, account *AccountSQL) error {
+	return sm.revokeAll(ctx, account, "")
+}
+
+func (sm *SessionManager) revokeAll(ctx context.Context, account *AccountSQL, keepSessionId string) error {
+	sessionIds, errRange := sm.redis.ZRange(ctx, sm.accountSessionsKey(account.GetUUID()), 0, -1).Result()
+	if errRange != nil {
+		return errRange
+	}
+
+	pipeline := sm.redis.TxPipeline()
+	for _, sessionId := range sessionIds {
+		if sessionId == keepSessionId {
+			continue
+		}
+		pipeline.Del(ctx, sm.sessionKey(account.GetUUID(), sessionId))
+		pipeline.ZRem(ctx, sm.accountSessionsKey(account.GetUUID()), sessionId)
+	}
+	_, errExec := pipeline.Exec(ctx)
+	return errExec
+}
+
+func NewSessionManager(redis redis.UniversalClient, entityName string, idleTimeout time.Duration, absoluteTimeout time.Duration) *SessionManager {
+	return &SessionManager{
+		redis:           redis,
+		entityName:      entityName,
+		idleTimeout:     idleTimeout,
+		absoluteTimeout: absoluteTimeout,
+	}
+}
+
+// IssueSessionTokens issues an access and refresh token pair bound to session.
+func (jh *JWTHandler) IssueSessionTokens(account *AccountSQL, session *Session) (*LoginResult, error) {
+	lifeSpan := time.Hour * time.Duration(jh.jwtTokenLifeSpan)
+	accessClaims := account.newUserClaims(jh.jwtTokenIssuer, lifeSpan)
+	accessClaims.SessionId = session.Id
+	accessToken, err := signToken(jh.jwtSecret, accessClaims)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := account.generateRefreshToken(jh.jwtSecret, jh.jwtTokenIssuer, session.Id, lifeSpan)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{
+		Status:       LoginSuccess,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		Account:      account,
+	}, nil
+}
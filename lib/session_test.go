@@ -0,0 +1,64 @@
+package lib
+
+import (
+	"errors"
+	"github.com/lefalya/commonuser/definition"
+	"testing"
+	"time"
+)
+
+func TestSessionKeysShareTheAccountSlot(t *testing.T) {
+	sessions := NewSessionManager(newFakeRedis(), testEntityName, time.Hour, 24*time.Hour)
+	if key := sessions.sessionKey("account", "id"); key != "test:session:{account}:id" {
+		t.Errorf("got session key %q", key)
+	}
+	if key := sessions.accountSessionsKey("account"); key != "test:sessions:{account}" {
+		t.Errorf("got session index key %q", key)
+	}
+}
+
+func TestSessionsBelongToTheirAccount(t *testing.T) {
+	sessions := NewSessionManager(newFakeRedis(), testEntityName, time.Hour, 24*time.Hour)
+	ada, charles := newTestMember("ada@example.com"), newTestMember("charles@example.com")
+
+	current, errCreate := sessions.Create(ada, "laptop", "10.0.0.1")
+	if errCreate != nil {
+		t.Fatal(errCreate)
+	}
+	other, errCreate := sessions.Create(ada, "phone", "10.0.0.2")
+	if errCreate != nil {
+		t.Fatal(errCreate)
+	}
+
+	if session, err := sessions.Find(charles.GetUUID(), current.Id); err != nil || session != nil {
+		t.Fatalf("another account found the session: %v, %v", session, err)
+	}
+	if err := sessions.Revoke(charles, current.Id); !errors.Is(err, definition.SessionNotFound) {
+		t.Fatalf("got %v revoking another account's session, want %v", err, definition.SessionNotFound)
+	}
+
+	listed, errList := sessions.List(ada)
+	if errList != nil {
+		t.Fatal(errList)
+	}
+	if len(listed) != 2 {
+		t.Fatalf("listed %d sessions, want 2", len(listed))
+	}
+
+	if err := sessions.RevokeOthers(ada, current.Id); err != nil {
+		t.Fatal(err)
+	}
+	if session, err := sessions.Find(ada.GetUUID(), other.Id); err != nil || session != nil {
+		t.Fatalf("the other session survived: %v, %v", session, err)
+	}
+	if err := sessions.Revoke(ada, current.Id); err != nil {
+		t.Fatal(err)
+	}
+	listed, errList = sessions.List(ada)
+	if errList != nil {
+		t.Fatal(errList)
+	}
+	if len(listed) != 0 {
+		t.Fatalf("listed %d sessions after revoking all, want 0", len(listed))
+	}
+}
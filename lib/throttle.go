@@ -0,0 +1,69 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"github.com/lefalya/commonuser/definition"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// RedisLoginThrottler refuses logins for an identifier after maxAttempts
+// consecutive failures within window.
+type RedisLoginThrottler struct {
+	redis       redis.UniversalClient
+	keyPrefix   string
+	maxAttempts int64
+	window      time.Duration
+}
+
+func (rt *RedisLoginThrottler) key(identifier string) string {
+	return rt.keyPrefix + identifier
+}
+
+func (rt *RedisLoginThrottler) Check(identifier string) error {
+	return rt.CheckContext(context.Background(), identifier)
+}
+
+func (rt *RedisLoginThrottler) CheckContext(ctx context.Context, identifier string) error {
+	attempts, err := rt.redis.Get(ctx, rt.key(identifier)).Int64()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		return err
+	}
+	if attempts >= rt.maxAttempts {
+		return definition.TooManyAttempts
+	}
+	return nil
+}
+
+func (rt *RedisLoginThrottler) RecordFailure(identifier string) error {
+	return rt.RecordFailureContext(context.Background(), identifier)
+}
+
+func (rt *RedisLoginThrottler) RecordFailureContext(ctx context.Context, identifier string) error {
+	pipeline := rt.redis.TxPipeline()
+	pipeline.Incr(ctx, rt.key(identifier))
+	pipeline.ExpireNX(ctx, rt.key(identifier), rt.window)
+	_, err := pipeline.Exec(ctx)
+	return err
+}
+
+func (rt *RedisLoginThrottler) RecordSuccess(identifier string) error {
+	return rt.RecordSuccessContext(context.Background(), identifier)
+}
+
+func (rt *RedisLoginThrottler) RecordSuccessContext(ctx context.Context, identifier string) error {
+	return rt.redis.Del(ctx, rt.key(identifier)).Err()
+}
+
+func NewRedisLoginThrottler(redis redis.UniversalClient, entityName string, maxAttempts int64, window time.Duration) *RedisLoginThrottler {
+	return &RedisLoginThrottler{
+		redis:       redis,
+		keyPrefix:   entityName + ":loginattempt:",
+		maxAttempts: maxAttempts,
+		window:      window,
+	}
+}
@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// Tx is a transaction shared by managers bound to it with WithTx. Side effects
+// outside the database, such as cache writes, session revocations and
+// notifications, are queued with AfterCommit and only run once the transaction
+// committed, so Redis never reflects a rolled back change.
+type Tx struct {
+	*sqlTx
+	afterCommit []func() error
+}
+
+// AfterCommit queues fn to run after a successful commit.
+func (tx *Tx) AfterCommit(fn func() error) {
+	tx.afterCommit = append(tx.afterCommit, fn)
+}
+
+// RunInTx runs fn in a transaction, committing when fn returns nil and rolling
+// back otherwise. The AfterCommit hooks run after the commit; their errors are
+// returned joined, although the changes are committed by then.
+func RunInTx(ctx context.Context, db *sql.DB, fn func(tx *Tx) error) error {
+	begun, errBegin := newSQLDB(db).BeginTx(ctx, nil)
+	if errBegin != nil {
+		return errBegin
+	}
+	tx := &Tx{sqlTx: begun}
+
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+
+	errFn := fn(tx)
+	if errFn != nil {
+		return errFn
+	}
+	errCommit := tx.Commit()
+	if errCommit != nil {
+		return errCommit
+	}
+	committed = true
+
+	var errHooks []error
+	for _, hook := range tx.afterCommit {
+		errHook := hook()
+		if errHook != nil {
+			errHooks = append(errHooks, errHook)
+		}
+	}
+	return errors.Join(errHooks...)
+}
+
+// sqlConn is what the managers query through: the database itself, or the
+// transaction they are bound to.
+type sqlConn interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	table(name string) string
+	dialect() Dialect
+}
+
+// afterCommit runs fn right away without a transaction, otherwise once tx
+// committed.
+func afterCommit(tx *Tx, fn func() error) error {
+	if tx == nil {
+		return fn()
+	}
+	tx.AfterCommit(fn)
+	return nil
+}
@@ -1,73 +1,143 @@
 package commonuser
 
 import (
+	"context"
 	"database/sql"
 	"github.com/lefalya/commonuser/lib"
 	"github.com/redis/go-redis/v9"
+	"time"
 )
 
-func NewAccountManagerSQL(db *sql.DB, redis *redis.Client, entityName string) *lib.AccountManagerSQL {
-	return lib.NewAccountManagerSQL(db, redis, entityName)
+// NewAccountManagerSQL refuses to start against a schema with pending
+// migrations; run Migrate first.
+func NewAccountManagerSQL(db *sql.DB, redis redis.UniversalClient, entityName string) (*lib.AccountManagerSQL, error) {
+	errSchema := lib.NewMigrator(db, entityName).CheckSchema()
+	if errSchema != nil {
+		return nil, errSchema
+	}
+	return lib.NewAccountManagerSQL(db, redis, entityName), nil
 }
 
-func NewUpdateEmailManagerSQL(db *sql.DB, entityName string) *lib.UpdateEmailManagerSQL {
-	return lib.NewUpdateEmailManagerSQL(db, entityName)
+// NewUpdateEmailManagerSQL refuses to start against a schema with pending
+// migrations; run Migrate first.
+func NewUpdateEmailManagerSQL(db *sql.DB, redis redis.UniversalClient, entityName string) (*lib.UpdateEmailManagerSQL, error) {
+	errSchema := lib.NewMigrator(db, entityName).CheckSchema()
+	if errSchema != nil {
+		return nil, errSchema
+	}
+	return lib.NewUpdateEmailManagerSQL(db, redis, entityName), nil
 }
 
-func NewResetPasswordSQL(db *sql.DB, redis *redis.Client, entityName string) *lib.ResetPasswordManagerSQL {
-	return lib.NewResetPasswordSQL(db, redis, entityName)
+// NewResetPasswordSQL refuses to start against a schema with pending
+// migrations; run Migrate first.
+func NewResetPasswordSQL(db *sql.DB, redis redis.UniversalClient, entityName string) (*lib.ResetPasswordManagerSQL, error) {
+	errSchema := lib.NewMigrator(db, entityName).CheckSchema()
+	if errSchema != nil {
+		return nil, errSchema
+	}
+	return lib.NewResetPasswordManagerSQL(db, redis, entityName), nil
+}
+
+func NewPasswordHistoryManagerSQL(db *sql.DB, entityName string, depth int) *lib.PasswordHistoryManagerSQL {
+	return lib.NewPasswordHistoryManagerSQL(db, entityName, depth)
+}
+
+func NewEmailVerificationManagerSQL(db *sql.DB, redis redis.UniversalClient, entityName string) *lib.EmailVerificationManagerSQL {
+	return lib.NewEmailVerificationManagerSQL(db, redis, entityName)
+}
+
+func NewRedisLoginThrottler(redis redis.UniversalClient, entityName string, maxAttempts int64, window time.Duration) *lib.RedisLoginThrottler {
+	return lib.NewRedisLoginThrottler(redis, entityName, maxAttempts, window)
+}
+
+func NewSessionManager(redis redis.UniversalClient, entityName string, idleTimeout time.Duration, absoluteTimeout time.Duration) *lib.SessionManager {
+	return lib.NewSessionManager(redis, entityName, idleTimeout, absoluteTimeout)
+}
+
+func NewInvalidationBus(redis redis.UniversalClient, entityName string) (*lib.InvalidationBus, error) {
+	return lib.NewInvalidationBus(redis, entityName)
+}
+
+func NewCookieSessionHandler(jwtHandler *lib.JWTHandler, accountManager *lib.AccountManagerSQL, config lib.CookieConfig) *lib.CookieSessionHandler {
+	return lib.NewCookieSessionHandler(jwtHandler, accountManager, config)
+}
+
+func NewRoleManagerSQL(db *sql.DB, redis redis.UniversalClient, entityName string) *lib.RoleManagerSQL {
+	return lib.NewRoleManagerSQL(db, redis, entityName)
+}
+
+func NewOrganizationManagerSQL(db *sql.DB, entityName string) *lib.OrganizationManagerSQL {
+	return lib.NewOrganizationManagerSQL(db, entityName)
+}
+
+func NewAPIKeyManagerSQL(db *sql.DB, entityName string, prefix string) (*lib.APIKeyManagerSQL, error) {
+	return lib.NewAPIKeyManagerSQL(db, entityName, prefix)
+}
+
+func NewServiceAccountManagerSQL(db *sql.DB, entityName string, jwtHandler *lib.JWTHandler) *lib.ServiceAccountManagerSQL {
+	return lib.NewServiceAccountManagerSQL(db, entityName, jwtHandler)
+}
+
+func NewOAuthClientManagerSQL(db *sql.DB, entityName string) *lib.OAuthClientManagerSQL {
+	return lib.NewOAuthClientManagerSQL(db, entityName)
+}
+
+func NewOAuthProvider(redis redis.UniversalClient, entityName string, clients *lib.OAuthClientManagerSQL, accountManager *lib.AccountManagerSQL, jwtHandler *lib.JWTHandler, config lib.OAuthProviderConfig) (*lib.OAuthProvider, error) {
+	return lib.NewOAuthProvider(redis, entityName, clients, accountManager, jwtHandler, config)
 }
 
 func NewJWTHandler(jwtSecret string, jwtTokenIssuer string, jwtTokenLifeSpan int) *lib.JWTHandler {
 	return lib.NewJWTHandler(jwtSecret, jwtTokenIssuer, jwtTokenLifeSpan)
 }
 
-func CreateResetPasswordTableSQL(db *sql.DB, entityName string) error {
-	tableName := entityName + "ResetPassword"
-	query := `CREATE TABLE IF NOT EXISTS ` + tableName + ` (
-		email VARCHAR(255) UNIQUE NOT NULL,
-		uuid VARCHAR(255) UNIQUE,
-		accountuuid VARCHAR(255) UNIQUE,
-		createdat TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updatedat TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		token VARCHAR(255) UNIQUE
-	)`
-
-	_, err := db.Exec(query)
+func NewBreachedPasswordList(path string) (*lib.BreachedPasswordList, error) {
+	return lib.NewBreachedPasswordList(path)
+}
+
+func DefaultPasswordPolicy() *lib.PasswordPolicy {
+	return lib.DefaultPasswordPolicy()
+}
+
+func NewMigrator(db *sql.DB, entityName string) *lib.Migrator {
+	return lib.NewMigrator(db, entityName)
+}
+
+// Migrate brings the tables of entityName up to the latest schema version.
+func Migrate(db *sql.DB, entityName string) error {
+	_, err := lib.NewMigrator(db, entityName).Up()
 	return err
 }
 
+// CreateAccountTableSQL migrates every table of entityName, not only the
+// account table.
+//
+// Deprecated: use Migrate, which creates and upgrades every table.
 func CreateAccountTableSQL(db *sql.DB, entityName string) error {
-	query := `CREATE TABLE IF NOT EXISTS ` + entityName + ` (
-		uuid VARCHAR(255) UNIQUE NOT NULL,
-		randId VARCHAR(255) UNIQUE,
-		createdat TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updatedat TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		name VARCHAR(255),
-		username VARCHAR(255) UNIQUE,
-		password VARCHAR(255),
-		email VARCHAR(255) UNIQUE,
-		avatar VARCHAR(255),
-		suspended BOOLEAN DEFAULT FALSE
-	)`
-
-	_, err := db.Exec(query)
-	return err
+	return Migrate(db, entityName)
+}
+
+// CreateResetPasswordTableSQL migrates every table of entityName, not only the
+// reset password table.
+//
+// Deprecated: use Migrate, which creates and upgrades every table.
+func CreateResetPasswordTableSQL(db *sql.DB, entityName string) error {
+	return Migrate(db, entityName)
 }
 
+// CreateUpdateEmailTableSQL migrates every table of entityName, not only the
+// update email table.
+//
+// Deprecated: use Migrate, which creates and upgrades every table.
 func CreateUpdateEmailTableSQL(db *sql.DB, entityName string) error {
-	tableName := entityName + "UpdateEmail"
-	query := `CREATE TABLE IF NOT EXISTS ` + tableName + ` (
-		uuid VARCHAR(255) UNIQUE NOT NULL,
-		randId VARCHAR(255) UNIQUE,
-		createdat TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updatedat TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		accountuuid VARCHAR(255) UNIQUE,
-		previousemailaddress VARCHAR(255),
-		newemailaddress VARCHAR(255) UNIQUE,
-		resettoken VARCHAR(255)
-	)`
-
-	_, err := db.Exec(query)
-	return err
+	return Migrate(db, entityName)
+}
+
+// SetDialect overrides the SQL dialect detected from the driver of db.
+func SetDialect(db *sql.DB, dialect lib.Dialect) {
+	lib.SetDialect(db, dialect)
+}
+
+// RunInTx runs fn in a transaction; bind managers to it with their WithTx.
+func RunInTx(ctx context.Context, db *sql.DB, fn func(tx *lib.Tx) error) error {
+	return lib.RunInTx(ctx, db, fn)
 }